@@ -18,18 +18,24 @@ func Connect(addr string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn: conn, r: bufio.NewReader(conn)}, nil
+	return NewClient(conn), nil
+}
+
+// NewClient wraps an established connection, such as one to a unix socket.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn, r: bufio.NewReader(conn)}
 }
 
 // Login sends the NICK and USER commands using the same value.
 // IRC servers typically require both commands during connection
 // setup but in this client the values are always identical.  Login
 // combines the two so callers don't have to issue them separately.
+// The name doubles as the real name in the USER command.
 func (c *Client) Login(name string) error {
 	if err := c.sendf("NICK %s", name); err != nil {
 		return err
 	}
-	return c.sendf("USER %s", name)
+	return c.sendf("USER %s 0 * :%s", name, name)
 }
 
 // Join joins the given channel.
@@ -47,6 +53,11 @@ func (c *Client) Msg(target, message string) error {
 	return c.sendf("PRIVMSG %s :%s", target, message)
 }
 
+// Send sends a raw protocol line.
+func (c *Client) Send(line string) error {
+	return c.sendf("%s", line)
+}
+
 // ReadLine reads a line from the server.
 func (c *Client) ReadLine() (string, error) {
 	line, err := c.r.ReadString('\n')
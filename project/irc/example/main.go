@@ -5,33 +5,43 @@ import (
 	"os"
 	"time"
 
-	"vibes/client"
 	"vibes/irc"
 )
 
 func main() {
-	irc.Logger = log.New(os.Stdout, "", log.LstdFlags)
-	irc.ErrorLogger = irc.Logger
-
 	srv := irc.NewServer(":6667")
+	srv.SetLogSink(irc.NewJSONSink(os.Stdout))
 	go func() {
 		if err := srv.Run(); err != nil {
-			irc.ErrorLogger.Fatal(err)
+			log.Fatal(err)
 		}
 	}()
 
 	// Wait for the server to be ready
 	<-srv.Ready()
 
-	cli, err := client.Connect("localhost:6667")
+	// Bots talk to the server in the same process, without a connection.
+	greeter, err := srv.NewBot("greeter", "Greeter", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer cli.Close()
+	greeter.Join("#chat")
+	srv.OnJoin(func(e irc.JoinEvent) {
+		if e.Nick != greeter.Nick() {
+			greeter.Msg(e.Channel, "Welcome to "+e.Channel+", "+e.Nick+"!")
+		}
+	})
 
-	cli.Login("tester")
-	cli.Join("#chat")
-	cli.Msg("#chat", "hello world")
+	tester, err := srv.NewBot("tester", "Tester", func(b *irc.Bot, m *irc.Message) {
+		if m.Command == "PRIVMSG" {
+			log.Printf("tester got <%s> %s", m.Source, m.Params[len(m.Params)-1])
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	tester.Join("#chat")
+	tester.Msg("#chat", "hello world")
 
 	time.Sleep(100 * time.Millisecond)
 }
@@ -0,0 +1,115 @@
+package irc
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// saslMechanisms lists the SASL mechanisms offered with the sasl capability.
+const saslMechanisms = "PLAIN"
+
+// saslChunkLen is the size of a full AUTHENTICATE chunk. A payload ends with
+// a shorter chunk, or with "+" when its length is a multiple of the chunk
+// size.
+const saslChunkLen = 400
+
+// maxSASLPayload limits the size of an assembled, still encoded payload.
+const maxSASLPayload = 4 * saslChunkLen
+
+// account returns the configured account called name. The caller must hold
+// s.mu.
+func (s *Server) account(name string) (AccountConfig, bool) {
+	key := s.fold(name)
+	for _, a := range s.cfg.Load().Accounts {
+		if s.fold(a.Name) == key {
+			return a, true
+		}
+	}
+	return AccountConfig{}, false
+}
+
+// checkAccount returns the account called name if password matches it.
+func (s *Server) checkAccount(name, password string) (AccountConfig, bool) {
+	s.mu.Lock()
+	acct, ok := s.account(name)
+	s.mu.Unlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(acct.Password), []byte(password)) != 1 {
+		return AccountConfig{}, false
+	}
+	return acct, true
+}
+
+// handleAuthenticate implements SASL PLAIN authentication. Logging in is
+// only possible before registration completes.
+func (s *Server) handleAuthenticate(c *Client, params []string) {
+	if c.registered || c.account != "" {
+		s.numeric(c, errSASLAlready, "You have already authenticated using SASL")
+		return
+	}
+	arg := params[0]
+	if arg == "*" {
+		c.saslMech = ""
+		c.saslBuf.Reset()
+		s.numeric(c, errSASLAborted, "SASL authentication aborted")
+		return
+	}
+	if c.saslMech == "" {
+		if !strings.EqualFold(arg, "PLAIN") {
+			s.numeric(c, rplSASLMechs, saslMechanisms, "are available SASL mechanisms")
+			s.numeric(c, errSASLFail, "SASL authentication failed")
+			return
+		}
+		c.saslMech = "PLAIN"
+		c.send("AUTHENTICATE +")
+		return
+	}
+	if len(arg) > saslChunkLen || c.saslBuf.Len()+len(arg) > maxSASLPayload {
+		c.saslMech = ""
+		c.saslBuf.Reset()
+		s.numeric(c, errSASLTooLong, "SASL message too long")
+		return
+	}
+	if arg != "+" {
+		c.saslBuf.WriteString(arg)
+	}
+	if len(arg) == saslChunkLen {
+		return
+	}
+	payload := c.saslBuf.String()
+	c.saslMech = ""
+	c.saslBuf.Reset()
+	s.saslPlain(c, payload)
+}
+
+// saslPlain checks a PLAIN payload: an authorization identity, which must
+// be empty or match the account, the account name and its password,
+// separated by NUL bytes.
+func (s *Server) saslPlain(c *Client, payload string) {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	fields := strings.Split(string(data), "\x00")
+	if err != nil || len(fields) != 3 || (fields[0] != "" && fields[0] != fields[1]) {
+		s.numeric(c, errSASLFail, "SASL authentication failed")
+		return
+	}
+	acct, ok := s.checkAccount(fields[1], fields[2])
+	if !ok {
+		s.logWarn(EventLogin, Fields{"account": fields[1], "host": c.Host}, "Failed login to account %s from %s", fields[1], c.Host)
+		s.numeric(c, errSASLFail, "SASL authentication failed")
+		return
+	}
+	s.mu.Lock()
+	c.account = acct.Name
+	s.mu.Unlock()
+	s.logInfo(EventLogin, Fields{"account": acct.Name, "host": c.Host}, "%s logged in to account %s", c.Host, acct.Name)
+	nick, user := c.nickname(), c.Username
+	if nick == "" {
+		nick = "*"
+	}
+	if user == "" {
+		user = "*"
+	}
+	s.numeric(c, rplLoggedIn, fmt.Sprintf("%s!%s@%s", nick, user, c.Host), acct.Name, "You are now logged in as "+acct.Name)
+	s.numeric(c, rplSASLSuccess, "SASL authentication successful")
+}
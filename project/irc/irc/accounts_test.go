@@ -0,0 +1,66 @@
+package irc
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	ic "vibes/client"
+)
+
+func accountConfig(accounts ...AccountConfig) Config {
+	cfg := DefaultConfig()
+	cfg.Accounts = accounts
+	return cfg
+}
+
+// loginAccount connects to s, logs in to account with SASL PLAIN and
+// registers as nick, consuming the welcome burst.
+func loginAccount(t *testing.T, s *Server, nick, account, password string) *ic.Client {
+	t.Helper()
+	c, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Send("CAP REQ :sasl")
+	c.Send("NICK " + nick)
+	c.Send("USER " + nick + " 0 * :" + nick)
+	readUntil(t, c, "ACK :sasl")
+	c.Send("AUTHENTICATE PLAIN")
+	readUntil(t, c, "AUTHENTICATE +")
+	c.Send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00"+account+"\x00"+password)))
+	readUntil(t, c, " 903 ")
+	c.Send("CAP END")
+	for {
+		line := readUntil(t, c, " ")
+		if strings.Contains(line, " 376 ") || strings.Contains(line, " 422 ") {
+			return c
+		}
+	}
+}
+
+func TestSASLPlainLogin(t *testing.T) {
+	s := startServer(t, accountConfig(AccountConfig{Name: "Alice", Password: "secret"}))
+	alice := loginAccount(t, s, "alice", "alice", "secret")
+	alice.Send("WHOIS alice")
+	readUntil(t, alice, " 330 alice alice Alice :is logged in as")
+	alice.Send("MODE alice")
+	if line := readUntil(t, alice, " 221 "); !strings.Contains(line, "r") {
+		t.Errorf("expected +r in %q", line)
+	}
+
+	bob, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	bob.Send("CAP LS 302")
+	readUntil(t, bob, "sasl=PLAIN")
+	bob.Send("AUTHENTICATE SCRAM-SHA-256")
+	readUntil(t, bob, " 908 * PLAIN ")
+	bob.Send("AUTHENTICATE PLAIN")
+	readUntil(t, bob, "AUTHENTICATE +")
+	bob.Send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wrong")))
+	readUntil(t, bob, " 904 ")
+}
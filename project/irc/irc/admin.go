@@ -0,0 +1,398 @@
+package irc
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Admin API
+//
+// When Config.AdminAPI.Addr is set the server answers HTTP requests from
+// scripts that would otherwise need an operator on IRC. Every request must
+// carry the configured token as a bearer token. Bodies and answers are
+// JSON:
+//
+//	GET    /api/clients   registered users
+//	GET    /api/channels  channels with their members and topic
+//	POST   /api/kick      {"channel", "nick", "reason"}
+//	POST   /api/kill      {"nick", "reason"}
+//	POST   /api/topic     {"channel", "topic"}
+//	POST   /api/notice    {"text"}
+//	GET    /api/bans      K-lines and D-lines
+//	POST   /api/bans      {"type": "kline" or "dline", "mask", "reason", "duration"}
+//	DELETE /api/bans?type=kline&mask=...
+//	GET    /api/logs      channel log entries, see apiLogs
+//
+// Actions answer 204 No Content; errors carry {"error": "..."}. Text that
+// ends up in IRC lines may not contain CR, LF or NUL.
+
+// adminSetBy is recorded as the author of bans and topics set through the
+// admin API.
+const adminSetBy = "admin API"
+
+// apiClient describes a user in GET /api/clients.
+type apiClient struct {
+	Nick     string   `json:"nick"`
+	User     string   `json:"user"`
+	Realname string   `json:"realname"`
+	Host     string   `json:"host"`
+	IP       string   `json:"ip,omitempty"`
+	Account  string   `json:"account,omitempty"`
+	Server   string   `json:"server"`
+	Modes    string   `json:"modes"`
+	Channels []string `json:"channels"`
+	// Idle is the number of seconds since the user last sent a line. It
+	// is unknown for users of other servers.
+	Idle *int64 `json:"idle,omitempty"`
+}
+
+// apiChannel describes a channel in GET /api/channels.
+type apiChannel struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Modes is always "+" while the server implements no channel modes.
+	Modes      string     `json:"modes"`
+	Topic      string     `json:"topic"`
+	TopicSetBy string     `json:"topic_set_by,omitempty"`
+	TopicSetAt *time.Time `json:"topic_set_at,omitempty"`
+	Members    []string   `json:"members"`
+}
+
+// serveAdmin serves the admin API on ln until it is closed.
+func (s *Server) serveAdmin(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/clients", s.apiClients)
+	mux.HandleFunc("/api/channels", s.apiChannels)
+	mux.HandleFunc("/api/kick", s.apiKick)
+	mux.HandleFunc("/api/kill", s.apiKill)
+	mux.HandleFunc("/api/topic", s.apiTopic)
+	mux.HandleFunc("/api/notice", s.apiNotice)
+	mux.HandleFunc("/api/bans", s.apiBans)
+	mux.HandleFunc("/api/logs", s.apiLogs)
+	srv := &http.Server{Handler: s.adminAuth(mux), ErrorLog: s.httpErrorLog("admin")}
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logError(EventServer, Fields{"listener": "admin", "error": err.Error()}, "admin API listener failed: %v", err)
+	}
+}
+
+// adminAuth rejects requests without the configured bearer token.
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		want := s.config().AdminAPI.Token
+		if !ok || want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// allowMethod answers 405 unless r uses method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+// readJSON decodes the body of a POST request into v, answering the
+// request itself when that fails.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if !allowMethod(w, r, http.MethodPost) {
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// lineSafe answers 400 unless every value may go into an IRC line, that is
+// holds no CR, LF or NUL.
+func lineSafe(w http.ResponseWriter, values ...string) bool {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n\x00") {
+			apiError(w, http.StatusBadRequest, "fields may not contain CR, LF or NUL")
+			return false
+		}
+	}
+	return true
+}
+
+// idleTime returns how long the local user c has been silent. A session is
+// as idle as its most recently active connection.
+func idleTime(c *Client, now time.Time) time.Duration {
+	if c.Conn != nil {
+		return now.Sub(time.Unix(0, c.lastActive.Load()))
+	}
+	var last int64
+	for _, conn := range c.attached() {
+		if t := conn.lastActive.Load(); t > last {
+			last = t
+		}
+	}
+	if last == 0 {
+		return now.Sub(c.detachedAt)
+	}
+	return now.Sub(time.Unix(0, last))
+}
+
+func (s *Server) apiClients(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	now := time.Now()
+	s.mu.RLock()
+	users := s.nicks.all()
+	clients := make([]apiClient, 0, len(users))
+	for _, u := range users {
+		if !u.registered {
+			continue
+		}
+		ac := apiClient{
+			Nick: u.nickname(), User: u.Username, Realname: u.Realname, Host: u.Host,
+			IP: u.ip, Account: u.account, Server: s.serverOf(u), Modes: modeString(u.modes),
+			Channels: s.channelNames(u),
+		}
+		if u.via == nil {
+			idle := int64(idleTime(u, now).Seconds())
+			ac.Idle = &idle
+		}
+		clients = append(clients, ac)
+	}
+	s.mu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Nick < clients[j].Nick })
+	writeJSON(w, clients)
+}
+
+func (s *Server) apiChannels(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	s.mu.RLock()
+	chans := s.channels.all()
+	channels := make([]apiChannel, 0, len(chans))
+	for _, ch := range chans {
+		ch.mu.RLock()
+		ac := apiChannel{
+			Name: ch.Name, Created: time.Unix(ch.ts, 0).UTC(), Modes: "+",
+			Topic: ch.topic, TopicSetBy: ch.topicBy, Members: []string{},
+		}
+		if ch.topic != "" {
+			at := ch.topicAt.UTC()
+			ac.TopicSetAt = &at
+		}
+		for m := range ch.Members {
+			ac.Members = append(ac.Members, m.nickname())
+		}
+		ch.mu.RUnlock()
+		sort.Strings(ac.Members)
+		channels = append(channels, ac)
+	}
+	s.mu.RUnlock()
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	writeJSON(w, channels)
+}
+
+func (s *Server) apiKick(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Channel, Nick, Reason string }
+	if !readJSON(w, r, &req) || !lineSafe(w, req.Channel, req.Nick, req.Reason) {
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = req.Nick
+	}
+	u := s.nicks.get(s.fold(req.Nick))
+	server := s.config().ServerName
+	if u == nil {
+		apiError(w, http.StatusNotFound, "no such nick "+req.Nick)
+		return
+	}
+	if !s.kick(server, req.Channel, u, req.Reason) {
+		apiError(w, http.StatusNotFound, req.Nick+" is not on "+req.Channel)
+		return
+	}
+	if u.id != "" {
+		s.propagate(nil, fmt.Sprintf(":%s KICK %s %s :%s", s.sid, req.Channel, u.id, req.Reason))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// kick removes u from a channel on behalf of source, a server name, and
+// tells the members, u included. It reports whether u was on the channel.
+func (s *Server) kick(source, name string, u *Client, reason string) bool {
+	ch, members, member := s.removeMember(u, s.fold(name))
+	if !member {
+		return false
+	}
+	name = ch.Name
+	s.logInfo(EventKick, Fields{"by": source, "nick": u.nickname(), "channel": name, "reason": reason}, "%s kicked %s from %s (%s)", source, u.nickname(), name, reason)
+	s.logChannel(name, "kick", source, u.nickname(), reason)
+	s.emitPart(PartEvent{Nick: u.nickname(), Channel: name, By: source, Reason: reason})
+	s.broadcast(members, fmt.Sprintf(":%s KICK %s %s :%s", source, name, u.nickname(), reason))
+	return true
+}
+
+// apiKill disconnects a local user. The connections of an always-on
+// session are closed but the session stays.
+func (s *Server) apiKill(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Nick, Reason string }
+	if !readJSON(w, r, &req) || !lineSafe(w, req.Nick, req.Reason) {
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "No reason given"
+	}
+	u := s.nicks.get(s.fold(req.Nick))
+	switch {
+	case u == nil:
+		apiError(w, http.StatusNotFound, "no such nick "+req.Nick)
+		return
+	case u.via != nil:
+		apiError(w, http.StatusBadRequest, req.Nick+" is on another server")
+		return
+	}
+	s.logInfo(EventOper, Fields{"by": adminSetBy, "nick": u.nickname(), "reason": req.Reason}, "%s killed %s (%s)", adminSetBy, u.nickname(), req.Reason)
+	for _, conn := range u.connections() {
+		s.quit(conn, "Killed: "+req.Reason)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiTopic(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Channel, Topic string }
+	if !readJSON(w, r, &req) || !lineSafe(w, req.Channel, req.Topic) {
+		return
+	}
+	cfg := s.config()
+	text := truncateTopic(req.Topic, cfg.TopicLen)
+	at := time.Now()
+	if !s.setTopic(cfg.ServerName, req.Channel, text, adminSetBy, at) {
+		apiError(w, http.StatusNotFound, "no such channel "+req.Channel)
+		return
+	}
+	s.propagate(nil, topicLine(s.sid, req.Channel, text, adminSetBy, at))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiNotice sends a server notice to every local user.
+func (s *Server) apiNotice(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Text string }
+	if !readJSON(w, r, &req) || !lineSafe(w, req.Text) {
+		return
+	}
+	if req.Text == "" {
+		apiError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	server := s.config().ServerName
+	var users []*Client
+	s.mu.RLock()
+	for _, u := range s.nicks.all() {
+		if u.registered && u.via == nil {
+			users = append(users, u)
+		}
+	}
+	s.mu.RUnlock()
+	for _, u := range users {
+		u.send(fmt.Sprintf(":%s NOTICE %s :%s", server, u.nickname(), req.Text))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		s.mu.Lock()
+		bans := banList{KLines: activeBans(s.bans.KLines, now), DLines: activeBans(s.bans.DLines, now)}
+		s.mu.Unlock()
+		if bans.KLines == nil {
+			bans.KLines = []ban{}
+		}
+		if bans.DLines == nil {
+			bans.DLines = []ban{}
+		}
+		writeJSON(w, bans)
+	case http.MethodPost:
+		var req struct{ Type, Mask, Reason, Duration string }
+		if !readJSON(w, r, &req) || !lineSafe(w, req.Mask, req.Reason) {
+			return
+		}
+		dline, ok := banType(req.Type)
+		if !ok {
+			apiError(w, http.StatusBadRequest, `type must be "kline" or "dline"`)
+			return
+		}
+		mask, ok := banMask(dline, req.Mask)
+		if req.Mask == "" || !ok {
+			apiError(w, http.StatusBadRequest, "invalid mask "+req.Mask)
+			return
+		}
+		if req.Reason == "" {
+			req.Reason = "No reason given"
+		}
+		now := time.Now()
+		b := ban{Mask: mask, Reason: req.Reason, SetBy: adminSetBy, Set: now}
+		if req.Duration != "" {
+			d, ok := parseBanDuration(req.Duration)
+			if !ok {
+				apiError(w, http.StatusBadRequest, "invalid duration "+req.Duration)
+				return
+			}
+			b.Expires = now.Add(d)
+		}
+		s.placeBan(dline, b)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		dline, ok := banType(r.URL.Query().Get("type"))
+		if !ok {
+			apiError(w, http.StatusBadRequest, `type must be "kline" or "dline"`)
+			return
+		}
+		mask, _ := banMask(dline, r.URL.Query().Get("mask"))
+		if !s.liftBan(dline, mask, adminSetBy) {
+			apiError(w, http.StatusNotFound, "no ban for "+mask)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// banType reports whether t names D-lines rather than K-lines, and whether
+// it names either.
+func banType(t string) (dline, ok bool) {
+	switch strings.ToLower(t) {
+	case "kline":
+		return false, true
+	case "dline":
+		return true, true
+	}
+	return false, false
+}
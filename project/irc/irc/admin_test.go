@@ -0,0 +1,187 @@
+package irc
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	ic "vibes/client"
+)
+
+// adminRequest sends an admin API request to s with the token "t0ken".
+func adminRequest(t *testing.T, s *Server, method, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+s.AdminAddr+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer t0ken")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func startAdmin(t *testing.T, name string, peers ...string) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ServerName = name
+	cfg.AdminAPI = AdminAPIConfig{Addr: "127.0.0.1:0", Token: "t0ken"}
+	for _, p := range peers {
+		cfg.Links = append(cfg.Links, LinkConfig{Name: p, Password: "linkpw"})
+	}
+	return startServer(t, cfg)
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	s := startAdmin(t, "irc.test")
+	for _, auth := range []string{"", "Bearer wrong", "t0ken"} {
+		req, _ := http.NewRequest("GET", "http://"+s.AdminAddr+"/api/clients", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d", auth, resp.StatusCode)
+		}
+	}
+	if code, _ := adminRequest(t, s, "POST", "/api/clients", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /api/clients: status %d", code)
+	}
+}
+
+func TestAdminAPIListsAndModerates(t *testing.T) {
+	s := startAdmin(t, "irc.test")
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	for _, c := range []*ic.Client{alice, bob} {
+		c.Join("#chat")
+		readUntil(t, c, " 366 ")
+	}
+
+	_, body := adminRequest(t, s, "GET", "/api/clients", "")
+	var clients []apiClient
+	if err := json.Unmarshal([]byte(body), &clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 || clients[0].Nick != "alice" || clients[0].Channels[0] != "#chat" ||
+		clients[0].Server != "irc.test" || clients[0].Idle == nil {
+		t.Errorf("clients = %s", body)
+	}
+
+	code, _ := adminRequest(t, s, "POST", "/api/topic", `{"channel": "#chat", "topic": "Be nice"}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("topic: status %d", code)
+	}
+	readUntil(t, alice, ":irc.test TOPIC #chat :Be nice")
+	_, body = adminRequest(t, s, "GET", "/api/channels", "")
+	var channels []apiChannel
+	if err := json.Unmarshal([]byte(body), &channels); err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Topic != "Be nice" || channels[0].TopicSetBy != adminSetBy ||
+		strings.Join(channels[0].Members, ",") != "alice,bob" || channels[0].Modes != "+" {
+		t.Errorf("channels = %s", body)
+	}
+
+	adminRequest(t, s, "POST", "/api/notice", `{"text": "Maintenance at noon"}`)
+	readUntil(t, bob, ":irc.test NOTICE bob :Maintenance at noon")
+	code, _ = adminRequest(t, s, "POST", "/api/kick", `{"channel": "#chat", "nick": "bob", "reason": "cool off"}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("kick: status %d", code)
+	}
+	readUntil(t, alice, ":irc.test KICK #chat bob :cool off")
+	readUntil(t, bob, ":irc.test KICK #chat bob :cool off")
+	if code, body := adminRequest(t, s, "POST", "/api/kick", `{"channel": "#chat", "nick": "bob"}`); code != http.StatusNotFound {
+		t.Errorf("second kick: %d %s", code, body)
+	}
+	adminRequest(t, s, "POST", "/api/kill", `{"nick": "bob", "reason": "spam"}`)
+	readUntil(t, bob, "(Killed: spam)")
+	if code, _ := adminRequest(t, s, "POST", "/api/kill", `{"nick": "nobody"}`); code != http.StatusNotFound {
+		t.Errorf("kill of unknown nick: status %d", code)
+	}
+}
+
+func TestAdminAPIBans(t *testing.T) {
+	s := startAdmin(t, "irc.test")
+	alice := login(t, s, "alice")
+
+	if code, _ := adminRequest(t, s, "POST", "/api/bans", `{"type": "gline", "mask": "x"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown type: status %d", code)
+	}
+	if code, _ := adminRequest(t, s, "POST", "/api/bans", `{"type": "dline", "mask": "nope"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid D-line: status %d", code)
+	}
+	code, _ := adminRequest(t, s, "POST", "/api/bans", `{"type": "kline", "mask": "alice@*", "reason": "bye", "duration": "1h"}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("kline: status %d", code)
+	}
+	readUntil(t, alice, " 465 alice :You are banned from this server: bye")
+
+	_, body := adminRequest(t, s, "GET", "/api/bans", "")
+	var bans banList
+	if err := json.Unmarshal([]byte(body), &bans); err != nil {
+		t.Fatal(err)
+	}
+	if len(bans.KLines) != 1 || bans.KLines[0].Mask != "alice@*" || bans.KLines[0].SetBy != adminSetBy ||
+		bans.KLines[0].Expires.IsZero() || len(bans.DLines) != 0 {
+		t.Errorf("bans = %s", body)
+	}
+	if code, _ := adminRequest(t, s, "DELETE", "/api/bans?type=kline&mask=alice@*", ""); code != http.StatusNoContent {
+		t.Errorf("delete: status %d", code)
+	}
+	if code, _ := adminRequest(t, s, "DELETE", "/api/bans?type=kline&mask=alice@*", ""); code != http.StatusNotFound {
+		t.Errorf("second delete: status %d", code)
+	}
+	login(t, s, "alice")
+}
+
+func TestAdminAPIKickCrossesLinks(t *testing.T) {
+	a := startAdmin(t, "a.test")
+	b := startAdmin(t, "b.test", "a.test")
+	link(t, a, b)
+	bob := login(t, b, "bob")
+	bob.Join("#room")
+	readUntil(t, bob, " 366 ")
+	waitFor(t, a, "#room", func() bool { return a.channels.get("#room") != nil })
+
+	if code, body := adminRequest(t, a, "POST", "/api/kick", `{"channel": "#room", "nick": "bob"}`); code != http.StatusNoContent {
+		t.Fatalf("kick: %d %s", code, body)
+	}
+	readUntil(t, bob, ":a.test KICK #room bob :bob")
+	if code, _ := adminRequest(t, a, "POST", "/api/kill", `{"nick": "bob"}`); code != http.StatusBadRequest {
+		t.Errorf("kill of remote user: status %d", code)
+	}
+}
+
+func TestAdminAPIRejectsLineBreaks(t *testing.T) {
+	s := startAdmin(t, "irc.test")
+	alice := login(t, s, "alice")
+	alice.Join("#chat")
+	readUntil(t, alice, " 366 ")
+
+	for _, req := range [][2]string{
+		{"/api/notice", `{"text": "hi\r\nKILL alice :gone"}`},
+		{"/api/topic", `{"channel": "#chat", "topic": "x\nQUIT :y"}`},
+		{"/api/kick", `{"channel": "#chat", "nick": "alice", "reason": "a\u0000b"}`},
+		{"/api/kill", `{"nick": "alice", "reason": "x\r\nPRIVMSG #chat :y"}`},
+		{"/api/bans", `{"type": "kline", "mask": "nobody@*", "reason": "x\nKILL alice"}`},
+	} {
+		if code, body := adminRequest(t, s, "POST", req[0], req[1]); code != http.StatusBadRequest {
+			t.Errorf("%s %s: %d %s", req[0], req[1], code, body)
+		}
+	}
+	alice.Send("PING :still here")
+	if line := readUntil(t, alice, "PONG"); !strings.Contains(line, "still here") {
+		t.Errorf("got %q", line)
+	}
+}
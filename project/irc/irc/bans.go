@@ -0,0 +1,356 @@
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server bans
+//
+// Operators ban users with K-lines, user@host masks checked when a client
+// registers, and D-lines, addresses or CIDR ranges checked as soon as a
+// connection arrives and again at registration, after WEBIRC may have
+// changed the address. Adding a ban disconnects the users it matches. Bans
+// may expire and are kept in Config.BansFile when it is set.
+
+// ban is a K-line or D-line.
+type ban struct {
+	Mask   string    `json:"mask"`
+	Reason string    `json:"reason"`
+	SetBy  string    `json:"set_by"`
+	Set    time.Time `json:"set"`
+	// Expires is zero for bans that do not expire.
+	Expires time.Time `json:"expires,omitempty"`
+	// ipNet is the range a D-line covers, nil if its mask is invalid.
+	ipNet *net.IPNet
+}
+
+// active reports whether b is in effect at now.
+func (b ban) active(now time.Time) bool {
+	return b.Expires.IsZero() || now.Before(b.Expires)
+}
+
+// banList holds the bans of a server, as stored in the bans file.
+type banList struct {
+	KLines []ban `json:"klines"`
+	DLines []ban `json:"dlines"`
+}
+
+// loadBans reads the bans file at path. A missing file holds no bans.
+func loadBans(path string) (banList, error) {
+	var bans banList
+	if path == "" {
+		return bans, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return bans, nil
+	}
+	if err != nil {
+		return bans, err
+	}
+	err = json.Unmarshal(data, &bans)
+	bans.parseDLines()
+	return bans, err
+}
+
+// parseDLines parses the masks of the D-lines in l.
+func (l *banList) parseDLines() {
+	for i := range l.DLines {
+		l.DLines[i].ipNet = dlineNet(l.DLines[i].Mask)
+	}
+}
+
+// dlineNet returns the range the D-line mask covers, nil if it is not an
+// address or CIDR range.
+func dlineNet(mask string) *net.IPNet {
+	nets, err := parseCIDRs([]string{mask})
+	if err != nil {
+		return nil
+	}
+	return nets[0]
+}
+
+// saveBans writes the bans to the bans file, dropping expired ones. The
+// caller must hold s.mu.
+func (s *Server) saveBans() {
+	now := time.Now()
+	s.bans.KLines = activeBans(s.bans.KLines, now)
+	s.bans.DLines = activeBans(s.bans.DLines, now)
+	if s.bansFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.bans, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.bansFile, data)
+	}
+	if err != nil {
+		s.logError(EventServer, Fields{"file": s.bansFile, "error": err.Error()}, "saving bans failed: %v", err)
+	}
+}
+
+func activeBans(bans []ban, now time.Time) []ban {
+	var kept []ban
+	for _, b := range bans {
+		if b.active(now) {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+// dlined returns the D-line matching the address ip. The caller must hold
+// s.mu.
+func (s *Server) dlined(ip string) (ban, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ban{}, false
+	}
+	now := time.Now()
+	for _, b := range s.bans.DLines {
+		if b.ipNet != nil && b.active(now) && b.ipNet.Contains(addr) {
+			return b, true
+		}
+	}
+	return ban{}, false
+}
+
+// klined returns the K-line matching c. The caller must hold s.mu.
+func (s *Server) klined(c *Client) (ban, bool) {
+	now := time.Now()
+	for _, b := range s.bans.KLines {
+		if !b.active(now) {
+			continue
+		}
+		if matchMask("ascii", b.Mask, c.Username+"@"+c.Host) ||
+			(c.ip != "" && matchMask("ascii", b.Mask, c.Username+"@"+c.ip)) {
+			return b, true
+		}
+	}
+	return ban{}, false
+}
+
+// banned disconnects c if a ban matches it, reporting whether it did.
+func (s *Server) banned(c *Client) bool {
+	s.mu.Lock()
+	b, ok := s.dlined(c.ip)
+	kind := "D-lined"
+	if !ok {
+		b, ok = s.klined(c)
+		kind = "K-lined"
+	}
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	s.logInfo(EventDisconnect, Fields{"nick": c.nickname(), "user": c.Username, "host": c.Host, "ban": b.Mask, "reason": b.Reason},
+		"%s!%s@%s is %s: %s", c.nickname(), c.Username, c.Host, kind, b.Reason)
+	s.numeric(c, errYoureBannedCreep, "You are banned from this server: "+b.Reason)
+	s.quit(c, kind)
+	return true
+}
+
+// handleKline implements KLINE [duration] <user@host> :<reason>.
+func (s *Server) handleKline(c *Client, params []string) {
+	s.addBan(c, "KLINE", params)
+}
+
+// handleDline implements DLINE [duration] <ip|cidr> :<reason>.
+func (s *Server) handleDline(c *Client, params []string) {
+	s.addBan(c, "DLINE", params)
+}
+
+// addBan adds the K-line or D-line described by params and disconnects
+// the users it matches. A leading duration is a number of minutes or a Go
+// duration such as 2h30m.
+func (s *Server) addBan(c *Client, cmd string, params []string) {
+	var dur time.Duration
+	if len(params) > 1 {
+		if d, ok := parseBanDuration(params[0]); ok {
+			dur, params = d, params[1:]
+		}
+	}
+	if len(params) == 0 || params[0] == "" {
+		s.numeric(c, errNeedMoreParams, cmd, "Not enough parameters")
+		return
+	}
+	mask, reason := params[0], "No reason given"
+	if len(params) > 1 && params[1] != "" {
+		reason = params[1]
+	}
+	server := s.config().ServerName
+	mask, ok := banMask(cmd == "DLINE", mask)
+	if !ok {
+		c.reply(fmt.Sprintf(":%s NOTICE %s :Invalid D-line mask %s", server, c.nickname(), mask))
+		return
+	}
+	now := time.Now()
+	b := ban{Mask: mask, Reason: reason, SetBy: c.nickname(), Set: now}
+	if dur > 0 {
+		b.Expires = now.Add(dur)
+	}
+
+	kind := "K-line"
+	if cmd == "DLINE" {
+		kind = "D-line"
+	}
+	c.reply(fmt.Sprintf(":%s NOTICE %s :Added %s for %s%s", server, c.nickname(), kind, mask, banExpiry(b)))
+	s.placeBan(cmd == "DLINE", b)
+}
+
+// banMask returns mask in the form bans are stored in: K-line masks
+// without a user part match any user. It reports whether a D-line mask is
+// an address or CIDR range.
+func banMask(dline bool, mask string) (string, bool) {
+	if dline {
+		return mask, dlineNet(mask) != nil
+	}
+	if !strings.Contains(mask, "@") {
+		mask = "*@" + mask
+	}
+	return mask, true
+}
+
+// placeBan adds b as a K-line, or a D-line if dline is set, and
+// disconnects the users it matches.
+func (s *Server) placeBan(dline bool, b ban) {
+	kind := "K-line"
+	s.mu.Lock()
+	list := &s.bans.KLines
+	if dline {
+		kind, list = "D-line", &s.bans.DLines
+		b.ipNet = dlineNet(b.Mask)
+	}
+	*list = append(removeBan(*list, b.Mask), b)
+	s.saveBans()
+	var hit []*Client
+	for _, other := range s.clients {
+		if other.peer != nil || other.quitReason != "" {
+			continue
+		}
+		_, dlined := s.dlined(other.ip)
+		_, klined := s.klined(other)
+		if dline && dlined || !dline && other.registered && klined {
+			hit = append(hit, other)
+		}
+	}
+	s.mu.Unlock()
+
+	fields := Fields{"by": b.SetBy, "kind": kind, "mask": b.Mask, "reason": b.Reason}
+	if !b.Expires.IsZero() {
+		fields["expires"] = b.Expires
+	}
+	s.logInfo(EventOper, fields, "%s added %s for %s (%s)%s", b.SetBy, kind, b.Mask, b.Reason, banExpiry(b))
+	for _, other := range hit {
+		s.numeric(other, errYoureBannedCreep, "You are banned from this server: "+b.Reason)
+		s.quit(other, kind+"d")
+	}
+}
+
+// handleUnkline implements UNKLINE <user@host>.
+func (s *Server) handleUnkline(c *Client, params []string) {
+	s.removeBanCmd(c, "UNKLINE", params)
+}
+
+// handleUndline implements UNDLINE <ip|cidr>.
+func (s *Server) handleUndline(c *Client, params []string) {
+	s.removeBanCmd(c, "UNDLINE", params)
+}
+
+func (s *Server) removeBanCmd(c *Client, cmd string, params []string) {
+	if len(params) == 0 || params[0] == "" {
+		s.numeric(c, errNeedMoreParams, cmd, "Not enough parameters")
+		return
+	}
+	dline := cmd == "UNDLINE"
+	kind := "K-line"
+	if dline {
+		kind = "D-line"
+	}
+	mask, _ := banMask(dline, params[0])
+	server := s.config().ServerName
+	if !s.liftBan(dline, mask, c.nickname()) {
+		c.reply(fmt.Sprintf(":%s NOTICE %s :No %s for %s", server, c.nickname(), kind, mask))
+		return
+	}
+	c.reply(fmt.Sprintf(":%s NOTICE %s :Removed %s for %s", server, c.nickname(), kind, mask))
+}
+
+// liftBan removes the K-line, or D-line if dline is set, for mask on behalf
+// of by. It reports whether there was one.
+func (s *Server) liftBan(dline bool, mask, by string) bool {
+	kind := "K-line"
+	s.mu.Lock()
+	list := &s.bans.KLines
+	if dline {
+		kind, list = "D-line", &s.bans.DLines
+	}
+	before := len(*list)
+	*list = removeBan(*list, mask)
+	removed := len(*list) < before
+	if removed {
+		s.saveBans()
+	}
+	s.mu.Unlock()
+	if removed {
+		s.logInfo(EventOper, Fields{"by": by, "kind": kind, "mask": mask}, "%s removed %s for %s", by, kind, mask)
+	}
+	return removed
+}
+
+// removeBan returns bans without the one for mask.
+func removeBan(bans []ban, mask string) []ban {
+	kept := bans[:0]
+	for _, b := range bans {
+		if !strings.EqualFold(b.Mask, mask) {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+// statsBans lists the active K-lines or D-lines for STATS k and STATS d.
+func (s *Server) statsBans(c *Client, query string) {
+	s.mu.Lock()
+	bans := s.bans.KLines
+	if query == "d" {
+		bans = s.bans.DLines
+	}
+	bans = activeBans(bans, time.Now())
+	s.mu.Unlock()
+	for _, b := range bans {
+		reason := b.Reason + banExpiry(b)
+		if query == "d" {
+			s.numeric(c, rplStatsDLine, "D", b.Mask, reason)
+			continue
+		}
+		user, host, _ := strings.Cut(b.Mask, "@")
+		s.numeric(c, rplStatsKLine, "K", host, "*", user, reason)
+	}
+}
+
+// banExpiry describes when b expires.
+func banExpiry(b ban) string {
+	if b.Expires.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(" (expires %s)", b.Expires.UTC().Format(time.RFC3339))
+}
+
+// parseBanDuration parses a ban duration: minutes, or a Go duration.
+func parseBanDuration(s string) (time.Duration, bool) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * time.Minute, true
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,108 @@
+package irc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	ic "vibes/client"
+)
+
+// operLogin registers nick and makes it an operator of s.
+func operLogin(t *testing.T, s *Server, nick string) *ic.Client {
+	t.Helper()
+	c := login(t, s, nick)
+	c.Send("OPER admin secret")
+	readUntil(t, c, " 381 "+nick+" ")
+	return c
+}
+
+func TestKlineDisconnectsAndPersists(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Opers = []OperConfig{{Name: "admin", Password: "secret"}}
+	cfg.BansFile = filepath.Join(t.TempDir(), "bans.json")
+	s := startServer(t, cfg)
+	oper := operLogin(t, s, "oper")
+	bob := login(t, s, "bob")
+
+	bob.Send("KLINE bob@* :no bobs")
+	readUntil(t, bob, " 481 bob ")
+	oper.Send("KLINE 90 bob@* :no bobs")
+	readUntil(t, oper, "NOTICE oper :Added K-line for bob@* (expires ")
+	readUntil(t, bob, " 465 bob :You are banned from this server: no bobs")
+	readUntil(t, bob, "ERROR :Closing Link")
+
+	again, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { again.Close() })
+	again.Login("bob")
+	readUntil(t, again, " 465 bob :You are banned from this server: no bobs")
+
+	restarted := startServer(t, cfg)
+	oper2 := operLogin(t, restarted, "oper")
+	oper2.Send("STATS k")
+	readUntil(t, oper2, " 216 oper K * * bob :no bobs (expires ")
+	oper2.Send("UNKLINE bob@*")
+	readUntil(t, oper2, "NOTICE oper :Removed K-line for bob@*")
+	login(t, restarted, "bob")
+	oper2.Send("UNKLINE bob@*")
+	readUntil(t, oper2, "NOTICE oper :No K-line for bob@*")
+}
+
+func TestDlineCheckedOnConnectAndRegistration(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Opers = []OperConfig{{Name: "admin", Password: "secret"}}
+	cfg.Gateways = []GatewayConfig{{Name: "webchat", Password: "secret", Hosts: []string{"127.0.0.1", "::1"}}}
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Addr: "127.0.0.1:0", Proxy: true}}
+	s := startServer(t, cfg)
+	oper := operLogin(t, s, "oper")
+
+	web, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { web.Close() })
+	web.Send("WEBIRC secret webchat web.example.com 198.51.100.7")
+	web.Login("web")
+	readUntil(t, web, " 001 web ")
+
+	oper.Send("DLINE 198.51.100.0/24 :bad network")
+	readUntil(t, web, " 465 web :You are banned from this server: bad network")
+	oper.Send("DLINE not-an-address :oops")
+	readUntil(t, oper, "NOTICE oper :Invalid D-line mask not-an-address")
+
+	proxied := dialListener(t, s, 0, []byte("PROXY TCP4 198.51.100.8 127.0.0.1 40000 6667\r\n"))
+	readUntil(t, proxied, "ERROR :Closing Link: 198.51.100.8 (D-lined: bad network)")
+
+	oper.Send("STATS d")
+	readUntil(t, oper, " 225 oper D 198.51.100.0/24 :bad network")
+	oper.Send("UNDLINE 198.51.100.0/24")
+	readUntil(t, oper, "NOTICE oper :Removed D-line for 198.51.100.0/24")
+	allowed := dialListener(t, s, 0, []byte("PROXY TCP4 198.51.100.8 127.0.0.1 40000 6667\r\n"))
+	allowed.Login("later")
+	readUntil(t, allowed, " 001 later ")
+}
+
+func TestLoadBansParsesDLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	data := `{"dlines": [{"mask": "198.51.100.0/24", "reason": "range"}, {"mask": "bogus", "reason": "broken"}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bans, err := loadBans(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans.DLines) != 2 || bans.DLines[0].ipNet == nil || bans.DLines[1].ipNet != nil {
+		t.Fatalf("D-lines = %+v", bans.DLines)
+	}
+	s := &Server{bans: bans}
+	if b, ok := s.dlined("198.51.100.7"); !ok || b.Reason != "range" {
+		t.Errorf("dlined(198.51.100.7) = %+v, %v", b, ok)
+	}
+	if _, ok := s.dlined("198.51.101.7"); ok {
+		t.Error("address outside the range D-lined")
+	}
+}
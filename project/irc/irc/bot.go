@@ -0,0 +1,226 @@
+package irc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bots
+//
+// A Bot is a user living inside the server process, such as a service,
+// driven by Go code instead of a network connection. To the rest of the
+// network it is an ordinary local user: it registers, joins channels and
+// sends messages through the same code as a connected client, and shows
+// up in WHO, WHOIS and the admin API. Lines the server sends to it are
+// parsed and handed to its BotHandler.
+
+// BotHandler receives the lines the server sends to a bot: numerics,
+// messages, joins and everything else a client would read. Lines are
+// handled one at a time, in order, on a goroutine of the bot.
+type BotHandler func(b *Bot, m *Message)
+
+// Bot is a pseudo-client created by NewBot.
+type Bot struct {
+	s    *Server
+	c    *Client
+	conn *botConn
+	// mu keeps the commands of the bot from being handled concurrently,
+	// as those of a connection never are.
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+// NewBot registers a bot called nick. handler, which may be nil, receives
+// what the server sends to the bot until it quits or is killed. Bots set
+// user mode +B and are not subject to connection limits or ping timeouts.
+func (s *Server) NewBot(nick, realname string, handler BotHandler) (*Bot, error) {
+	if !validNick(nick, s.config().NickLen) {
+		return nil, fmt.Errorf("invalid nickname %q", nick)
+	}
+	conn := newBotConn()
+	c := connClient(conn)
+	c.Host = s.config().ServerName
+	c.lastActive.Store(time.Now().UnixNano())
+	b := &Bot{s: s, c: c, conn: conn, done: make(chan struct{})}
+	s.mu.Lock()
+	s.addClient(c)
+	s.mu.Unlock()
+	go b.run(handler)
+
+	if realname == "" {
+		realname = nick
+	}
+	b.Send("NICK " + nick)
+	b.Send("USER " + nick + " 0 * :" + realname)
+	s.mu.Lock()
+	registered := c.registered
+	s.mu.Unlock()
+	if !registered {
+		conn.Close()
+		<-b.done
+		return nil, fmt.Errorf("nickname %s is not available", nick)
+	}
+	b.Send("MODE " + nick + " +B")
+	s.logInfo(EventConnect, Fields{"nick": nick}, "Bot %s created", nick)
+	return b, nil
+}
+
+// Nick returns the current nickname of the bot.
+func (b *Bot) Nick() string {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	return b.c.nickname()
+}
+
+// Send handles line, a raw IRC command without a line ending, as if the
+// bot had sent it. It returns once the command has been handled, so it
+// must not be called from an event handler or command hook running for a
+// command of the same bot.
+func (b *Bot) Send(line string) {
+	select {
+	case <-b.done:
+		return
+	default:
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.c.lastActive.Store(time.Now().UnixNano())
+	b.s.handleLine(b.c, strings.TrimRight(line, "\r\n"))
+}
+
+// Join joins a channel.
+func (b *Bot) Join(channel string) {
+	b.Send("JOIN " + channel)
+}
+
+// Part leaves a channel.
+func (b *Bot) Part(channel string) {
+	b.Send("PART " + channel)
+}
+
+// Msg sends a PRIVMSG to a channel or user.
+func (b *Bot) Msg(target, text string) {
+	b.Send("PRIVMSG " + target + " :" + text)
+}
+
+// Notice sends a NOTICE to a channel or user.
+func (b *Bot) Notice(target, text string) {
+	b.Send("NOTICE " + target + " :" + text)
+}
+
+// Quit disconnects the bot. Done is closed once it has left the network.
+func (b *Bot) Quit(reason string) {
+	b.Send("QUIT :" + reason)
+	b.conn.Close()
+}
+
+// Done returns a channel closed once the bot has left the network, by
+// quitting or being killed.
+func (b *Bot) Done() <-chan struct{} {
+	return b.done
+}
+
+// run hands the lines written to the bot to handler until the bot is
+// disconnected, then removes it like a closed connection.
+func (b *Bot) run(handler BotHandler) {
+	defer close(b.done)
+	for {
+		lines, open := b.conn.next()
+		for _, line := range lines {
+			if m, err := parseMessage(line, maxLinkLineLen); err == nil && handler != nil {
+				handler(b, m)
+			}
+		}
+		if !open {
+			b.s.removeClient(b.c, "Connection closed")
+			return
+		}
+	}
+}
+
+// botConn is the connection of a bot. What the server writes to it is
+// queued for the bot's goroutine, so writing never waits for the handler.
+type botConn struct {
+	mu      sync.Mutex
+	pending strings.Builder
+	wake    chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newBotConn() *botConn {
+	return &botConn{wake: make(chan struct{}, 1), closed: make(chan struct{})}
+}
+
+// next waits for lines written to the connection and returns them. open
+// is false once the connection is closed and every line was returned.
+func (c *botConn) next() (lines []string, open bool) {
+	select {
+	case <-c.wake:
+	case <-c.closed:
+	}
+	c.mu.Lock()
+	out := c.pending.String()
+	c.pending.Reset()
+	c.mu.Unlock()
+	lines = strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	if out == "" {
+		lines = nil
+	}
+	select {
+	case <-c.closed:
+		c.mu.Lock()
+		open = c.pending.Len() > 0
+		c.mu.Unlock()
+	default:
+		open = true
+	}
+	return lines, open
+}
+
+func (c *botConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	c.pending.Write(p)
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Read blocks until the connection is closed: the bot's commands are
+// handled by Bot.Send rather than read.
+func (c *botConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c *botConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+func (c *botConn) LocalAddr() net.Addr                { return botAddr{} }
+func (c *botConn) RemoteAddr() net.Addr               { return botAddr{} }
+func (c *botConn) SetDeadline(t time.Time) error      { return nil }
+func (c *botConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *botConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// botAddr is the address of a bot.
+type botAddr struct{}
+
+func (botAddr) Network() string { return "bot" }
+func (botAddr) String() string  { return "bot" }
@@ -0,0 +1,63 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBot(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	joins := make(chan string, 10)
+	echo, err := s.NewBot("echo", "Echo service", func(b *Bot, m *Message) {
+		switch {
+		case m.Command == "PRIVMSG" && len(m.Params) == 2 && m.Params[0] == b.Nick():
+			b.Msg(m.Source, "echo: "+m.Params[1])
+		case m.Command == "JOIN":
+			joins <- m.Source + " " + m.Params[0]
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo.Join("#chat")
+
+	alice := login(t, s, "alice")
+	alice.Join("#chat")
+	if line := readUntil(t, alice, " 353 "); !strings.Contains(line, "echo") {
+		t.Errorf("bot missing from NAMES: %q", line)
+	}
+	alice.Msg("echo", "hi")
+	readUntil(t, alice, ":echo PRIVMSG alice :echo: hi")
+	echo.Msg("#chat", "hello")
+	readUntil(t, alice, ":echo PRIVMSG #chat :hello")
+	alice.Send("WHOIS echo")
+	readUntil(t, alice, " 335 alice echo ")
+
+	for _, want := range []string{"echo #chat", "alice #chat"} {
+		select {
+		case got := <-joins:
+			if got != want {
+				t.Errorf("bot saw JOIN %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("bot did not see JOIN %q", want)
+		}
+	}
+
+	if _, err := s.NewBot("alice", "", nil); err == nil {
+		t.Error("bot took the nick of a user")
+	}
+	if _, err := s.NewBot("not valid", "", nil); err == nil {
+		t.Error("bot took an invalid nick")
+	}
+
+	echo.Quit("bye")
+	readUntil(t, alice, ":echo QUIT :Quit: bye")
+	select {
+	case <-echo.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Done not closed")
+	}
+	waitFor(t, s, "the bot to go", func() bool { return s.nicks.get("echo") == nil })
+}
@@ -0,0 +1,271 @@
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Always-on sessions
+//
+// Connections logged in to an AlwaysOn account do not become users of their
+// own. The first one creates a session: a Client without a connection that
+// holds the nickname, channels and modes of the account. Every connection of
+// the account attaches to that Client; lines sent to it are copied to all
+// attached connections, and commands read from any of them act on it. When
+// the last connection goes away the session stays on its channels and
+// history keeps the messages it receives, which are replayed on the next
+// attach. Per target delivery markers make sure nothing is replayed twice.
+
+// nick returns the nickname shown to c: that of its session for attached
+// connections.
+func (c *Client) nick() string {
+	if c.user != nil {
+		return c.user.nickname()
+	}
+	return c.nickname()
+}
+
+// attached returns the connections attached to the session c.
+func (c *Client) attached() []*Client {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+	return append([]*Client(nil), c.sessions...)
+}
+
+// connections returns the connections that lines sent to c are written to.
+func (c *Client) connections() []*Client {
+	if c.Conn != nil {
+		return []*Client{c}
+	}
+	return c.attached()
+}
+
+// current returns the connection whose command is being handled for the
+// session c, or c itself.
+func (c *Client) current() *Client {
+	if r := c.replyTo.Load(); r != nil {
+		return r
+	}
+	return c
+}
+
+// reply sends a line answering the command being handled for c. For a
+// session it only goes to the connection that sent the command.
+func (c *Client) reply(line string) {
+	c.current().send(line)
+}
+
+// replyingTo directs replies for the session c to conn until the returned
+// function is called. Commands of one session are handled one at a time.
+func (c *Client) replyingTo(conn *Client) (done func()) {
+	c.cmdMu.Lock()
+	c.replyTo.Store(conn)
+	return func() {
+		c.replyTo.Store(nil)
+		c.cmdMu.Unlock()
+	}
+}
+
+// registerSession completes registration of a connection logged in to an
+// always-on account by attaching it to the account's session, creating the
+// session if needed. It reports false for other connections.
+func (s *Server) registerSession(c *Client) bool {
+	s.mu.Lock()
+	acct, ok := s.account(c.account)
+	if c.account == "" || !ok || !acct.AlwaysOn {
+		s.mu.Unlock()
+		return false
+	}
+	key := s.fold(acct.Name)
+	u := s.sessions[key]
+	nickKey := s.fold(c.nickname())
+	if u == nil {
+		if other := s.nicks.get(nickKey); other != nil && other != c {
+			nick := c.nickname()
+			c.setNick("")
+			s.mu.Unlock()
+			s.numeric(c, errNicknameInUse, nick, "Nickname is already in use")
+			return true
+		}
+		u = newSession(acct.Name, c.nickname(), c.Username, c.Realname, c.Host)
+		for m := range c.modes {
+			u.setMode(m, true)
+		}
+		s.sessions[key] = u
+		s.nicks.set(nickKey, u)
+		s.logInfo(EventRegister, Fields{"nick": u.nickname(), "account": acct.Name, "session": true}, "%s registered (always-on session for %s)", u.nickname(), acct.Name)
+	} else {
+		s.nicks.deleteIf(nickKey, c)
+	}
+	since := u.detachedAt
+	u.detachedAt = time.Time{}
+	c.user = u
+	c.registered = true
+	u.sessMu.Lock()
+	u.sessions = append(u.sessions, c)
+	resumed := len(u.sessions) > 1 || !since.IsZero()
+	u.sessMu.Unlock()
+	s.mu.Unlock()
+
+	if resumed {
+		s.logInfo(EventRegister, Fields{"nick": u.nickname(), "host": c.Host, "session": true}, "%s attached to %s", c.Host, u.nickname())
+	} else {
+		s.introduceUser(u)
+	}
+	s.welcome(c)
+	if resumed {
+		s.resumeSession(c, since)
+	}
+	return true
+}
+
+// newSession returns the always-on session of account, not yet known to
+// the server.
+func newSession(account, nick, user, realname, host string) *Client {
+	u := &Client{
+		Username:   user,
+		Realname:   realname,
+		Host:       host,
+		Channels:   make(map[string]bool),
+		registered: true,
+		alwaysOn:   true,
+		account:    account,
+		connected:  time.Now(),
+		delivered:  make(map[string]time.Time),
+	}
+	u.setNick(nick)
+	u.setMode('r', true)
+	return u
+}
+
+// resumeSession tells a newly attached connection which channels its
+// session is on and replays what the session missed.
+func (s *Server) resumeSession(c *Client, since time.Time) {
+	u := c.user
+	defer u.replyingTo(c)()
+	for _, name := range s.channelNames(u) {
+		c.send(fmt.Sprintf(":%s JOIN %s", u.nickname(), name))
+		s.joinReadMarker(u, []*Client{c}, name)
+		s.sendTopic(u, name, false)
+		s.sendNames(u, name)
+	}
+	s.replayMissed(u, since)
+}
+
+// replayMissed sends u the channel and private messages it received after
+// its delivery marker for each target. Targets without a marker are
+// replayed from since, the time the session lost its last connection.
+func (s *Server) replayMissed(u *Client, since time.Time) {
+	keys, err := s.history.Keys()
+	if err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "history lookup failed: %v", err)
+		return
+	}
+	s.mu.Lock()
+	self := s.fold(u.account)
+	targets := make(map[string]string)
+	for _, name := range s.channelNames(u) {
+		targets[s.historyKey(name)] = name
+	}
+	for _, key := range keys {
+		if peer, ok := dmPeer(key, self); ok {
+			targets[key] = strings.TrimPrefix(peer, "~")
+		}
+	}
+	from := make(map[string]time.Time, len(targets))
+	for key := range targets {
+		from[key] = u.delivered[key]
+		if from[key].IsZero() {
+			from[key] = since
+		}
+	}
+	s.mu.Unlock()
+
+	ordered := make([]string, 0, len(targets))
+	for key := range targets {
+		ordered = append(ordered, key)
+	}
+	sort.Strings(ordered)
+	for _, key := range ordered {
+		if from[key].IsZero() {
+			continue
+		}
+		items, err := s.history.Items(key)
+		if err != nil {
+			s.logError(EventServer, Fields{"error": err.Error()}, "history lookup failed: %v", err)
+			continue
+		}
+		items = historyAfter(items, from[key], len(items))
+		if len(items) == 0 {
+			continue
+		}
+		s.sendHistory(u, targets[key], items)
+		s.markDelivered(map[*Client]bool{u: true}, key, items[len(items)-1].Time)
+	}
+}
+
+// markDelivered advances the delivery marker of key for every always-on
+// session in recips that has a connection attached.
+func (s *Server) markDelivered(recips map[*Client]bool, key string, t time.Time) {
+	if key == "" {
+		return
+	}
+	var sessions []*Client
+	for r := range recips {
+		if r.alwaysOn {
+			sessions = append(sessions, r)
+		}
+	}
+	if len(sessions) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range sessions {
+		if len(r.attached()) > 0 && r.delivered[key].Before(t) {
+			r.delivered[key] = t
+		}
+	}
+}
+
+// detach removes the connection c from its session. The session stays on
+// its channels when its last connection leaves.
+func (s *Server) detach(c *Client, reason string) {
+	u := c.user
+	s.mu.Lock()
+	delete(s.clients, c.Conn)
+	u.sessMu.Lock()
+	for i, conn := range u.sessions {
+		if conn == c {
+			u.sessions = append(u.sessions[:i], u.sessions[i+1:]...)
+			break
+		}
+	}
+	left := len(u.sessions)
+	u.sessMu.Unlock()
+	if left == 0 {
+		u.detachedAt = time.Now()
+	}
+	s.mu.Unlock()
+	s.logInfo(EventDisconnect, Fields{"nick": u.nickname(), "host": c.Host, "reason": reason, "session": true}, "%s detached from %s (%s)", c.Host, u.nickname(), reason)
+}
+
+// dmPeer returns the other account taking part in a private conversation
+// history key if the account self does.
+func dmPeer(key, self string) (string, bool) {
+	if !strings.HasPrefix(key, "dm:") {
+		return "", false
+	}
+	pair := strings.Split(strings.TrimPrefix(key, "dm:"), ",")
+	switch {
+	case len(pair) != 2:
+		return "", false
+	case pair[0] == self:
+		return pair[1], true
+	case pair[1] == self:
+		return pair[0], true
+	}
+	return "", false
+}
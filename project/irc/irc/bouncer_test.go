@@ -0,0 +1,93 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitDetached waits until the always-on session of account has no
+// connection attached.
+func waitDetached(t *testing.T, s *Server, account string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		u := s.sessions[s.fold(account)]
+		s.mu.Unlock()
+		if u != nil && len(u.attached()) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session of %s still attached", account)
+}
+
+func TestAlwaysOnSessionSurvivesDisconnect(t *testing.T) {
+	s := startServer(t, accountConfig(AccountConfig{Name: "alice", Password: "secret", AlwaysOn: true}))
+	alice := loginAccount(t, s, "alice", "alice", "secret")
+	alice.Join("#room")
+	readUntil(t, alice, " 366 alice #room ")
+	bob := login(t, s, "bob")
+	bob.Join("#room")
+	readUntil(t, bob, " 366 bob #room ")
+
+	alice.Close()
+	waitDetached(t, s, "alice")
+	bob.Msg("#room", "while you were away")
+	bob.Msg("alice", "ping me back")
+	bob.Send("NAMES #room")
+	if line := readUntil(t, bob, " 353 "); !strings.Contains(line, "alice") {
+		t.Errorf("alice left #room on disconnect: %q", line)
+	}
+
+	alice = loginAccount(t, s, "alice", "alice", "secret")
+	readUntil(t, alice, ":alice JOIN #room")
+	readUntil(t, alice, ":bob PRIVMSG #room :while you were away")
+	readUntil(t, alice, ":bob PRIVMSG alice :ping me back")
+
+	// Reattaching again replays only what arrived in between.
+	alice.Close()
+	waitDetached(t, s, "alice")
+	bob.Msg("#room", "second")
+	bob.Send("PING :sync")
+	readUntil(t, bob, "PONG")
+	alice = loginAccount(t, s, "alice", "alice", "secret")
+	line := readUntil(t, alice, "PRIVMSG")
+	if !strings.Contains(line, ":second") {
+		t.Errorf("expected only the new message to be replayed, got %q", line)
+	}
+}
+
+func TestAlwaysOnSessionMultipleConnections(t *testing.T) {
+	s := startServer(t, accountConfig(AccountConfig{Name: "alice", Password: "secret", AlwaysOn: true}))
+	laptop := loginAccount(t, s, "alice", "alice", "secret")
+	laptop.Join("#room")
+	readUntil(t, laptop, " 366 alice #room ")
+	phone := loginAccount(t, s, "alice", "alice", "secret")
+	readUntil(t, phone, ":alice JOIN #room")
+	bob := login(t, s, "bob")
+	bob.Join("#room")
+	readUntil(t, bob, " 366 bob #room ")
+
+	bob.Msg("#room", "hello both")
+	readUntil(t, laptop, ":bob PRIVMSG #room :hello both")
+	readUntil(t, phone, ":bob PRIVMSG #room :hello both")
+
+	laptop.Msg("#room", "from the laptop")
+	readUntil(t, bob, ":alice PRIVMSG #room :from the laptop")
+	readUntil(t, phone, ":alice PRIVMSG #room :from the laptop")
+
+	// Replies only go to the connection that asked.
+	phone.Send("WHOIS bob")
+	readUntil(t, phone, " 318 alice bob ")
+	laptop.Send("PING :sync")
+	if line := readUntil(t, laptop, " "); !strings.Contains(line, "PONG") {
+		t.Errorf("WHOIS reply reached the other connection: %q", line)
+	}
+
+	phone.Send("QUIT :bye")
+	readUntil(t, phone, "ERROR")
+	bob.Msg("#room", "still here?")
+	readUntil(t, laptop, ":bob PRIVMSG #room :still here?")
+}
@@ -0,0 +1,102 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// capabilities lists the IRCv3 capabilities offered in CAP LS.
+var capabilities = []string{"batch", "draft/chathistory", readMarkerCap, "echo-message", "message-tags", "sasl", "server-time"}
+
+// capValues holds the values advertised to clients requesting CAP LS 302.
+var capValues = map[string]string{"sasl": saslMechanisms}
+
+func supportedCap(name string) bool {
+	for _, c := range capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCap reports whether c negotiated the named capability. The caller must
+// hold s.mu when c belongs to another connection.
+func (c *Client) hasCap(name string) bool {
+	return c.caps[name]
+}
+
+// handleCap implements the CAP LS, LIST, REQ and END subcommands. Starting
+// negotiation before registration suspends registration until CAP END.
+func (s *Server) handleCap(c *Client, params []string) {
+	nick := c.nick()
+	if nick == "" {
+		nick = "*"
+	}
+	server := s.config().ServerName
+	sub := strings.ToUpper(params[0])
+	switch sub {
+	case "LS":
+		if !c.registered {
+			c.capNegotiating = true
+		}
+		offered := capabilities
+		version := 0
+		if len(params) > 1 {
+			version, _ = strconv.Atoi(params[1])
+		}
+		if version >= 302 {
+			offered = make([]string, len(capabilities))
+			for i, name := range capabilities {
+				offered[i] = name
+				if v := capValues[name]; v != "" {
+					offered[i] += "=" + v
+				}
+			}
+		}
+		c.send(":" + server + " CAP " + nick + " LS :" + strings.Join(offered, " "))
+	case "LIST":
+		var enabled []string
+		for _, name := range capabilities {
+			if c.hasCap(name) {
+				enabled = append(enabled, name)
+			}
+		}
+		c.send(":" + server + " CAP " + nick + " LIST :" + strings.Join(enabled, " "))
+	case "REQ":
+		if !c.registered {
+			c.capNegotiating = true
+		}
+		req := ""
+		if len(params) > 1 {
+			req = params[1]
+		}
+		// Requests are applied all or nothing.
+		for _, name := range strings.Fields(req) {
+			if !supportedCap(strings.TrimPrefix(name, "-")) {
+				c.send(":" + server + " CAP " + nick + " NAK :" + req)
+				return
+			}
+		}
+		s.mu.Lock()
+		if c.caps == nil {
+			c.caps = make(map[string]bool)
+		}
+		for _, name := range strings.Fields(req) {
+			if strings.HasPrefix(name, "-") {
+				delete(c.caps, name[1:])
+			} else {
+				c.caps[name] = true
+			}
+		}
+		s.mu.Unlock()
+		c.send(":" + server + " CAP " + nick + " ACK :" + req)
+	case "END":
+		if c.capNegotiating {
+			c.capNegotiating = false
+			s.tryRegister(c)
+		}
+	default:
+		s.numeric(c, errInvalidCapCmd, params[0], "Invalid CAP command")
+	}
+}
@@ -0,0 +1,590 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel logs
+//
+// When Config.ChannelLogs.Dir is set, what happens on the channels matching
+// Config.ChannelLogs.Channels is written to disk: messages, notices, joins,
+// parts, quits, kicks, topic changes and nick changes. Every channel has a
+// directory named after its case folded, path escaped name holding one file
+// per UTC day, 2006-01-02.log, continued in 2006-01-02.1.log and so on once
+// a file reaches MaxSize. Files older than MaxAge are removed once an
+// hour.
+//
+// The text format has one entry per line:
+//
+//	2006-01-02T15:04:05.000Z message alice :hello there
+//	2006-01-02T15:04:05.000Z kick oper bob :spam
+//
+// the time, the kind of entry, the nick that acted, for kicks and nick
+// changes the kicked user or the new nick, then the text. The jsonl format
+// writes chanLogEntry values as JSON lines instead, in .jsonl files.
+
+const chanLogTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// chanLogEntry is one entry of a channel log.
+type chanLogEntry struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	// Type is message, notice, join, part, quit, kick, topic or nick.
+	Type string `json:"type"`
+	Nick string `json:"nick"`
+	// Target is the kicked user of a kick and the new nick of a nick
+	// change.
+	Target string `json:"target,omitempty"`
+	Text   string `json:"text,omitempty"`
+}
+
+// formatText returns e in the text format, without a line ending.
+func (e chanLogEntry) formatText() string {
+	line := e.Time.UTC().Format(chanLogTimeFormat) + " " + e.Type + " " + e.Nick
+	if e.Target != "" {
+		line += " " + e.Target
+	}
+	return line + " :" + e.Text
+}
+
+// parseChanLogText parses a line of the text format written for channel.
+func parseChanLogText(channel, line string) (chanLogEntry, bool) {
+	head, text, ok := strings.Cut(line, " :")
+	if !ok {
+		return chanLogEntry{}, false
+	}
+	fields := strings.Fields(head)
+	if len(fields) < 3 || len(fields) > 4 {
+		return chanLogEntry{}, false
+	}
+	at, err := time.Parse(chanLogTimeFormat, fields[0])
+	if err != nil {
+		return chanLogEntry{}, false
+	}
+	e := chanLogEntry{Time: at, Channel: channel, Type: fields[1], Nick: fields[2], Text: text}
+	if len(fields) == 4 {
+		e.Target = fields[3]
+	}
+	return e, true
+}
+
+// chanLogFile is the file a channel is currently logged to. Its lock
+// serializes the writes to the log of one channel, so that channels are
+// written in parallel. The file stays open until the day changes, the file
+// reaches MaxSize or it has not been written to for a while.
+type chanLogFile struct {
+	mu    sync.Mutex
+	dir   string
+	ext   string
+	f     *os.File
+	day   string
+	index int
+	size  int64
+	// used is set by every write and cleared by closeIdle.
+	used bool
+	// dropped is set once the logger no longer uses the file, for example
+	// because the log directory changed.
+	dropped bool
+}
+
+// chanLogger writes channel logs. It has its own lock so that disk writes
+// never happen under s.mu; l.mu itself is only held to find the file of a
+// channel.
+type chanLogger struct {
+	mu      sync.Mutex
+	cfg     ChannelLogConfig
+	mapping string
+	files   map[string]*chanLogFile // folded channel name -> current file
+}
+
+func newChanLogger() *chanLogger {
+	return &chanLogger{files: make(map[string]*chanLogFile)}
+}
+
+// configure applies the channel log settings of cfg.
+func (l *chanLogger) configure(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg.ChannelLogs.Dir != l.cfg.Dir || cfg.ChannelLogs.Format != l.cfg.Format {
+		l.dropFiles()
+	}
+	l.cfg = cfg.ChannelLogs
+	l.mapping = cfg.CaseMapping
+}
+
+// close closes the open log files.
+func (l *chanLogger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dropFiles()
+}
+
+// dropFiles closes the files of every channel and forgets them. The caller
+// must hold l.mu.
+func (l *chanLogger) dropFiles() {
+	for _, cf := range l.files {
+		cf.mu.Lock()
+		cf.closeFile()
+		cf.dropped = true
+		cf.mu.Unlock()
+	}
+	l.files = make(map[string]*chanLogFile)
+}
+
+// enabled reports whether channel logs are written or can be searched.
+func (l *chanLogger) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg.Dir != ""
+}
+
+// logs reports whether the channel called name is logged. The caller must
+// hold l.mu.
+func (l *chanLogger) logs(name string) bool {
+	if l.cfg.Dir == "" {
+		return false
+	}
+	if len(l.cfg.Channels) == 0 {
+		return true
+	}
+	for _, mask := range l.cfg.Channels {
+		if matchMask(l.mapping, mask, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *chanLogger) ext() string {
+	if l.cfg.Format == "jsonl" {
+		return ".jsonl"
+	}
+	return ".log"
+}
+
+func (l *chanLogger) dir(name string) string {
+	return filepath.Join(l.cfg.Dir, url.PathEscape(foldCase(l.mapping, name)))
+}
+
+// write appends e to the log of its channel if the channel is logged.
+func (l *chanLogger) write(e chanLogEntry) error {
+	day := e.Time.UTC().Format("2006-01-02")
+	for {
+		l.mu.Lock()
+		if !l.logs(e.Channel) {
+			l.mu.Unlock()
+			return nil
+		}
+		jsonl, maxSize := l.cfg.Format == "jsonl", l.cfg.MaxSize
+		key := foldCase(l.mapping, e.Channel)
+		cf := l.files[key]
+		if cf == nil {
+			cf = &chanLogFile{dir: l.dir(e.Channel), ext: l.ext()}
+			l.files[key] = cf
+		}
+		l.mu.Unlock()
+
+		var line []byte
+		if jsonl {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			line = append(data, '\n')
+		} else {
+			line = []byte(e.formatText() + "\n")
+		}
+		if written, err := cf.append(line, day, maxSize); written || err != nil {
+			return err
+		}
+		// The file was dropped by a rehash in the meantime.
+	}
+}
+
+// append writes line to the log of day, opening a new file when the day
+// changes or the current one would grow beyond maxSize. It reports false
+// if the logger dropped cf, in which case nothing is written.
+func (cf *chanLogFile) append(line []byte, day string, maxSize int64) (bool, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.dropped {
+		return false, nil
+	}
+	if cf.day != day {
+		cf.closeFile()
+		if err := cf.startDay(day); err != nil {
+			return true, err
+		}
+	}
+	if maxSize > 0 && cf.size > 0 && cf.size+int64(len(line)) > maxSize {
+		cf.closeFile()
+		cf.index++
+	}
+	if cf.f == nil {
+		if err := cf.openFile(); err != nil {
+			return true, err
+		}
+	}
+	n, err := cf.f.Write(line)
+	cf.size += int64(n)
+	cf.used = true
+	return true, err
+}
+
+func (cf *chanLogFile) fileName(day string, index int) string {
+	if index == 0 {
+		return day + cf.ext
+	}
+	return day + "." + strconv.Itoa(index) + cf.ext
+}
+
+// startDay finds the last file of day, which may have been written before
+// a restart. The caller must hold cf.mu.
+func (cf *chanLogFile) startDay(day string) error {
+	if err := os.MkdirAll(cf.dir, 0755); err != nil {
+		return err
+	}
+	cf.day, cf.index = day, 0
+	for {
+		if _, err := os.Stat(filepath.Join(cf.dir, cf.fileName(day, cf.index+1))); err != nil {
+			break
+		}
+		cf.index++
+	}
+	return nil
+}
+
+// openFile opens the current file for appending. The caller must hold
+// cf.mu.
+func (cf *chanLogFile) openFile() error {
+	f, err := os.OpenFile(filepath.Join(cf.dir, cf.fileName(cf.day, cf.index)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	cf.f, cf.size = f, fi.Size()
+	return nil
+}
+
+// closeFile closes the current file, if it is open. The caller must hold
+// cf.mu.
+func (cf *chanLogFile) closeFile() {
+	if cf.f != nil {
+		cf.f.Close()
+		cf.f = nil
+	}
+}
+
+// chanLogMaintenance is how often idle log files are closed and old ones
+// removed.
+const chanLogMaintenance = time.Hour
+
+// chanLogLoop maintains the channel logs every chanLogMaintenance until
+// the server is closed.
+func (s *Server) chanLogLoop() {
+	ticker := time.NewTicker(chanLogMaintenance)
+	defer ticker.Stop()
+	for {
+		s.maintainChannelLogs()
+		select {
+		case <-s.closing:
+			s.chanLog.close()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// maintainChannelLogs closes idle log files and removes the files past
+// MaxAge. Failures are logged as errors.
+func (s *Server) maintainChannelLogs() {
+	s.chanLog.closeIdle()
+	if err := s.chanLog.prune(); err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "failed to prune channel logs: %v", err)
+	}
+}
+
+// closeIdle closes the files not written to since the previous call.
+func (l *chanLogger) closeIdle() {
+	l.mu.Lock()
+	files := make([]*chanLogFile, 0, len(l.files))
+	for _, cf := range l.files {
+		files = append(files, cf)
+	}
+	l.mu.Unlock()
+	for _, cf := range files {
+		cf.mu.Lock()
+		if !cf.used {
+			cf.closeFile()
+		}
+		cf.used = false
+		cf.mu.Unlock()
+	}
+}
+
+// prune removes the log files older than MaxAge from every channel
+// directory.
+func (l *chanLogger) prune() error {
+	l.mu.Lock()
+	root, maxAge := l.cfg.Dir, time.Duration(l.cfg.MaxAge)
+	l.mu.Unlock()
+	if root == "" || maxAge <= 0 {
+		return nil
+	}
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cutoff := time.Now().UTC().Add(-maxAge).Format("2006-01-02")
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, d.Name())
+		files, err := chanLogFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.day < cutoff {
+				if err := os.Remove(filepath.Join(dir, f.name)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// chanLogFileInfo is a log file found on disk.
+type chanLogFileInfo struct {
+	name  string
+	day   string
+	index int
+	jsonl bool
+}
+
+// chanLogFiles lists the log files in dir, oldest first.
+func chanLogFiles(dir string) ([]chanLogFileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []chanLogFileInfo
+	for _, e := range entries {
+		name := e.Name()
+		f := chanLogFileInfo{name: name}
+		base := strings.TrimSuffix(name, ".log")
+		if base == name {
+			base = strings.TrimSuffix(name, ".jsonl")
+			f.jsonl = true
+		}
+		if e.IsDir() || base == name {
+			continue
+		}
+		day, index, _ := strings.Cut(base, ".")
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			continue
+		}
+		f.day = day
+		if index != "" {
+			if f.index, err = strconv.Atoi(index); err != nil {
+				continue
+			}
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].day != files[j].day {
+			return files[i].day < files[j].day
+		}
+		return files[i].index < files[j].index
+	})
+	return files, nil
+}
+
+// chanLogQuery selects channel log entries. Zero fields match everything.
+type chanLogQuery struct {
+	Channel string
+	// Nick is a mask matched against the nick and target of entries.
+	Nick     string
+	From, To time.Time
+	// Text is looked for in the text of entries, ignoring case.
+	Text  string
+	Limit int
+}
+
+// search returns the first entries of the log of q.Channel matching q, in
+// the order they were written.
+func (l *chanLogger) search(q chanLogQuery) ([]chanLogEntry, error) {
+	l.mu.Lock()
+	dir, mapping := l.dir(q.Channel), l.mapping
+	l.mu.Unlock()
+	files, err := chanLogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ToLower(q.Text)
+	matches := func(e chanLogEntry) bool {
+		switch {
+		case !q.From.IsZero() && e.Time.Before(q.From):
+			return false
+		case !q.To.IsZero() && e.Time.After(q.To):
+			return false
+		case q.Nick != "" && !matchMask(mapping, q.Nick, e.Nick) && (e.Target == "" || !matchMask(mapping, q.Nick, e.Target)):
+			return false
+		}
+		return text == "" || strings.Contains(strings.ToLower(e.Text), text)
+	}
+	entries := []chanLogEntry{}
+	for _, f := range files {
+		if !q.From.IsZero() && f.day < q.From.UTC().Format("2006-01-02") {
+			continue
+		}
+		if !q.To.IsZero() && f.day > q.To.UTC().Format("2006-01-02") {
+			break
+		}
+		done, err := readChanLog(filepath.Join(dir, f.name), q.Channel, f.jsonl, func(e chanLogEntry) bool {
+			if matches(e) {
+				entries = append(entries, e)
+			}
+			return q.Limit > 0 && len(entries) >= q.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// readChanLog calls fn with every entry of a log file until fn returns
+// true, which readChanLog then returns. Malformed lines are skipped.
+func readChanLog(path, channel string, jsonl bool, fn func(chanLogEntry) bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e chanLogEntry
+		ok := true
+		if jsonl {
+			ok = json.Unmarshal(sc.Bytes(), &e) == nil
+		} else {
+			e, ok = parseChanLogText(channel, sc.Text())
+		}
+		if ok && fn(e) {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// logChannel writes an entry of the current time to the log of the channel
+// called name.
+func (s *Server) logChannel(name, typ, nick, target, text string) {
+	s.writeChannelLog(chanLogEntry{Time: time.Now().UTC(), Channel: name, Type: typ, Nick: nick, Target: target, Text: text})
+}
+
+// writeChannelLog writes e to the log of its channel. Failures are logged
+// as errors and otherwise ignored.
+func (s *Server) writeChannelLog(e chanLogEntry) {
+	if err := s.chanLog.write(e); err != nil {
+		s.logError(EventServer, Fields{"channel": e.Channel, "error": err.Error()}, "failed to write channel log: %v", err)
+	}
+}
+
+// channelNames returns the names of the channels c is on, sorted.
+func (s *Server) channelNames(c *Client) []string {
+	keys := c.channelKeys()
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if ch := s.channels.get(key); ch != nil {
+			names = append(names, ch.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// apiLogs searches the log of a channel:
+//
+//	GET /api/logs?channel=#chat&nick=alice*&from=...&to=...&text=...&limit=100
+//
+// from and to are RFC 3339 times. At most 1000 entries are returned, 100
+// unless limit says otherwise.
+func (s *Server) apiLogs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if !s.chanLog.enabled() {
+		apiError(w, http.StatusNotFound, "channel logging is disabled")
+		return
+	}
+	v := r.URL.Query()
+	q := chanLogQuery{Channel: v.Get("channel"), Nick: v.Get("nick"), Text: v.Get("text"), Limit: 100}
+	if !validChannel(q.Channel, len(q.Channel)) {
+		apiError(w, http.StatusBadRequest, "invalid channel "+strconv.Quote(q.Channel))
+		return
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v.Get(p.name) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v.Get(p.name))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %v", p.name, err))
+			return
+		}
+		*p.t = t
+	}
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			apiError(w, http.StatusBadRequest, "invalid limit "+strconv.Quote(limit))
+			return
+		}
+		if n > 1000 {
+			n = 1000
+		}
+		q.Limit = n
+	}
+	entries, err := s.chanLog.search(q)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, entries)
+}
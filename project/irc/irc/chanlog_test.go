@@ -0,0 +1,225 @@
+package irc
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ic "vibes/client"
+)
+
+// waitLog waits until the log of channel holds n entries and returns them.
+func waitLog(t *testing.T, s *Server, channel string, n int) []chanLogEntry {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entries, err := s.chanLog.search(chanLogQuery{Channel: channel})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) >= n {
+			return entries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log of %s has %d entries, want %d: %+v", channel, len(entries), n, entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChannelLogs(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.AdminAPI = AdminAPIConfig{Addr: "127.0.0.1:0", Token: "t0ken"}
+	cfg.ChannelLogs = ChannelLogConfig{Dir: dir, Channels: []string{"#log*"}}
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	for _, c := range []*ic.Client{alice, bob} {
+		c.Join("#Logged")
+		readUntil(t, c, " 366 ")
+		c.Join("#other")
+		readUntil(t, c, " 366 ")
+	}
+	alice.Msg("#logged", "hello there")
+	readUntil(t, bob, "PRIVMSG #logged :hello there")
+	alice.Msg("#other", "not logged")
+	readUntil(t, bob, "PRIVMSG #other :not logged")
+	alice.Send("TOPIC #logged :Logged stuff")
+	readUntil(t, bob, "TOPIC #Logged :Logged stuff")
+	bob.Send("NICK robert")
+	readUntil(t, alice, ":bob NICK robert")
+	bob.Send("PART #logged")
+	readUntil(t, alice, ":robert PART #Logged")
+	alice.Send("QUIT :bye")
+	readUntil(t, alice, "ERROR :Closing Link")
+
+	entries := waitLog(t, s, "#LOGGED", 7)
+	var got []string
+	for _, e := range entries {
+		got = append(got, strings.Join(strings.Fields(e.Type+" "+e.Nick+" "+e.Target+" "+e.Text), " "))
+	}
+	want := []string{"join alice", "join bob", "message alice hello there", "topic alice Logged stuff",
+		"nick bob robert", "part robert", "quit alice Quit: bye"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	day := time.Now().UTC().Format("2006-01-02")
+	data, err := os.ReadFile(filepath.Join(dir, "%23logged", day+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), " message alice :hello there\n") || !strings.Contains(string(data), " nick bob robert :\n") {
+		t.Errorf("log file:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "%23other")); !os.IsNotExist(err) {
+		t.Errorf("#other was logged: %v", err)
+	}
+
+	code, body := adminRequest(t, s, "GET", "/api/logs?channel=%23logged&nick=rob*", "")
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	var found []chanLogEntry
+	if err := json.Unmarshal([]byte(body), &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].Type != "nick" || found[1].Type != "part" {
+		t.Errorf("search by nick = %+v", found)
+	}
+	code, body = adminRequest(t, s, "GET", "/api/logs?channel=%23logged&text=HELLO&limit=1", "")
+	if code != http.StatusOK || !strings.Contains(body, `"text":"hello there"`) {
+		t.Errorf("search by text: %d %s", code, body)
+	}
+	if code, _ := adminRequest(t, s, "GET", "/api/logs?channel=%23logged&from=yesterday", ""); code != http.StatusBadRequest {
+		t.Errorf("invalid from: status %d", code)
+	}
+}
+
+func TestChannelLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.ChannelLogs = ChannelLogConfig{Dir: dir, Format: "jsonl", MaxSize: 200, MaxAge: Duration(48 * time.Hour)}
+	l := newChanLogger()
+	l.configure(cfg.withDefaults())
+	t.Cleanup(l.close)
+
+	chanDir := filepath.Join(dir, "%23chat")
+	if err := os.MkdirAll(chanDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().AddDate(0, 0, -5).Format("2006-01-02")
+	if err := os.WriteFile(filepath.Join(chanDir, old+".jsonl"), []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UTC().Add(-time.Hour)
+	for i := 0; i < 6; i++ {
+		e := chanLogEntry{Time: start.Add(time.Duration(i) * time.Minute), Channel: "#Chat", Type: "message", Nick: "alice", Text: strings.Repeat("x", 50)}
+		if i == 4 {
+			e.Nick, e.Text = "bob", "needle"
+		}
+		if err := l.write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.prune(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := chanLogFiles(chanDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("files = %+v, want the log split by size", files)
+	}
+	for _, f := range files {
+		if f.day == old {
+			t.Errorf("expired file %s kept", f.name)
+		}
+		if fi, _ := os.Stat(filepath.Join(chanDir, f.name)); fi.Size() > 200 {
+			t.Errorf("%s has %d bytes", f.name, fi.Size())
+		}
+	}
+
+	entries, err := l.search(chanLogQuery{Channel: "#CHAT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 || !entries[0].Time.Equal(start) {
+		t.Fatalf("entries = %+v", entries)
+	}
+	entries, _ = l.search(chanLogQuery{Channel: "#chat", From: start.Add(2 * time.Minute), To: start.Add(3 * time.Minute)})
+	if len(entries) != 2 {
+		t.Errorf("time range matched %d entries", len(entries))
+	}
+	entries, _ = l.search(chanLogQuery{Channel: "#chat", Nick: "BOB"})
+	if len(entries) != 1 || entries[0].Text != "needle" {
+		t.Errorf("nick search = %+v", entries)
+	}
+}
+
+func TestChanLogTextRoundTrip(t *testing.T) {
+	e := chanLogEntry{Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Channel: "#c", Type: "kick", Nick: "op", Target: "bob", Text: "bye :)"}
+	line := e.formatText()
+	if line != "2024-05-01T12:00:00.000Z kick op bob :bye :)" {
+		t.Errorf("formatText = %q", line)
+	}
+	got, ok := parseChanLogText("#c", line)
+	if !ok || got != e {
+		t.Errorf("parseChanLogText = %+v, %v", got, ok)
+	}
+}
+
+func TestChannelLogKeepsFilesOpen(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.ChannelLogs = ChannelLogConfig{Dir: dir}
+	l := newChanLogger()
+	l.configure(cfg.withDefaults())
+	t.Cleanup(l.close)
+
+	now := time.Now().UTC()
+	write := func(channel, text string) {
+		t.Helper()
+		if err := l.write(chanLogEntry{Time: now, Channel: channel, Type: "message", Nick: "alice", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("#a", "one")
+	write("#b", "one")
+	cf := l.files["#a"]
+	f := cf.f
+	write("#a", "two")
+	if cf.f != f {
+		t.Error("file reopened for the second line")
+	}
+
+	// A file still in use survives the first idle check, not the second.
+	l.closeIdle()
+	if cf.f == nil {
+		t.Error("file closed while in use")
+	}
+	l.closeIdle()
+	if cf.f != nil {
+		t.Error("idle file left open")
+	}
+	write("#a", "three")
+	entries, err := l.search(chanLogQuery{Channel: "#a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[2].Text != "three" {
+		t.Errorf("entries = %+v", entries)
+	}
+
+	cfg.ChannelLogs.Dir = t.TempDir()
+	l.configure(cfg.withDefaults())
+	if cf.f != nil || !cf.dropped {
+		t.Error("file of the old directory left open")
+	}
+}
@@ -0,0 +1,379 @@
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storeHistory records a delivered PRIVMSG or NOTICE. Messages without a
+// history key are not kept.
+func (s *Server) storeHistory(key string, item HistoryItem) {
+	if key == "" {
+		return
+	}
+	if err := s.history.Append(key, item); err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "history append failed: %v", err)
+	}
+}
+
+// replayHistory sends the latest history of a channel to a client that just
+// joined it, if the channel is configured for replay.
+func (s *Server) replayHistory(c *Client, ch *Channel) {
+	cfg := s.config().History
+	replay := false
+	for _, name := range cfg.ReplayChannels {
+		if s.fold(name) == s.historyKey(ch.Name) {
+			replay = true
+			break
+		}
+	}
+	if !replay {
+		return
+	}
+	items, err := s.history.Items(s.historyKey(ch.Name))
+	if err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "history lookup failed: %v", err)
+		return
+	}
+	if len(items) > cfg.ReplayLength {
+		items = items[len(items)-cfg.ReplayLength:]
+	}
+	if len(items) > 0 {
+		s.sendHistory(c, ch.Name, items)
+	}
+}
+
+// sendHistory sends items to c, wrapped in a chathistory batch when c
+// negotiated batch. For a session they go to the connection whose command
+// is being handled.
+func (s *Server) sendHistory(c *Client, target string, items []HistoryItem) {
+	c = c.current()
+	server := s.config().ServerName
+	s.mu.Lock()
+	batch := c.hasCap("batch")
+	lines := make([]string, len(items))
+	ref := ""
+	if batch {
+		ref = newMsgID()
+	}
+	for i, item := range items {
+		tags := map[string]string{"msgid": item.MsgID, "time": item.Time.UTC().Format(serverTimeFormat)}
+		for k, v := range item.Tags {
+			tags[k] = v
+		}
+		visible := tagsFor(c, tags)
+		if batch {
+			visible = copyTags(visible)
+			visible["batch"] = ref
+		}
+		lines[i] = formatTags(visible) + fmt.Sprintf(":%s %s %s :%s", item.Source, item.Command, item.Target, item.Text)
+	}
+	s.mu.Unlock()
+
+	if batch {
+		c.send(fmt.Sprintf(":%s BATCH +%s chathistory %s", server, ref, target))
+	}
+	for _, l := range lines {
+		c.send(l)
+	}
+	if batch {
+		c.send(fmt.Sprintf(":%s BATCH -%s", server, ref))
+	}
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	out := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		out[k] = v
+	}
+	return out
+}
+
+// fail sends an IRCv3 standard reply FAIL message.
+func (s *Server) fail(c *Client, command, code string, context ...string) {
+	params := append([]string{command, code}, context...)
+	m := &Message{Source: s.config().ServerName, Command: "FAIL", Params: params}
+	c.reply(m.String())
+}
+
+// historyRef is a resolved message reference: either "*" or a point in
+// time.
+type historyRef struct {
+	any  bool
+	time time.Time
+}
+
+// parseHistoryRef resolves a "timestamp=" or "msgid=" reference against
+// items. "*" is accepted when allowAny is set.
+func parseHistoryRef(ref string, items []HistoryItem, allowAny bool) (historyRef, bool) {
+	switch {
+	case ref == "*" && allowAny:
+		return historyRef{any: true}, true
+	case strings.HasPrefix(ref, "timestamp="):
+		t, err := time.Parse(serverTimeFormat, strings.TrimPrefix(ref, "timestamp="))
+		if err != nil {
+			t, err = time.Parse(time.RFC3339Nano, strings.TrimPrefix(ref, "timestamp="))
+		}
+		return historyRef{time: t}, err == nil
+	case strings.HasPrefix(ref, "msgid="):
+		id := strings.TrimPrefix(ref, "msgid=")
+		for _, item := range items {
+			if item.MsgID == id {
+				return historyRef{time: item.Time}, true
+			}
+		}
+	}
+	return historyRef{}, false
+}
+
+// historyBefore returns the newest limit items older than t.
+func historyBefore(items []HistoryItem, t time.Time, limit int) []HistoryItem {
+	i := sort.Search(len(items), func(i int) bool { return !items[i].Time.Before(t) })
+	items = items[:i]
+	if len(items) > limit {
+		items = items[len(items)-limit:]
+	}
+	return items
+}
+
+// historyAfter returns the oldest limit items newer than t.
+func historyAfter(items []HistoryItem, t time.Time, limit int) []HistoryItem {
+	i := sort.Search(len(items), func(i int) bool { return items[i].Time.After(t) })
+	items = items[i:]
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+// historyAround returns up to limit items centred on t.
+func historyAround(items []HistoryItem, t time.Time, limit int) []HistoryItem {
+	i := sort.Search(len(items), func(i int) bool { return !items[i].Time.Before(t) })
+	start := i - limit/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + limit
+	if end > len(items) {
+		end = len(items)
+		if start = end - limit; start < 0 {
+			start = 0
+		}
+	}
+	return items[start:end]
+}
+
+// historyBetween returns up to limit items strictly between a and b. When a
+// is later than b the newest items are kept, otherwise the oldest.
+func historyBetween(items []HistoryItem, a, b time.Time, limit int) []HistoryItem {
+	if a.After(b) {
+		return historyItems(historyAfter(historyBefore(items, a, len(items)), b, len(items))).limitNewest(limit)
+	}
+	return historyItems(historyBefore(historyAfter(items, a, len(items)), b, len(items))).limitOldest(limit)
+}
+
+func (s *Server) handleChatHistory(c *Client, params []string) {
+	if len(params) < 1 {
+		s.fail(c, "CHATHISTORY", "NEED_MORE_PARAMS", "Missing parameters")
+		return
+	}
+	sub := strings.ToUpper(params[0])
+	if sub == "TARGETS" {
+		s.chatHistoryTargets(c, params[1:])
+		return
+	}
+	want := map[string]int{"LATEST": 4, "BEFORE": 4, "AFTER": 4, "AROUND": 4, "BETWEEN": 5}[sub]
+	if want == 0 {
+		s.fail(c, "CHATHISTORY", "INVALID_PARAMS", params[0], "Unknown subcommand")
+		return
+	}
+	if len(params) < want {
+		s.fail(c, "CHATHISTORY", "NEED_MORE_PARAMS", sub, "Missing parameters")
+		return
+	}
+	limit, err := strconv.Atoi(params[want-1])
+	if err != nil || limit < 0 {
+		s.fail(c, "CHATHISTORY", "INVALID_PARAMS", sub, "Invalid limit")
+		return
+	}
+	if max := s.config().History.MaxQuery; limit == 0 || limit > max {
+		limit = max
+	}
+
+	target := params[1]
+	key, name, ok := s.historyTarget(c, target)
+	if !ok {
+		s.fail(c, "CHATHISTORY", "INVALID_TARGET", sub, target, "Messages could not be retrieved")
+		return
+	}
+	items, err := s.history.Items(key)
+	if err != nil {
+		s.fail(c, "CHATHISTORY", "MESSAGE_ERROR", sub, target, "Messages could not be retrieved")
+		return
+	}
+	ref, ok := parseHistoryRef(params[2], items, sub == "LATEST")
+	if !ok {
+		s.fail(c, "CHATHISTORY", "INVALID_PARAMS", sub, params[2], "Invalid message reference")
+		return
+	}
+	switch sub {
+	case "LATEST":
+		if ref.any {
+			items = historyItems(items).limitNewest(limit)
+		} else {
+			items = historyItems(historyAfter(items, ref.time, len(items))).limitNewest(limit)
+		}
+	case "BEFORE":
+		items = historyBefore(items, ref.time, limit)
+	case "AFTER":
+		items = historyAfter(items, ref.time, limit)
+	case "AROUND":
+		items = historyAround(items, ref.time, limit)
+	case "BETWEEN":
+		end, ok := parseHistoryRef(params[3], items, false)
+		if !ok {
+			s.fail(c, "CHATHISTORY", "INVALID_PARAMS", sub, params[3], "Invalid message reference")
+			return
+		}
+		items = historyBetween(items, ref.time, end.time, limit)
+	}
+	s.sendHistory(c, name, items)
+}
+
+// historyItems adds slicing helpers to a list of items.
+type historyItems []HistoryItem
+
+func (h historyItems) limitNewest(limit int) historyItems {
+	if len(h) > limit {
+		return h[len(h)-limit:]
+	}
+	return h
+}
+
+func (h historyItems) limitOldest(limit int) historyItems {
+	if len(h) > limit {
+		return h[:limit]
+	}
+	return h
+}
+
+// historyTarget resolves a CHATHISTORY target to a history key and display
+// name. Channel history is only available to channel members, and private
+// conversations to the accounts taking part in them. The target names an
+// account, or else the user holding that nick; conversations with users who
+// are not logged in are kept under their nick.
+func (s *Server) historyTarget(c *Client, target string) (key, name string, ok bool) {
+	if target == "" {
+		return "", "", false
+	}
+	if strings.ContainsRune(chanTypes, rune(target[0])) {
+		ch := s.channels.get(s.fold(target))
+		if ch == nil || !ch.has(c) {
+			return "", "", false
+		}
+		return s.historyKey(ch.Name), ch.Name, true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c.account == "" {
+		return "", "", false
+	}
+	peer := ""
+	if acct, ok := s.account(target); ok {
+		peer = s.fold(acct.Name)
+	} else if u := s.nicks.get(s.fold(target)); u != nil {
+		peer = s.dmSide(u)
+	} else if validNick(target, len(target)) {
+		peer = "~" + s.fold(target)
+	} else {
+		return "", "", false
+	}
+	return dmHistoryKey(s.dmSide(c), peer), target, true
+}
+
+// chatHistoryTargets answers CHATHISTORY TARGETS with the channels and
+// conversations of c that have messages between two timestamps.
+func (s *Server) chatHistoryTargets(c *Client, params []string) {
+	if len(params) < 3 {
+		s.fail(c, "CHATHISTORY", "NEED_MORE_PARAMS", "TARGETS", "Missing parameters")
+		return
+	}
+	from, ok1 := parseHistoryRef(params[0], nil, false)
+	to, ok2 := parseHistoryRef(params[1], nil, false)
+	limit, err := strconv.Atoi(params[2])
+	if !ok1 || !ok2 || err != nil || limit < 0 {
+		s.fail(c, "CHATHISTORY", "INVALID_PARAMS", "TARGETS", "Invalid parameters")
+		return
+	}
+	if max := s.config().History.MaxQuery; limit == 0 || limit > max {
+		limit = max
+	}
+	start, end := from.time, to.time
+	if start.After(end) {
+		start, end = end, start
+	}
+
+	keys, err := s.history.Keys()
+	if err != nil {
+		s.fail(c, "CHATHISTORY", "MESSAGE_ERROR", "TARGETS", "Targets could not be retrieved")
+		return
+	}
+	type latest struct {
+		name string
+		time time.Time
+	}
+	var found []latest
+	s.mu.RLock()
+	self := s.fold(c.account)
+	s.mu.RUnlock()
+	channels := make(map[string]string)
+	for _, name := range s.channelNames(c) {
+		channels[s.historyKey(name)] = name
+	}
+	for _, key := range keys {
+		name, isChannel := channels[key]
+		if _, ok := dmPeer(key, self); !isChannel && (self == "" || !ok) {
+			continue
+		}
+		items, err := s.history.Items(key)
+		if err != nil || len(items) == 0 {
+			continue
+		}
+		in := historyBefore(historyAfter(items, start, len(items)), end, len(items))
+		if len(in) == 0 {
+			continue
+		}
+		last := in[len(in)-1]
+		if !isChannel {
+			name = last.Target
+			if s.fold(name) == s.fold(c.nick()) {
+				name = last.Source
+			}
+		}
+		found = append(found, latest{name, last.Time})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].time.Before(found[j].time) })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	server := s.config().ServerName
+	conn := c.current()
+	s.mu.Lock()
+	batch := conn.hasCap("batch")
+	s.mu.Unlock()
+	ref, prefix := newMsgID(), ""
+	if batch {
+		conn.send(fmt.Sprintf(":%s BATCH +%s draft/chathistory-targets", server, ref))
+		prefix = "@batch=" + ref + " "
+	}
+	for _, f := range found {
+		conn.send(fmt.Sprintf("%s:%s CHATHISTORY TARGETS %s %s", prefix, server, f.name, f.time.UTC().Format(serverTimeFormat)))
+	}
+	if batch {
+		conn.send(fmt.Sprintf(":%s BATCH -%s", server, ref))
+	}
+}
@@ -0,0 +1,142 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ic "vibes/client"
+)
+
+func TestChatHistoryLatestInBatch(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	alice.Join("#room")
+	readUntil(t, alice, " 366 alice #room ")
+	bob.Join("#room")
+	readUntil(t, bob, " 366 bob #room ")
+	for _, text := range []string{"one", "two", "three"} {
+		alice.Msg("#room", text)
+		readUntil(t, bob, ":"+text)
+	}
+
+	bob.Send("CAP REQ :batch message-tags")
+	readUntil(t, bob, "ACK")
+	bob.Send("CHATHISTORY LATEST #room * 2")
+	start := readUntil(t, bob, "BATCH +")
+	if !strings.Contains(start, " chathistory #room") {
+		t.Errorf("unexpected batch start %q", start)
+	}
+	ref := strings.Fields(start)[2][1:]
+	if line := readUntil(t, bob, "PRIVMSG #room"); !strings.Contains(line, ":two") || !strings.Contains(line, "batch="+ref) {
+		t.Errorf("unexpected first item %q", line)
+	}
+	readUntil(t, bob, "PRIVMSG #room :three")
+	readUntil(t, bob, "BATCH -"+ref)
+}
+
+func TestChatHistoryRequiresMembership(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	alice.Join("#room")
+	readUntil(t, alice, " 366 alice #room ")
+
+	bob.Send("CHATHISTORY LATEST #room * 10")
+	readUntil(t, bob, "FAIL CHATHISTORY INVALID_TARGET LATEST #room ")
+	bob.Send("CHATHISTORY BEFORE #room bogus 10")
+	readUntil(t, bob, "FAIL CHATHISTORY ")
+}
+
+func TestChatHistoryDirectMessagesAndTargets(t *testing.T) {
+	s := startServer(t, accountConfig(AccountConfig{Name: "alice", Password: "a"}, AccountConfig{Name: "bob", Password: "b"}))
+	alice := loginAccount(t, s, "alice", "alice", "a")
+	bob := loginAccount(t, s, "bob", "bob", "b")
+
+	alice.Msg("bob", "psst")
+	readUntil(t, bob, "PRIVMSG bob :psst")
+	bob.Msg("alice", "what")
+	readUntil(t, alice, "PRIVMSG alice :what")
+
+	alice.Send("CHATHISTORY LATEST bob * 10")
+	readUntil(t, alice, ":alice PRIVMSG bob :psst")
+	readUntil(t, alice, ":bob PRIVMSG alice :what")
+
+	alice.Send("CHATHISTORY TARGETS timestamp=2000-01-01T00:00:00.000Z timestamp=2100-01-01T00:00:00.000Z 10")
+	readUntil(t, alice, "CHATHISTORY TARGETS bob ")
+}
+
+// TestChatHistoryNickTakeover checks that whoever takes a freed nick does
+// not get the private messages of its previous owner.
+func TestChatHistoryNickTakeover(t *testing.T) {
+	s := startServer(t, accountConfig(AccountConfig{Name: "alice", Password: "a"},
+		AccountConfig{Name: "bob", Password: "b"}, AccountConfig{Name: "mallory", Password: "m"}))
+	alice := loginAccount(t, s, "alice", "alice", "a")
+	bob := loginAccount(t, s, "bob", "bob", "b")
+	alice.Msg("bob", "hunter2")
+	readUntil(t, bob, "PRIVMSG bob :hunter2")
+	anon := login(t, s, "anon")
+	anon.Msg("alice", "hello")
+	readUntil(t, alice, "PRIVMSG alice :hello")
+	freeNick := func(c *ic.Client) {
+		c.Close()
+		for s.nicks.get("bob") != nil {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	freeNick(bob)
+
+	thief := login(t, s, "bob")
+	thief.Send("CHATHISTORY LATEST alice * 10")
+	readUntil(t, thief, "FAIL CHATHISTORY INVALID_TARGET LATEST alice ")
+	freeNick(thief)
+	mallory := loginAccount(t, s, "bob", "mallory", "m")
+	mallory.Send("CHATHISTORY LATEST alice * 10")
+	mallory.Send("CHATHISTORY TARGETS timestamp=2000-01-01T00:00:00.000Z timestamp=2100-01-01T00:00:00.000Z 10")
+	mallory.Send("PING :done")
+	for {
+		line, err := mallory.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, "PRIVMSG") || strings.Contains(line, "TARGETS alice") {
+			t.Errorf("history leaked to the new owner of the nick: %q", line)
+		}
+		if strings.Contains(line, "PONG") {
+			break
+		}
+	}
+
+	alice.Send("CHATHISTORY LATEST bob * 10")
+	if line := readUntil(t, alice, " PRIVMSG "); !strings.Contains(line, ":hunter2") {
+		t.Errorf("alice got %q", line)
+	}
+	// Only the side that is logged in keeps a conversation with a user who
+	// is not.
+	alice.Send("CHATHISTORY LATEST anon * 10")
+	readUntil(t, alice, ":anon PRIVMSG alice :hello")
+	anon.Send("CHATHISTORY LATEST alice * 10")
+	readUntil(t, anon, "FAIL CHATHISTORY INVALID_TARGET LATEST alice ")
+}
+
+func TestHistoryReplayOnJoin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.History.ReplayChannels = []string{"#Log"}
+	cfg.History.ReplayLength = 1
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	alice.Join("#log")
+	readUntil(t, alice, " 366 alice #log ")
+	alice.Send("PRIVMSG #log :first")
+	alice.Send("PRIVMSG #log :second")
+	alice.Send("PING :stored")
+	readUntil(t, alice, "PONG :stored")
+
+	bob := login(t, s, "bob")
+	bob.Join("#log")
+	readUntil(t, bob, " 366 bob #log ")
+	if line := readUntil(t, bob, "PRIVMSG #log"); !strings.Contains(line, ":second") {
+		t.Errorf("expected only the latest message, got %q", line)
+	}
+}
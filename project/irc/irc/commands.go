@@ -0,0 +1,256 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Commands
+//
+// Client commands are looked up by name in a registry. Each entry declares
+// what the server checks before calling its handler: whether the client
+// must have registered, whether it must be an operator and how many
+// parameters it needs. It also gives the command's cost for flood
+// control, which makes clients that send faster than Config.Flood allows
+// wait before their commands are handled. Programs embedding the server
+// add their own commands, or replace built-in ones, with RegisterCommand.
+
+// CommandHandler handles a command from c. For connections attached to an
+// always-on session c is the session, unless the command is PerConnection.
+type CommandHandler func(s *Server, c *Client, m *Message)
+
+// Command describes a client command.
+type Command struct {
+	Handler CommandHandler
+	// MinParams is the number of parameters below which the command is
+	// refused with ERR_NEEDMOREPARAMS.
+	MinParams int
+	// Unregistered allows the command before registration completes.
+	Unregistered bool
+	// Oper restricts the command to IRC operators.
+	Oper bool
+	// Cost is what the command takes from the client's flood allowance.
+	// Commands costing 0 are never delayed.
+	Cost int
+	// PerConnection hands the command the connection it came from rather
+	// than the always-on session the connection is attached to.
+	PerConnection bool
+}
+
+// commandRegistry holds the commands known to a server.
+type commandRegistry struct {
+	mu   sync.RWMutex
+	cmds map[string]Command
+}
+
+func (r *commandRegistry) lookup(name string) (Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.cmds[name]
+	return cmd, ok
+}
+
+// RegisterCommand adds the command name, replacing a built-in or earlier
+// command of that name.
+func (s *Server) RegisterCommand(name string, cmd Command) {
+	s.commands.mu.Lock()
+	defer s.commands.mu.Unlock()
+	s.commands.cmds[strings.ToUpper(name)] = cmd
+}
+
+// Numeric sends a numeric reply to c, as handlers of commands do. The last
+// parameter is sent as the trailing parameter.
+func (s *Server) Numeric(c *Client, code string, params ...string) {
+	s.numeric(c, code, params...)
+}
+
+// Reply sends a raw line to c. For an always-on session it only goes to
+// the connection whose command is being handled.
+func (c *Client) Reply(line string) {
+	c.reply(line)
+}
+
+// params adapts a handler taking the parameters of a command.
+func params(h func(s *Server, c *Client, params []string)) CommandHandler {
+	return func(s *Server, c *Client, m *Message) {
+		h(s, c, m.Params)
+	}
+}
+
+// localInfo adapts a handler of an informational command that may name a
+// target server.
+func localInfo(h func(s *Server, c *Client)) CommandHandler {
+	return func(s *Server, c *Client, m *Message) {
+		if s.isLocalServer(c, m.Params) {
+			h(s, c)
+		}
+	}
+}
+
+// builtinCommands returns the commands implemented by the server.
+func builtinCommands() map[string]Command {
+	return map[string]Command{
+		"CAP":          {Handler: params((*Server).handleCap), MinParams: 1, Unregistered: true, PerConnection: true},
+		"AUTHENTICATE": {Handler: params((*Server).handleAuthenticate), MinParams: 1, Unregistered: true, PerConnection: true},
+		"PING":         {Handler: handlePing, Unregistered: true, PerConnection: true},
+		"PONG":         {Handler: func(*Server, *Client, *Message) {}, Unregistered: true, PerConnection: true},
+		"QUIT":         {Handler: params((*Server).handleQuit), Unregistered: true, PerConnection: true},
+		"PASS":         {Handler: handlePass, MinParams: 1, Unregistered: true, PerConnection: true},
+		"SERVER":       {Handler: handleServerCmd, Unregistered: true, PerConnection: true},
+		"WEBIRC":       {Handler: params((*Server).handleWebIRC), MinParams: 4, Unregistered: true, PerConnection: true},
+		"ERROR":        {Handler: handleErrorCmd, Unregistered: true, PerConnection: true},
+		"NICK":         {Handler: params((*Server).handleNick), Unregistered: true, Cost: 1},
+		"USER":         {Handler: params((*Server).handleUser), MinParams: 1, Unregistered: true},
+
+		"JOIN":        {Handler: handleJoin, MinParams: 1, Cost: 1},
+		"PART":        {Handler: handlePart, MinParams: 1, Cost: 1},
+		"TOPIC":       {Handler: params((*Server).handleTopic), MinParams: 1, Cost: 1},
+		"PRIVMSG":     {Handler: (*Server).handleMessage, MinParams: 1, Cost: 1},
+		"NOTICE":      {Handler: (*Server).handleMessage, MinParams: 1, Cost: 1},
+		"TAGMSG":      {Handler: (*Server).handleMessage, MinParams: 1, Cost: 1},
+		"OPER":        {Handler: params((*Server).handleOper), MinParams: 2, Cost: 1},
+		"MOTD":        {Handler: localInfo((*Server).handleMOTD), Cost: 2},
+		"LUSERS":      {Handler: func(s *Server, c *Client, _ *Message) { s.handleLusers(c) }, Cost: 1},
+		"VERSION":     {Handler: localInfo((*Server).handleVersion), Cost: 1},
+		"TIME":        {Handler: localInfo((*Server).handleTime), Cost: 1},
+		"ADMIN":       {Handler: localInfo((*Server).handleAdmin), Cost: 1},
+		"INFO":        {Handler: localInfo((*Server).handleInfo), Cost: 2},
+		"MODE":        {Handler: params((*Server).handleMode), MinParams: 1, Cost: 1},
+		"WHO":         {Handler: params((*Server).handleWho), Cost: 2},
+		"WHOIS":       {Handler: params((*Server).handleWhois), Cost: 1},
+		"NAMES":       {Handler: params((*Server).handleNames), Cost: 1},
+		"WHOWAS":      {Handler: params((*Server).handleWhowas), Cost: 1},
+		"CHATHISTORY": {Handler: params((*Server).handleChatHistory), Cost: 2},
+		"MARKREAD":    {Handler: params((*Server).handleMarkRead), Cost: 1},
+
+		"STATS":   {Handler: params((*Server).handleStats), MinParams: 1, Oper: true},
+		"WALLOPS": {Handler: params((*Server).handleWallops), MinParams: 1, Oper: true},
+		"KLINE":   {Handler: params((*Server).handleKline), MinParams: 1, Oper: true},
+		"UNKLINE": {Handler: params((*Server).handleUnkline), MinParams: 1, Oper: true},
+		"DLINE":   {Handler: params((*Server).handleDline), MinParams: 1, Oper: true},
+		"UNDLINE": {Handler: params((*Server).handleUndline), MinParams: 1, Oper: true},
+		"LINKS":   {Handler: func(s *Server, c *Client, _ *Message) { s.handleLinks(c) }, Oper: true},
+		"CONNECT": {Handler: params((*Server).handleConnect), MinParams: 1, Oper: true},
+		"SQUIT":   {Handler: params((*Server).handleSquit), MinParams: 1, Oper: true},
+	}
+}
+
+func handlePing(s *Server, c *Client, m *Message) {
+	token := ""
+	if len(m.Params) > 0 {
+		token = m.Params[0]
+	}
+	c.send("PONG :" + token)
+}
+
+func handlePass(s *Server, c *Client, m *Message) {
+	if !c.registered {
+		c.pass = m.Params[0]
+	}
+}
+
+func handleServerCmd(s *Server, c *Client, m *Message) {
+	if !c.registered {
+		s.handleServer(c, m.Params)
+	}
+}
+
+// handleErrorCmd handles the ERROR a server sends when it refuses a link
+// we opened.
+func handleErrorCmd(s *Server, c *Client, m *Message) {
+	if c.linkTo != "" {
+		reason := strings.Join(m.Params, " ")
+		s.logError(EventLink, Fields{"server": c.linkTo, "reason": reason}, "Link to %s refused: %s", c.linkTo, reason)
+		c.Conn.Close()
+	}
+}
+
+func handleJoin(s *Server, c *Client, m *Message) {
+	for _, name := range strings.Split(m.Params[0], ",") {
+		s.joinChannel(c, name)
+	}
+}
+
+func handlePart(s *Server, c *Client, m *Message) {
+	reason := ""
+	if len(m.Params) > 1 {
+		reason = m.Params[1]
+	}
+	for _, name := range strings.Split(m.Params[0], ",") {
+		s.partChannel(c, name, reason)
+	}
+}
+
+// dispatch runs the checks declared by the command of m and calls its
+// handler.
+func (s *Server) dispatch(c *Client, m *Message) {
+	cmd, ok := s.commands.lookup(m.Command)
+	if !ok {
+		registered := c.registered
+		if c.user != nil {
+			registered = true
+		}
+		if registered {
+			s.numeric(c, errUnknownCommand, m.Command, "Unknown command")
+		} else {
+			s.numeric(c, errNotRegistered, "You have not registered")
+		}
+		return
+	}
+	s.throttle(c, cmd.Cost)
+	if u := c.user; u != nil && !cmd.PerConnection {
+		defer u.replyingTo(c)()
+		c = u
+	}
+	switch {
+	case !cmd.Unregistered && !c.registered:
+		s.numeric(c, errNotRegistered, "You have not registered")
+	case cmd.Oper && !s.isOper(c):
+		s.numeric(c, errNoPrivileges, "Permission Denied- You're not an IRC operator")
+	case len(m.Params) < cmd.MinParams:
+		s.numeric(c, errNeedMoreParams, m.Command, "Not enough parameters")
+	default:
+		cmd.Handler(s, c, m)
+	}
+}
+
+// floodBucket is the flood allowance of a connection. Only the goroutine
+// handling the lines of the connection uses it.
+type floodBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// throttle takes cost from the flood allowance of the connection c,
+// first waiting until it has earned enough when it is spent. Operators and
+// bots are not limited.
+func (s *Server) throttle(c *Client, cost int) {
+	cfg := s.config().Flood
+	if cost <= 0 || cfg.Burst < 0 {
+		return
+	}
+	if _, bot := c.Conn.(*botConn); bot {
+		return
+	}
+	u := c
+	if c.user != nil {
+		u = c.user
+	}
+	if s.isOper(u) {
+		return
+	}
+	now := time.Now()
+	b := &c.flood
+	burst := float64(cfg.Burst)
+	if b.at.IsZero() {
+		b.tokens = burst
+	} else if b.tokens += now.Sub(b.at).Seconds() * cfg.Rate; b.tokens > burst {
+		b.tokens = burst
+	}
+	b.at = now
+	b.tokens -= float64(cost)
+	if b.tokens < 0 {
+		time.Sleep(time.Duration(-b.tokens / cfg.Rate * float64(time.Second)))
+	}
+}
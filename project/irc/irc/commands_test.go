@@ -0,0 +1,124 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ic "vibes/client"
+)
+
+func TestCommandChecks(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	c, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Send("FROB")
+	readUntil(t, c, " 451 * :You have not registered")
+	c.Send("JOIN #early")
+	readUntil(t, c, " 451 * :You have not registered")
+	c.Login("alice")
+	readUntil(t, c, " 001 alice ")
+
+	c.Send("FROB x")
+	readUntil(t, c, " 421 alice FROB :Unknown command")
+	c.Send("JOIN")
+	readUntil(t, c, " 461 alice JOIN :Not enough parameters")
+	c.Send("PRIVMSG #early")
+	readUntil(t, c, " 412 alice :No text to send")
+	c.Send("KLINE *@example.com")
+	readUntil(t, c, " 481 alice :Permission Denied- You're not an IRC operator")
+	c.Send("PONG :irc.vibes.local")
+	c.Send("PING :done")
+	if line := readUntil(t, c, "PONG"); strings.Contains(line, " 421 ") {
+		t.Errorf("PONG refused: %q", line)
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Opers = []OperConfig{{Name: "admin", Password: "secret"}}
+	s := startServer(t, cfg)
+	s.RegisterCommand("hello", Command{
+		MinParams: 1,
+		Handler: func(s *Server, c *Client, m *Message) {
+			c.Reply(":" + s.Config().ServerName + " NOTICE " + c.Nickname + " :Hello, " + m.Params[0])
+		},
+	})
+	s.RegisterCommand("SECRET", Command{
+		Oper: true,
+		Handler: func(s *Server, c *Client, m *Message) {
+			s.Numeric(c, "300", "the secret")
+		},
+	})
+	alice := login(t, s, "alice")
+	alice.Send("HELLO")
+	readUntil(t, alice, " 461 alice HELLO ")
+	alice.Send("HELLO world")
+	readUntil(t, alice, "NOTICE alice :Hello, world")
+	alice.Send("SECRET")
+	readUntil(t, alice, " 481 alice ")
+	alice.Send("OPER admin secret")
+	readUntil(t, alice, " 381 ")
+	alice.Send("SECRET")
+	readUntil(t, alice, " 300 alice :the secret")
+}
+
+func TestFloodControl(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Flood = FloodConfig{Burst: 2, Rate: 20}
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		alice.Send("TIME")
+	}
+	for i := 0; i < 6; i++ {
+		readUntil(t, alice, " 391 ")
+	}
+	// NICK spent a token during registration, so five of the six TIMEs
+	// wait 50ms each.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("six commands took %v, want them throttled", elapsed)
+	}
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		alice.Send("PING :x")
+	}
+	for i := 0; i < 10; i++ {
+		readUntil(t, alice, "PONG")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("free commands took %v", elapsed)
+	}
+}
+
+func TestFloodKeepsReading(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Flood = FloodConfig{Burst: 1, Rate: 4}
+	cfg.PingInterval = Duration(100 * time.Millisecond)
+	cfg.PingTimeout = Duration(100 * time.Millisecond)
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	// Each TIME waits 250ms, longer than the ping timeout, so the PONGs
+	// must be read while the TIMEs are still throttled.
+	for i := 0; i < 4; i++ {
+		alice.Send("TIME")
+	}
+	for times := 0; times < 4; {
+		line, err := alice.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case strings.HasPrefix(line, "PING "):
+			alice.Send("PONG " + strings.TrimPrefix(line, "PING "))
+		case strings.HasPrefix(line, "ERROR "):
+			t.Fatalf("disconnected while throttled: %q", line)
+		case strings.Contains(line, " 391 "):
+			times++
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package irc
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration written as a string such as "90s" or "2m" in
+// configuration files.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config holds the tunable settings of a Server. Zero values are replaced by
+// the corresponding DefaultConfig value.
+type Config struct {
+	ServerName  string `json:"server_name"`
+	NetworkName string `json:"network_name"`
+	// ServerID identifies the server to linked servers: a digit followed
+	// by two upper case letters or digits. It is derived from ServerName
+	// when not set.
+	ServerID string `json:"server_id"`
+	// CaseMapping selects how nicknames and channel names are compared:
+	// "rfc1459" or "ascii".
+	CaseMapping string `json:"case_mapping"`
+	NickLen     int    `json:"nick_len"`
+	ChannelLen  int    `json:"channel_len"`
+	TopicLen    int    `json:"topic_len"`
+	// MaxChannels is the number of channels a client may be joined to.
+	MaxChannels int `json:"max_channels"`
+	// MaxTargets is the number of comma separated targets accepted by
+	// PRIVMSG, NOTICE and TAGMSG.
+	MaxTargets int `json:"max_targets"`
+	// MaxList is the number of entries allowed in each channel list mode.
+	MaxList int `json:"max_list"`
+	// UTF8Policy decides what happens to messages containing invalid
+	// UTF-8: UTF8Allow, UTF8Replace or UTF8Reject.
+	UTF8Policy string `json:"utf8_policy"`
+	// WhowasLength is the number of departed nicknames remembered for
+	// WHOWAS.
+	WhowasLength int `json:"whowas_length"`
+	// PingInterval is how long a client may stay silent before the server
+	// sends it a PING. Clients that stay silent for PingTimeout after that
+	// are disconnected.
+	PingInterval Duration      `json:"ping_interval"`
+	PingTimeout  Duration      `json:"ping_timeout"`
+	History      HistoryConfig `json:"history"`
+	Memos        MemoConfig    `json:"memos"`
+	Limits       LimitsConfig  `json:"limits"`
+	Flood        FloodConfig   `json:"flood"`
+	// Filters are checked, in order, against the text users send. They
+	// are reloaded on every rehash.
+	Filters []FilterConfig `json:"filters"`
+	// BansFile keeps the K-lines and D-lines set by operators across
+	// restarts. Bans are only kept in memory when it is empty. It is read
+	// when the server starts and is not changed by a rehash.
+	BansFile string `json:"bans_file"`
+	// Snapshot keeps channels, bans, offline messages and always-on
+	// sessions across restarts.
+	Snapshot SnapshotConfig `json:"snapshot"`
+	// MOTDFile is read on startup and on every rehash.
+	MOTDFile string       `json:"motd_file"`
+	Admin    AdminConfig  `json:"admin"`
+	Opers    []OperConfig `json:"opers"`
+	// Accounts lists the accounts clients may log in to with SASL PLAIN.
+	Accounts []AccountConfig `json:"accounts"`
+	// Links lists the servers allowed to link with this one.
+	Links []LinkConfig `json:"links"`
+	// Gateways lists the WEBIRC gateways allowed to connect on behalf of
+	// users.
+	Gateways []GatewayConfig `json:"gateways"`
+	// Listeners lists listeners opened next to the address the server was
+	// created with. They are opened on startup and not changed by a
+	// rehash.
+	Listeners []ListenerConfig `json:"listeners"`
+	// WebSocket configures the listener for browser clients.
+	WebSocket WebSocketConfig `json:"websocket"`
+	// Metrics configures the Prometheus metrics endpoint.
+	Metrics MetricsConfig `json:"metrics"`
+	// AdminAPI configures the HTTP API for administration scripts.
+	AdminAPI AdminAPIConfig `json:"admin_api"`
+	// Log configures the event log.
+	Log LogConfig `json:"log"`
+	// ChannelLogs configures the logs of channel activity written to disk.
+	ChannelLogs ChannelLogConfig `json:"channel_logs"`
+}
+
+// HistoryConfig controls message history and CHATHISTORY. The store is
+// chosen when the server starts and is not changed by a rehash.
+type HistoryConfig struct {
+	// Store is "memory" or "file". File history is kept in Dir.
+	Store string `json:"store"`
+	Dir   string `json:"dir"`
+	// Length is the number of messages kept per channel or conversation.
+	Length int `json:"length"`
+	// ReplayChannels lists the channels whose latest ReplayLength messages
+	// are sent to users joining them.
+	ReplayChannels []string `json:"replay_channels"`
+	ReplayLength   int      `json:"replay_length"`
+	// MaxQuery is the largest number of messages returned by one
+	// CHATHISTORY request.
+	MaxQuery int `json:"max_query"`
+}
+
+// MemoConfig controls private messages kept for accounts that are offline.
+type MemoConfig struct {
+	// MaxPerUser is the number of messages kept for one account.
+	MaxPerUser int `json:"max_per_user"`
+	// Expiry is how long a message waits before it is dropped.
+	Expiry Duration `json:"expiry"`
+}
+
+// SnapshotConfig controls the snapshot of server state. It is written to
+// File every Interval and when the server is closed, and read when the
+// server starts. No snapshot is kept when File is empty.
+type SnapshotConfig struct {
+	File string `json:"file"`
+	// Interval is five minutes by default. It is read when the server
+	// starts and is not changed by a rehash.
+	Interval Duration `json:"interval"`
+}
+
+// GatewayConfig is a WEBIRC gateway. It must connect from one of Hosts,
+// addresses or CIDR ranges, and send Password.
+type GatewayConfig struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Hosts    []string `json:"hosts"`
+}
+
+// ListenerConfig describes a listener accepting IRC connections.
+type ListenerConfig struct {
+	// Network is "tcp" or "unix"; Addr is the address or the socket path.
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	// Proxy makes connections from the addresses or CIDR ranges in
+	// ProxyFrom start with a PROXY protocol header naming the client.
+	// Other sources are served directly. Every source must send the
+	// header when ProxyFrom is empty.
+	Proxy     bool     `json:"proxy"`
+	ProxyFrom []string `json:"proxy_from"`
+}
+
+// WebSocketConfig controls IRC over WebSocket. The listener is opened when
+// the server starts and is not changed by a rehash; Origins is.
+type WebSocketConfig struct {
+	// Addr is the address of the HTTP listener accepting WebSocket
+	// connections. WebSocket is disabled when it is empty.
+	Addr string `json:"addr"`
+	// Origins lists the Origin values, which may contain * and ?
+	// wildcards, of web pages allowed to connect. When it is empty only
+	// pages from the host the WebSocket listener is reached at may connect.
+	Origins []string `json:"origins"`
+}
+
+// MetricsConfig controls the Prometheus metrics endpoint. The listener is
+// opened when the server starts and is not changed by a rehash.
+type MetricsConfig struct {
+	// Addr is the address of the HTTP listener serving /metrics. Metrics
+	// are not served when it is empty.
+	Addr string `json:"addr"`
+}
+
+// LogConfig controls the event log.
+type LogConfig struct {
+	// Level is the least severe level logged: "debug", "info", "warn" or
+	// "error".
+	Level string `json:"level"`
+}
+
+// ChannelLogConfig controls channel logs.
+type ChannelLogConfig struct {
+	// Dir holds a directory per logged channel. Channels are not logged
+	// when it is empty.
+	Dir string `json:"dir"`
+	// Channels lists masks of the channels logged, every channel when it
+	// is empty.
+	Channels []string `json:"channels"`
+	// Format is "text" or "jsonl".
+	Format string `json:"format"`
+	// MaxSize is the size in bytes at which a day's log is continued in a
+	// new file. Files grow without limit when it is 0.
+	MaxSize int64 `json:"max_size"`
+	// MaxAge is how long log files are kept, forever when it is 0.
+	MaxAge Duration `json:"max_age"`
+}
+
+// AdminAPIConfig controls the admin HTTP API. The listener is opened when
+// the server starts and is not changed by a rehash; Token is.
+type AdminAPIConfig struct {
+	// Addr is the address of the HTTP listener, best kept on a loopback
+	// address. The API is disabled when it is empty.
+	Addr string `json:"addr"`
+	// Token must be sent with every request as a bearer token. It is
+	// required when Addr is set.
+	Token string `json:"token"`
+}
+
+// FilterConfig is a content filter.
+type FilterConfig struct {
+	Name string `json:"name"`
+	// Pattern is a Go regular expression; (?i) makes it ignore case.
+	Pattern string `json:"pattern"`
+	// Action is what happens to matching text: FilterBlock, FilterWarn,
+	// FilterReplace, FilterKill, FilterBan or FilterNotify.
+	Action string `json:"action"`
+	// Commands lists the commands checked, PRIVMSG, NOTICE, TOPIC, PART
+	// and QUIT by default.
+	Commands []string `json:"commands"`
+	// Channels limits the filter to messages sent to channels matching
+	// one of its masks. Filters without channels apply everywhere.
+	Channels []string `json:"channels"`
+	// Replacement is substituted for matches by FilterReplace, "***" by
+	// default. Reason is told to the sender and used for kills and bans.
+	Replacement string `json:"replacement"`
+	Reason      string `json:"reason"`
+	// Duration is how long a FilterBan ban lasts, an hour by default.
+	Duration Duration `json:"duration"`
+}
+
+// LimitsConfig caps the number of connections. A negative limit disables
+// it.
+type LimitsConfig struct {
+	// MaxClients is the number of connections the server accepts.
+	MaxClients int `json:"max_clients"`
+	// PerIP is the number of connections accepted from one address and
+	// PerCIDR the number accepted from one network, an IPv4 /CIDRv4 or an
+	// IPv6 /CIDRv6.
+	PerIP   int `json:"per_ip"`
+	PerCIDR int `json:"per_cidr"`
+	CIDRv4  int `json:"cidr_v4"`
+	CIDRv6  int `json:"cidr_v6"`
+	// Exempt lists addresses and CIDR ranges the limits do not apply to.
+	Exempt []string `json:"exempt"`
+	// SendQ is the number of bytes that may wait to be written to a
+	// client, and LinkSendQ to a server link, before it is disconnected.
+	SendQ     int64 `json:"sendq"`
+	LinkSendQ int64 `json:"link_sendq"`
+}
+
+// FloodConfig controls how fast clients may send commands. Every command
+// costs a number of tokens; a client starts with Burst tokens and earns
+// Rate of them back per second. Commands of a client out of tokens wait
+// until it has earned enough.
+type FloodConfig struct {
+	// Burst is the number of tokens a client can spend at once. A
+	// negative burst disables flood control.
+	Burst int     `json:"burst"`
+	Rate  float64 `json:"rate"`
+}
+
+// AdminConfig is returned by the ADMIN command.
+type AdminConfig struct {
+	Location    string `json:"location"`
+	Description string `json:"description"`
+	Email       string `json:"email"`
+}
+
+// OperConfig is an operator block matched by the OPER command.
+type OperConfig struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// AccountConfig is a user account. Connections logged in to an AlwaysOn
+// account share one persistent session that stays on its channels while no
+// connection is attached.
+type AccountConfig struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	AlwaysOn bool   `json:"always_on"`
+}
+
+// LinkConfig describes a server this server may link with. The password
+// is sent by both sides, so it has to match on both.
+type LinkConfig struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Password string `json:"password"`
+}
+
+// DefaultConfig returns the configuration used by NewServer.
+func DefaultConfig() Config {
+	return Config{
+		ServerName:   "irc.vibes.local",
+		NetworkName:  "Vibes",
+		CaseMapping:  "rfc1459",
+		NickLen:      30,
+		ChannelLen:   50,
+		TopicLen:     390,
+		MaxChannels:  20,
+		MaxTargets:   4,
+		MaxList:      100,
+		UTF8Policy:   UTF8Replace,
+		Log:          LogConfig{Level: "info"},
+		ChannelLogs:  ChannelLogConfig{Format: "text"},
+		WhowasLength: 500,
+		PingInterval: Duration(2 * time.Minute),
+		PingTimeout:  Duration(time.Minute),
+		History: HistoryConfig{
+			Store:        "memory",
+			Dir:          "history",
+			Length:       1000,
+			ReplayLength: 50,
+			MaxQuery:     100,
+		},
+		Memos: MemoConfig{
+			MaxPerUser: 20,
+			Expiry:     Duration(7 * 24 * time.Hour),
+		},
+		Limits: LimitsConfig{
+			MaxClients: 1000,
+			PerIP:      20,
+			PerCIDR:    100,
+			CIDRv4:     24,
+			CIDRv6:     64,
+			SendQ:      1 << 20,
+			LinkSendQ:  32 << 20,
+		},
+		Flood:    FloodConfig{Burst: 20, Rate: 4},
+		Snapshot: SnapshotConfig{Interval: Duration(5 * time.Minute)},
+	}
+}
+
+// LoadConfig reads a JSON configuration file. Settings missing from the file
+// keep their default values.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg.withDefaults(), nil
+}
+
+func (cfg Config) withDefaults() Config {
+	def := DefaultConfig()
+	if cfg.ServerName == "" {
+		cfg.ServerName = def.ServerName
+	}
+	if cfg.NetworkName == "" {
+		cfg.NetworkName = def.NetworkName
+	}
+	if !validSID(cfg.ServerID) {
+		cfg.ServerID = sidFor(cfg.ServerName)
+	}
+	if cfg.CaseMapping != "ascii" && cfg.CaseMapping != "rfc1459" {
+		cfg.CaseMapping = def.CaseMapping
+	}
+	if cfg.NickLen <= 0 {
+		cfg.NickLen = def.NickLen
+	}
+	if cfg.ChannelLen <= 0 {
+		cfg.ChannelLen = def.ChannelLen
+	}
+	if cfg.TopicLen <= 0 {
+		cfg.TopicLen = def.TopicLen
+	}
+	if cfg.MaxChannels <= 0 {
+		cfg.MaxChannels = def.MaxChannels
+	}
+	if cfg.MaxTargets <= 0 {
+		cfg.MaxTargets = def.MaxTargets
+	}
+	if cfg.MaxList <= 0 {
+		cfg.MaxList = def.MaxList
+	}
+	if cfg.WhowasLength <= 0 {
+		cfg.WhowasLength = def.WhowasLength
+	}
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = def.PingInterval
+	}
+	if cfg.PingTimeout <= 0 {
+		cfg.PingTimeout = def.PingTimeout
+	}
+	if cfg.History.Store != "file" {
+		cfg.History.Store = def.History.Store
+	}
+	if cfg.History.Dir == "" {
+		cfg.History.Dir = def.History.Dir
+	}
+	if cfg.History.Length <= 0 {
+		cfg.History.Length = def.History.Length
+	}
+	if cfg.History.ReplayLength <= 0 {
+		cfg.History.ReplayLength = def.History.ReplayLength
+	}
+	if cfg.History.MaxQuery <= 0 {
+		cfg.History.MaxQuery = def.History.MaxQuery
+	}
+	if cfg.Memos.MaxPerUser <= 0 {
+		cfg.Memos.MaxPerUser = def.Memos.MaxPerUser
+	}
+	if cfg.Memos.Expiry <= 0 {
+		cfg.Memos.Expiry = def.Memos.Expiry
+	}
+	if cfg.Limits.MaxClients == 0 {
+		cfg.Limits.MaxClients = def.Limits.MaxClients
+	}
+	if cfg.Limits.PerIP == 0 {
+		cfg.Limits.PerIP = def.Limits.PerIP
+	}
+	if cfg.Limits.PerCIDR == 0 {
+		cfg.Limits.PerCIDR = def.Limits.PerCIDR
+	}
+	if cfg.Limits.CIDRv4 <= 0 || cfg.Limits.CIDRv4 > 32 {
+		cfg.Limits.CIDRv4 = def.Limits.CIDRv4
+	}
+	if cfg.Limits.CIDRv6 <= 0 || cfg.Limits.CIDRv6 > 128 {
+		cfg.Limits.CIDRv6 = def.Limits.CIDRv6
+	}
+	if cfg.Limits.SendQ == 0 {
+		cfg.Limits.SendQ = def.Limits.SendQ
+	}
+	if cfg.Limits.LinkSendQ == 0 {
+		cfg.Limits.LinkSendQ = def.Limits.LinkSendQ
+	}
+	if cfg.Flood.Burst == 0 {
+		cfg.Flood.Burst = def.Flood.Burst
+	}
+	if cfg.Flood.Rate <= 0 {
+		cfg.Flood.Rate = def.Flood.Rate
+	}
+	if cfg.Snapshot.Interval <= 0 {
+		cfg.Snapshot.Interval = def.Snapshot.Interval
+	}
+	switch cfg.UTF8Policy {
+	case UTF8Allow, UTF8Replace, UTF8Reject:
+	default:
+		cfg.UTF8Policy = def.UTF8Policy
+	}
+	if _, ok := parseLogLevel(cfg.Log.Level); !ok {
+		cfg.Log.Level = def.Log.Level
+	}
+	if cfg.ChannelLogs.Format != "jsonl" {
+		cfg.ChannelLogs.Format = def.ChannelLogs.Format
+	}
+	return cfg
+}
@@ -0,0 +1,215 @@
+package irc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Filters
+//
+// Filters match the text users send against regular expressions from
+// Config.Filters. PRIVMSG and NOTICE are checked once per message, against
+// the filters of any of its targets, TOPIC and PART per channel and QUIT
+// reasons only against filters that are not limited to channels. Filters
+// are compiled again on every rehash and swapped in atomically, so checking
+// text takes no lock; their hit counters are kept by name and listed with
+// STATS f.
+
+// Filter actions.
+const (
+	FilterBlock   = "block"
+	FilterWarn    = "warn"
+	FilterReplace = "replace"
+	FilterKill    = "kill"
+	FilterBan     = "ban"
+	FilterNotify  = "notify"
+)
+
+// filterCommands are the commands filters apply to by default.
+var filterCommands = []string{"PRIVMSG", "NOTICE", "TOPIC", "PART", "QUIT"}
+
+// defaultFilterBan is how long a ban placed by a filter lasts unless the
+// filter sets a duration.
+const defaultFilterBan = time.Hour
+
+// filter is a compiled FilterConfig. hits is shared with the filter of the
+// same name before a rehash.
+type filter struct {
+	FilterConfig
+	re   *regexp.Regexp
+	hits *atomic.Int64
+}
+
+// compileFilters compiles the configured filters. Filters with an invalid
+// pattern or action are logged and left out.
+func (s *Server) compileFilters(cfgs []FilterConfig) []*filter {
+	var filters []*filter
+	for _, fc := range cfgs {
+		re, err := regexp.Compile(fc.Pattern)
+		if err != nil {
+			s.logError(EventServer, Fields{"filter": fc.Name, "error": err.Error()}, "filter %s: %v", fc.Name, err)
+			continue
+		}
+		switch fc.Action {
+		case FilterBlock, FilterWarn, FilterReplace, FilterKill, FilterBan, FilterNotify:
+		default:
+			s.logError(EventServer, Fields{"filter": fc.Name, "action": fc.Action}, "filter %s: unknown action %q", fc.Name, fc.Action)
+			continue
+		}
+		if len(fc.Commands) == 0 {
+			fc.Commands = filterCommands
+		}
+		if fc.Replacement == "" {
+			fc.Replacement = "***"
+		}
+		if fc.Reason == "" {
+			fc.Reason = "Message blocked by filter " + fc.Name
+		}
+		if fc.Duration <= 0 {
+			fc.Duration = Duration(defaultFilterBan)
+		}
+		filters = append(filters, &filter{FilterConfig: fc, re: re})
+	}
+	return filters
+}
+
+// reloadFilters compiles the filters of the current configuration and
+// keeps the counters of those still configured. The caller must hold s.mu.
+func (s *Server) reloadFilters() {
+	hits := make(map[string]*atomic.Int64)
+	if old := s.filters.Load(); old != nil {
+		for _, f := range *old {
+			hits[f.Name] = f.hits
+		}
+	}
+	filters := s.compileFilters(s.cfg.Load().Filters)
+	for _, f := range filters {
+		if f.hits = hits[f.Name]; f.hits == nil {
+			f.hits = new(atomic.Int64)
+			hits[f.Name] = f.hits
+		}
+	}
+	s.filters.Store(&filters)
+}
+
+// filterAppliesTo reports whether f checks command sent to target, a comma
+// separated list of targets or "" for commands without one.
+func (s *Server) filterAppliesTo(f *filter, command, target string) bool {
+	found := false
+	for _, cmd := range f.Commands {
+		if strings.EqualFold(cmd, command) {
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+	if len(f.Channels) == 0 {
+		return true
+	}
+	for _, t := range strings.Split(target, ",") {
+		for _, ch := range f.Channels {
+			if t != "" && matchMask(s.cfg.Load().CaseMapping, ch, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterText runs the filters on text sent by c with command to target,
+// which may be a comma separated list of targets. It returns the text to send, changed by replace filters, and whether it
+// may be sent at all. Filters run in configuration order and the first
+// block, kill or ban stops the others.
+func (s *Server) filterText(c *Client, command, target, text string) (string, bool) {
+	type hit struct {
+		f    *filter
+		text string
+	}
+	var hits []hit
+	allowed := true
+	for _, f := range *s.filters.Load() {
+		if !s.filterAppliesTo(f, command, target) || !f.re.MatchString(text) {
+			continue
+		}
+		f.hits.Add(1)
+		hits = append(hits, hit{f, text})
+		if f.Action == FilterReplace {
+			text = f.re.ReplaceAllLiteralString(text, f.Replacement)
+			continue
+		}
+		if f.Action == FilterBlock || f.Action == FilterKill || f.Action == FilterBan {
+			allowed = false
+			break
+		}
+	}
+	if len(hits) == 0 {
+		return text, true
+	}
+
+	server := s.cfg.Load().ServerName
+	where := target
+	if where == "" {
+		where = command
+	}
+	for _, h := range hits {
+		f := h.f
+		s.logInfo(EventFilter, Fields{"filter": f.Name, "action": f.Action, "nick": c.nickname(), "target": where},
+			"Filter %s (%s) matched %s in %s", f.Name, f.Action, c.nickname(), where)
+		switch f.Action {
+		case FilterBlock:
+			c.reply(fmt.Sprintf(":%s NOTICE %s :Your message to %s was blocked: %s", server, c.nickname(), where, f.Reason))
+		case FilterWarn:
+			c.reply(fmt.Sprintf(":%s NOTICE %s :Warning: %s", server, c.nickname(), f.Reason))
+		case FilterNotify:
+			s.notifyOpers(fmt.Sprintf("Filter %s matched %s!%s@%s in %s: %s", f.Name, c.nickname(), c.Username, c.Host, where, h.text))
+		case FilterKill:
+			s.notifyOpers(fmt.Sprintf("Filter %s killed %s!%s@%s in %s: %s", f.Name, c.nickname(), c.Username, c.Host, where, h.text))
+			if conn := c.current(); conn.Conn != nil {
+				s.quit(conn, "Killed: "+f.Reason)
+			}
+		case FilterBan:
+			s.mu.RLock()
+			mask := "*@" + c.Host
+			if conn := c.current(); conn.ip != "" {
+				mask = "*@" + conn.ip
+			}
+			s.mu.RUnlock()
+			s.notifyOpers(fmt.Sprintf("Filter %s banned %s (%s) in %s: %s", f.Name, c.nickname(), mask, where, h.text))
+			now := time.Now()
+			s.placeBan(false, ban{Mask: mask, Reason: f.Reason, SetBy: "filter " + f.Name, Set: now, Expires: now.Add(time.Duration(f.Duration))})
+		}
+	}
+	return text, allowed
+}
+
+// notifyOpers sends a server notice to the local operators.
+func (s *Server) notifyOpers(text string) {
+	server := s.config().ServerName
+	var opers []*Client
+	s.mu.RLock()
+	for _, u := range s.nicks.all() {
+		if u.registered && u.via == nil && u.hasMode('o') {
+			opers = append(opers, u)
+		}
+	}
+	s.mu.RUnlock()
+	for _, o := range opers {
+		o.send(fmt.Sprintf(":%s NOTICE %s :*** %s", server, o.nickname(), text))
+	}
+}
+
+// statsFilters lists the filters and their hit counts for STATS f, in
+// configuration order.
+func (s *Server) statsFilters(c *Client) {
+	for _, f := range *s.filters.Load() {
+		scope := "*"
+		if len(f.Channels) > 0 {
+			scope = strings.Join(f.Channels, ",")
+		}
+		s.numeric(c, rplStatsDebug, "F", f.Name, f.Action, scope, fmt.Sprint(f.hits.Load()), f.Pattern)
+	}
+}
@@ -0,0 +1,404 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryItem is a message kept in the history of a channel or of a
+// conversation between two users.
+type HistoryItem struct {
+	Time    time.Time         `json:"time"`
+	MsgID   string            `json:"msgid"`
+	Source  string            `json:"source"`
+	Command string            `json:"command"`
+	Target  string            `json:"target"`
+	Text    string            `json:"text"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// HistoryStore keeps message history. Keys identify a channel or a pair of
+// users; see historyKey and dmHistoryKey.
+type HistoryStore interface {
+	// Append records item under key.
+	Append(key string, item HistoryItem) error
+	// Items returns the items stored under key, oldest first.
+	Items(key string) ([]HistoryItem, error)
+	// Keys returns every key with stored items.
+	Keys() ([]string, error)
+	// ReadMarker returns the time up to which account has read target, or
+	// the zero time if it has no marker.
+	ReadMarker(account, target string) (time.Time, error)
+	// SetReadMarker records the read marker of account for target.
+	SetReadMarker(account, target string, t time.Time) error
+}
+
+// MemoryHistory is a HistoryStore keeping the latest items of each key in
+// memory.
+type MemoryHistory struct {
+	mu      sync.Mutex
+	length  int
+	items   map[string][]HistoryItem
+	markers map[string]map[string]time.Time
+}
+
+// NewMemoryHistory returns a MemoryHistory keeping up to length items per
+// key.
+func NewMemoryHistory(length int) *MemoryHistory {
+	return &MemoryHistory{
+		length:  length,
+		items:   make(map[string][]HistoryItem),
+		markers: make(map[string]map[string]time.Time),
+	}
+}
+
+// Append implements HistoryStore.
+func (h *MemoryHistory) Append(key string, item HistoryItem) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.append(key, item)
+	return nil
+}
+
+func (h *MemoryHistory) append(key string, item HistoryItem) {
+	items := append(h.items[key], item)
+	if len(items) > h.length {
+		items = append([]HistoryItem(nil), items[len(items)-h.length:]...)
+	}
+	h.items[key] = items
+}
+
+// Items implements HistoryStore.
+func (h *MemoryHistory) Items(key string) ([]HistoryItem, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HistoryItem(nil), h.items[key]...), nil
+}
+
+// Keys implements HistoryStore.
+func (h *MemoryHistory) Keys() ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.items))
+	for k := range h.items {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// ReadMarker implements HistoryStore.
+func (h *MemoryHistory) ReadMarker(account, target string) (time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.markers[account][target], nil
+}
+
+// SetReadMarker implements HistoryStore.
+func (h *MemoryHistory) SetReadMarker(account, target string, t time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.setReadMarker(account, target, t)
+	return nil
+}
+
+func (h *MemoryHistory) setReadMarker(account, target string, t time.Time) {
+	if h.markers[account] == nil {
+		h.markers[account] = make(map[string]time.Time)
+	}
+	h.markers[account][target] = t
+}
+
+// FileHistory is a HistoryStore that appends every item to a JSON lines
+// file per key in a directory, so history survives restarts. The latest
+// items of each key are cached in memory; files are compacted when they
+// grow to twice the configured length. Read markers are kept in
+// readMarkersFile in the same directory.
+//
+// Every key has a lock of its own, so appends to different keys run in
+// parallel, and keeps its file open between appends. At most
+// maxOpenHistoryFiles files are open at a time.
+type FileHistory struct {
+	dir   string
+	cache *MemoryHistory
+	// mu guards files and open. markersMu serializes writes of the read
+	// markers file.
+	mu        sync.Mutex
+	files     map[string]*historyFile
+	open      int
+	markersMu sync.Mutex
+}
+
+// historyFile is the file of a key of a FileHistory.
+type historyFile struct {
+	mu    sync.Mutex
+	f     *os.File
+	lines int
+}
+
+// maxOpenHistoryFiles bounds the files a FileHistory keeps open.
+const maxOpenHistoryFiles = 128
+
+// NewFileHistory opens or creates a FileHistory in dir keeping up to
+// length items per key.
+func NewFileHistory(dir string, length int) (*FileHistory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &FileHistory{dir: dir, cache: NewMemoryHistory(length), files: make(map[string]*historyFile)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.loadReadMarkers(); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSuffix(name, ".jsonl"))
+		if err != nil {
+			continue
+		}
+		if err := h.load(key); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *FileHistory) path(key string) string {
+	return filepath.Join(h.dir, url.PathEscape(key)+".jsonl")
+}
+
+// file returns the file of key.
+func (h *FileHistory) file(key string) *historyFile {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hf := h.files[key]
+	if hf == nil {
+		hf = &historyFile{}
+		h.files[key] = hf
+	}
+	return hf
+}
+
+func (h *FileHistory) load(key string) error {
+	f, err := os.Open(h.path(key))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hf := h.file(key)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var item HistoryItem
+		if err := json.Unmarshal(sc.Bytes(), &item); err != nil {
+			continue
+		}
+		h.cache.append(key, item)
+		hf.lines++
+	}
+	return sc.Err()
+}
+
+// Append implements HistoryStore.
+func (h *FileHistory) Append(key string, item HistoryItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	hf := h.file(key)
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	h.cache.Append(key, item)
+	if hf.f == nil {
+		f, err := os.OpenFile(h.path(key), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		hf.f = f
+		h.opened(hf)
+	}
+	if _, err := hf.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	hf.lines++
+	if hf.lines >= 2*h.cache.length {
+		return h.compact(key, hf)
+	}
+	return nil
+}
+
+// opened counts the file just opened by hf and closes the files of other
+// keys while too many are open. Files whose key is being written to are
+// skipped rather than waited for. The caller must hold hf.mu.
+func (h *FileHistory) opened(hf *historyFile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.open++
+	for _, other := range h.files {
+		if h.open <= maxOpenHistoryFiles {
+			return
+		}
+		if other == hf || !other.mu.TryLock() {
+			continue
+		}
+		if other.f != nil {
+			other.f.Close()
+			other.f = nil
+			h.open--
+		}
+		other.mu.Unlock()
+	}
+}
+
+// closeFile closes the file of hf, if it is open. The caller must hold
+// hf.mu.
+func (h *FileHistory) closeFile(hf *historyFile) {
+	if hf.f == nil {
+		return
+	}
+	hf.f.Close()
+	hf.f = nil
+	h.mu.Lock()
+	h.open--
+	h.mu.Unlock()
+}
+
+// compact rewrites the file for key with only the cached items. The
+// caller must hold hf.mu.
+func (h *FileHistory) compact(key string, hf *historyFile) error {
+	h.closeFile(hf)
+	items, _ := h.cache.Items(key)
+	tmp := h.path(key) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.path(key)); err != nil {
+		return err
+	}
+	hf.lines = len(items)
+	return nil
+}
+
+// Items implements HistoryStore.
+func (h *FileHistory) Items(key string) ([]HistoryItem, error) {
+	return h.cache.Items(key)
+}
+
+// Keys implements HistoryStore.
+func (h *FileHistory) Keys() ([]string, error) {
+	return h.cache.Keys()
+}
+
+// readMarkersFile is the file holding the read markers of a FileHistory.
+const readMarkersFile = "read-markers.json"
+
+func (h *FileHistory) loadReadMarkers() error {
+	data, err := os.ReadFile(filepath.Join(h.dir, readMarkersFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var markers map[string]map[string]time.Time
+	if err := json.Unmarshal(data, &markers); err != nil {
+		return err
+	}
+	for account, targets := range markers {
+		for target, t := range targets {
+			h.cache.setReadMarker(account, target, t)
+		}
+	}
+	return nil
+}
+
+// ReadMarker implements HistoryStore.
+func (h *FileHistory) ReadMarker(account, target string) (time.Time, error) {
+	return h.cache.ReadMarker(account, target)
+}
+
+// SetReadMarker implements HistoryStore. The markers file is replaced as a
+// whole so a crash never leaves it half written.
+func (h *FileHistory) SetReadMarker(account, target string, t time.Time) error {
+	h.markersMu.Lock()
+	defer h.markersMu.Unlock()
+	h.cache.mu.Lock()
+	h.cache.setReadMarker(account, target, t)
+	data, err := json.Marshal(h.cache.markers)
+	h.cache.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(h.dir, readMarkersFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// newHistoryStore creates the store selected by cfg.
+func newHistoryStore(cfg HistoryConfig) (HistoryStore, error) {
+	if cfg.Store == "file" {
+		return NewFileHistory(cfg.Dir, cfg.Length)
+	}
+	return NewMemoryHistory(cfg.Length), nil
+}
+
+// historyKey is the history key of a channel.
+func (s *Server) historyKey(channel string) string {
+	return s.fold(channel)
+}
+
+// dmSide names a participant of a private conversation in its history key:
+// the account c is logged in to, or ~ and the nick of c. The caller must
+// hold s.mu.
+func (s *Server) dmSide(c *Client) string {
+	if c.account != "" {
+		return s.fold(c.account)
+	}
+	return "~" + s.fold(c.nickname())
+}
+
+// dmHistoryKey is the history key of the conversation between the sides a
+// and b, as named by dmSide. It does not depend on which side sent the
+// message. Conversations are kept by account so that a nick changing hands
+// does not hand them over, and only accounts can fetch them; the key is
+// empty when neither side is logged in.
+func dmHistoryKey(a, b string) string {
+	if strings.HasPrefix(a, "~") && strings.HasPrefix(b, "~") {
+		return ""
+	}
+	if a > b {
+		a, b = b, a
+	}
+	return "dm:" + a + "," + b
+}
@@ -0,0 +1,164 @@
+package irc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testItems(n int) []HistoryItem {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	items := make([]HistoryItem, n)
+	for i := range items {
+		items[i] = HistoryItem{Time: base.Add(time.Duration(i) * time.Second), MsgID: fmt.Sprint(i), Text: fmt.Sprint(i)}
+	}
+	return items
+}
+
+func itemIDs(items []HistoryItem) string {
+	ids := ""
+	for _, item := range items {
+		ids += item.MsgID
+	}
+	return ids
+}
+
+func TestHistorySelection(t *testing.T) {
+	items := testItems(10)
+	at := func(i int) time.Time { return items[i].Time }
+	cases := []struct {
+		name string
+		got  []HistoryItem
+		want string
+	}{
+		{"before", historyBefore(items, at(5), 3), "234"},
+		{"after", historyAfter(items, at(5), 3), "678"},
+		{"around", historyAround(items, at(5), 4), "3456"},
+		{"around start", historyAround(items, at(0), 3), "012"},
+		{"around end", historyAround(items, at(9), 3), "789"},
+		{"between", historyBetween(items, at(2), at(7), 10), "3456"},
+		{"between limited", historyBetween(items, at(2), at(7), 2), "34"},
+		{"between reversed", historyBetween(items, at(7), at(2), 2), "56"},
+	}
+	for _, tc := range cases {
+		if got := itemIDs(tc.got); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryHistoryBounded(t *testing.T) {
+	h := NewMemoryHistory(3)
+	for _, item := range testItems(5) {
+		h.Append("#room", item)
+	}
+	items, _ := h.Items("#room")
+	if got := itemIDs(items); got != "234" {
+		t.Errorf("got %s, want 234", got)
+	}
+}
+
+func TestFileHistoryPersists(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewFileHistory(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range testItems(7) {
+		if err := h.Append("#room", item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Append("dm:alice,bob", testItems(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileHistory(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _ := reopened.Items("#room")
+	if got := itemIDs(items); got != "456" {
+		t.Errorf("got %s, want 456", got)
+	}
+	keys, _ := reopened.Keys()
+	if len(keys) != 2 {
+		t.Errorf("expected 2 keys, got %v", keys)
+	}
+	data, err := os.ReadFile(reopened.path("#room"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Seven appends with a length of three compact the file once.
+	if lines := len(strings.Split(strings.TrimSpace(string(data)), "\n")); lines > 6 {
+		t.Errorf("file not compacted: %d lines", lines)
+	}
+}
+
+// TestFileHistoryConcurrentKeys appends to more keys than files are kept
+// open, from several goroutines at once.
+func TestFileHistoryConcurrentKeys(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewFileHistory(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keys = maxOpenHistoryFiles + 20
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for k := w; k < keys; k += 4 {
+				for _, item := range testItems(3) {
+					if err := h.Append(fmt.Sprintf("#room%d", k), item); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	h.mu.Lock()
+	open := h.open
+	h.mu.Unlock()
+	if open > maxOpenHistoryFiles {
+		t.Errorf("%d files open", open)
+	}
+
+	reopened, err := NewFileHistory(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < keys; k++ {
+		if items, _ := reopened.Items(fmt.Sprintf("#room%d", k)); itemIDs(items) != "012" {
+			t.Fatalf("#room%d holds %s", k, itemIDs(items))
+		}
+	}
+}
+
+func TestFileHistoryPersistsReadMarkers(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewFileHistory(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := h.SetReadMarker("alice", "#room", at); err != nil {
+		t.Fatal(err)
+	}
+	h, err = NewFileHistory(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := h.ReadMarker("alice", "#room"); !got.Equal(at) {
+		t.Errorf("read marker = %v, want %v", got, at)
+	}
+	if keys, _ := h.Keys(); len(keys) != 0 {
+		t.Errorf("read markers listed as history keys: %v", keys)
+	}
+}
@@ -0,0 +1,220 @@
+package irc
+
+import (
+	"sync"
+	"time"
+)
+
+// Hooks
+//
+// Programs embedding a Server can watch what happens on the network and
+// steer the commands of local clients. Event handlers are registered with
+// OnMessage, OnJoin, OnPart, OnNick and OnMode and see the activity of
+// every user, those of linked servers included. Command hooks registered
+// with AddCommandHook see each command of a local client, bots included,
+// before the server handles it, and may rewrite or drop it.
+//
+// Handlers run on the goroutine that caused the event, after the server
+// has applied it and without holding its lock, so they may call back into
+// the server but should not block.
+
+// MessageEvent is a PRIVMSG or NOTICE delivered to a channel or user.
+type MessageEvent struct {
+	Time    time.Time
+	Command string
+	Nick    string
+	// Target is the channel or the nick the message was sent to.
+	Target string
+	Text   string
+	// Tags holds the client-only tags of the message.
+	Tags map[string]string
+}
+
+// JoinEvent is a user joining a channel.
+type JoinEvent struct {
+	Nick    string
+	Channel string
+}
+
+// PartEvent is a user leaving a channel with PART or being kicked from it.
+type PartEvent struct {
+	Nick    string
+	Channel string
+	// By is the nick or server that kicked the user, empty for PART.
+	By     string
+	Reason string
+}
+
+// NickEvent is a nick change.
+type NickEvent struct {
+	Old, New string
+}
+
+// ModeEvent is a change of user modes, such as "+iw-B".
+type ModeEvent struct {
+	Nick  string
+	Modes string
+}
+
+// ClientInfo describes the client sending a command to a command hook.
+type ClientInfo struct {
+	Nick       string
+	User       string
+	Host       string
+	Account    string
+	Registered bool
+	Oper       bool
+}
+
+// CommandHook inspects a command before the server handles it. It returns
+// the message to handle, m itself, a changed copy or another command, or
+// nil to drop the command without an answer.
+type CommandHook func(c ClientInfo, m *Message) *Message
+
+// hookList holds handlers in the order they were added.
+type hookList[F any] struct {
+	mu     sync.Mutex
+	nextID int
+	hooks  []hookEntry[F]
+}
+
+type hookEntry[F any] struct {
+	id int
+	fn F
+}
+
+// add appends fn and returns a function removing it again.
+func (l *hookList[F]) add(fn F) (remove func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	id := l.nextID
+	l.hooks = append(l.hooks, hookEntry[F]{id, fn})
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, h := range l.hooks {
+			if h.id == id {
+				l.hooks = append(l.hooks[:i:i], l.hooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// funcs returns the handlers currently registered.
+func (l *hookList[F]) funcs() []F {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fns := make([]F, len(l.hooks))
+	for i, h := range l.hooks {
+		fns[i] = h.fn
+	}
+	return fns
+}
+
+// hooks holds the handlers registered by the program embedding a server.
+type hooks struct {
+	message  hookList[func(MessageEvent)]
+	join     hookList[func(JoinEvent)]
+	part     hookList[func(PartEvent)]
+	nick     hookList[func(NickEvent)]
+	mode     hookList[func(ModeEvent)]
+	commands hookList[CommandHook]
+}
+
+// OnMessage calls fn for every PRIVMSG and NOTICE delivered on the
+// network until the returned function is called.
+func (s *Server) OnMessage(fn func(MessageEvent)) (cancel func()) {
+	return s.hooks.message.add(fn)
+}
+
+// OnJoin calls fn whenever a user joins a channel until the returned
+// function is called.
+func (s *Server) OnJoin(fn func(JoinEvent)) (cancel func()) {
+	return s.hooks.join.add(fn)
+}
+
+// OnPart calls fn whenever a user parts or is kicked from a channel until
+// the returned function is called.
+func (s *Server) OnPart(fn func(PartEvent)) (cancel func()) {
+	return s.hooks.part.add(fn)
+}
+
+// OnNick calls fn for every nick change until the returned function is
+// called.
+func (s *Server) OnNick(fn func(NickEvent)) (cancel func()) {
+	return s.hooks.nick.add(fn)
+}
+
+// OnMode calls fn for every change of user modes until the returned
+// function is called.
+func (s *Server) OnMode(fn func(ModeEvent)) (cancel func()) {
+	return s.hooks.mode.add(fn)
+}
+
+// AddCommandHook runs hook on every command of a local client until the
+// returned function is called. Hooks run in the order they were added,
+// each seeing the message returned by the one before.
+func (s *Server) AddCommandHook(hook CommandHook) (remove func()) {
+	return s.hooks.commands.add(hook)
+}
+
+func (s *Server) emitMessage(e MessageEvent) {
+	for _, fn := range s.hooks.message.funcs() {
+		fn(e)
+	}
+}
+
+func (s *Server) emitJoin(e JoinEvent) {
+	for _, fn := range s.hooks.join.funcs() {
+		fn(e)
+	}
+}
+
+func (s *Server) emitPart(e PartEvent) {
+	for _, fn := range s.hooks.part.funcs() {
+		fn(e)
+	}
+}
+
+func (s *Server) emitNick(e NickEvent) {
+	for _, fn := range s.hooks.nick.funcs() {
+		fn(e)
+	}
+}
+
+func (s *Server) emitMode(e ModeEvent) {
+	for _, fn := range s.hooks.mode.funcs() {
+		fn(e)
+	}
+}
+
+// runCommandHooks passes m through the command hooks and returns the
+// message to handle, nil if a hook dropped it.
+func (s *Server) runCommandHooks(c *Client, m *Message) *Message {
+	hooks := s.hooks.commands.funcs()
+	if len(hooks) == 0 {
+		return m
+	}
+	u := c
+	if c.user != nil {
+		u = c.user
+	}
+	s.mu.RLock()
+	info := ClientInfo{
+		Nick:       u.nickname(),
+		User:       u.Username,
+		Host:       u.Host,
+		Account:    c.account,
+		Registered: c.registered,
+		Oper:       u.hasMode('o'),
+	}
+	s.mu.RUnlock()
+	for _, hook := range hooks {
+		if m = hook(info, m); m == nil {
+			return nil
+		}
+	}
+	return m
+}
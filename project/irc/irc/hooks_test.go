@@ -0,0 +1,102 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEventHooks(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	var mu sync.Mutex
+	var events []string
+	record := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf(format, args...))
+	}
+	cancels := []func(){
+		s.OnMessage(func(e MessageEvent) { record("message %s %s %s %s", e.Command, e.Nick, e.Target, e.Text) }),
+		s.OnJoin(func(e JoinEvent) { record("join %s %s", e.Nick, e.Channel) }),
+		s.OnPart(func(e PartEvent) { record("part %s %s", e.Nick, e.Channel) }),
+		s.OnNick(func(e NickEvent) { record("nick %s %s", e.Old, e.New) }),
+		s.OnMode(func(e ModeEvent) { record("mode %s %s", e.Nick, e.Modes) }),
+	}
+
+	alice := login(t, s, "alice")
+	alice.Join("#Chat")
+	readUntil(t, alice, " 366 ")
+	alice.Msg("#chat", "hello")
+	alice.Send("NOTICE alice :note")
+	alice.Send("PING :sync")
+	readUntil(t, alice, "PONG")
+	alice.Send("MODE alice +w")
+	readUntil(t, alice, "MODE alice :+w")
+	alice.Send("NICK alicia")
+	readUntil(t, alice, "NICK alicia")
+	alice.Send("PART #chat")
+	alice.Send("PING :sync")
+	readUntil(t, alice, "PONG")
+	for _, cancel := range cancels {
+		cancel()
+	}
+	alice.Join("#other")
+	readUntil(t, alice, " 366 ")
+
+	want := []string{
+		"join alice #Chat",
+		"message PRIVMSG alice #Chat hello",
+		"message NOTICE alice alice note",
+		"mode alice +w",
+		"nick alice alicia",
+		"part alicia #Chat",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCommandHooks(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	var mu sync.Mutex
+	var seen []string
+	s.AddCommandHook(func(c ClientInfo, m *Message) *Message {
+		if m.Command == "PRIVMSG" {
+			mu.Lock()
+			seen = append(seen, c.Nick)
+			mu.Unlock()
+		}
+		if m.Command == "PRIVMSG" && len(m.Params) == 2 && strings.Contains(m.Params[1], "secret") {
+			return nil
+		}
+		return m
+	})
+	remove := s.AddCommandHook(func(c ClientInfo, m *Message) *Message {
+		if m.Command == "JOIN" && len(m.Params) > 0 && m.Params[0] == "#old" {
+			return &Message{Command: "JOIN", Params: []string{"#new"}}
+		}
+		return m
+	})
+
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	alice.Msg("bob", "the secret is out")
+	alice.Msg("bob", "nothing to see")
+	if line := readUntil(t, bob, "PRIVMSG bob"); !strings.HasSuffix(strings.TrimSpace(line), ":nothing to see") {
+		t.Errorf("dropped message delivered: %q", line)
+	}
+	alice.Join("#old")
+	readUntil(t, alice, ":alice JOIN #new")
+	remove()
+	alice.Join("#old")
+	readUntil(t, alice, ":alice JOIN #old")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0] != "alice" {
+		t.Errorf("hook saw PRIVMSG from %q", seen)
+	}
+}
@@ -0,0 +1,186 @@
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// infoText is returned line by line in reply to INFO.
+var infoText = []string{
+	"vibes IRC server " + Version,
+	"A small IRC server written in Go.",
+}
+
+// loadMOTD reads the message of the day from path. An empty path means the
+// server has no MOTD.
+func loadMOTD(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		lines = append(lines, strings.TrimRight(sc.Text(), "\r"))
+	}
+	return lines, sc.Err()
+}
+
+// isLocalServer reports whether the optional <target> parameter of an
+// informational command names this server. It sends ERR_NOSUCHSERVER
+// otherwise.
+func (s *Server) isLocalServer(c *Client, params []string) bool {
+	if len(params) == 0 {
+		return true
+	}
+	name := s.config().ServerName
+	local := strings.EqualFold(params[0], name) || s.nicks.get(s.fold(params[0])) != nil
+	if local {
+		return true
+	}
+	s.numeric(c, errNoSuchServer, params[0], "No such server")
+	return false
+}
+
+func (s *Server) handleMOTD(c *Client) {
+	s.mu.Lock()
+	motd := s.motd
+	s.mu.Unlock()
+	if motd == nil {
+		s.numeric(c, errNoMOTD, "MOTD File is missing")
+		return
+	}
+	s.numeric(c, rplMOTDStart, fmt.Sprintf("- %s Message of the day - ", s.config().ServerName))
+	for _, line := range motd {
+		s.numeric(c, rplMOTD, "- "+line)
+	}
+	s.numeric(c, rplEndOfMOTD, "End of /MOTD command.")
+}
+
+func (s *Server) handleLusers(c *Client) {
+	s.mu.RLock()
+	users, invisible, unknown, opers := 0, 0, 0, 0
+	local, links := 0, 0
+	for _, cl := range s.clients {
+		switch {
+		case cl.peer != nil:
+			links++
+		case !cl.registered:
+			unknown++
+		}
+	}
+	// Users are counted by nickname so that an always-on session counts
+	// once however many connections are attached to it.
+	for _, cl := range s.nicks.all() {
+		if !cl.registered {
+			continue
+		}
+		users++
+		if cl.via == nil {
+			local++
+		}
+		if cl.hasMode('i') {
+			invisible++
+		}
+		if cl.hasMode('o') {
+			opers++
+		}
+	}
+	channels := s.channels.len()
+	servers := len(s.servers) + 1
+	maxUsers := s.maxClients
+	s.mu.RUnlock()
+
+	s.numeric(c, rplLuserClient, fmt.Sprintf("There are %d users and %d invisible on %d servers", users-invisible, invisible, servers))
+	s.numeric(c, rplLuserOp, fmt.Sprint(opers), "operator(s) online")
+	s.numeric(c, rplLuserUnknown, fmt.Sprint(unknown), "unknown connection(s)")
+	s.numeric(c, rplLuserChannels, fmt.Sprint(channels), "channels formed")
+	s.numeric(c, rplLuserMe, fmt.Sprintf("I have %d clients and %d servers", local, links))
+	s.numeric(c, rplLocalUsers, fmt.Sprint(local), fmt.Sprint(maxUsers), fmt.Sprintf("Current local users %d, max %d", local, maxUsers))
+	s.numeric(c, rplGlobalUsers, fmt.Sprint(users), fmt.Sprint(maxUsers), fmt.Sprintf("Current global users %d, max %d", users, maxUsers))
+}
+
+func (s *Server) handleVersion(c *Client) {
+	s.numeric(c, rplVersion, Version+".", s.config().ServerName, "")
+	s.sendISupport(c)
+}
+
+func (s *Server) handleTime(c *Client) {
+	s.numeric(c, rplTime, s.config().ServerName, time.Now().Format(time.RFC1123))
+}
+
+func (s *Server) handleAdmin(c *Client) {
+	cfg := s.config()
+	if cfg.Admin == (AdminConfig{}) {
+		s.numeric(c, errNoAdminInfo, cfg.ServerName, "No administrative info available")
+		return
+	}
+	s.numeric(c, rplAdminMe, cfg.ServerName, "Administrative info")
+	s.numeric(c, rplAdminLoc1, cfg.Admin.Location)
+	s.numeric(c, rplAdminLoc2, cfg.Admin.Description)
+	s.numeric(c, rplAdminEmail, cfg.Admin.Email)
+}
+
+func (s *Server) handleInfo(c *Client) {
+	for _, line := range infoText {
+		s.numeric(c, rplInfo, line)
+	}
+	s.numeric(c, rplInfo, "Started "+s.created.Format(time.RFC1123))
+	s.numeric(c, rplEndOfInfo, "End of /INFO list")
+}
+
+// handleStats answers the oper-only STATS query. Supported letters are
+// u (uptime and connection counts), m (command usage) and l (per
+// connection traffic).
+func (s *Server) handleStats(c *Client, params []string) {
+	if params[0] == "" {
+		s.numeric(c, errNeedMoreParams, "STATS", "Not enough parameters")
+		return
+	}
+	query := params[0][:1]
+	switch query {
+	case "u":
+		up := int(time.Since(s.created).Seconds())
+		s.numeric(c, rplStatsUptime, fmt.Sprintf("Server Up %d days %d:%02d:%02d",
+			up/86400, up%86400/3600, up%3600/60, up%60))
+		s.mu.Lock()
+		maxClients, total := s.maxClients, s.totalConns
+		s.mu.Unlock()
+		s.numeric(c, rplStatsConn, fmt.Sprintf("Highest connection count: %d (%d connections received)", maxClients, total))
+	case "m":
+		for _, name := range s.metrics.commandNames() {
+			st := s.metrics.command(name)
+			s.numeric(c, rplStatsCommands, name, fmt.Sprint(st.count.Load()), fmt.Sprint(st.bytes.Load()), "0")
+		}
+	case "l":
+		s.mu.Lock()
+		clients := make([]*Client, 0, len(s.clients))
+		for _, cl := range s.clients {
+			clients = append(clients, cl)
+		}
+		s.mu.Unlock()
+		for _, cl := range clients {
+			name := cl.nick()
+			if name == "" {
+				name = "*"
+			}
+			s.numeric(c, rplStatsLinkInfo,
+				fmt.Sprintf("%s[%s]", name, cl.Conn.RemoteAddr()), "0",
+				fmt.Sprint(cl.sentMsgs.Load()), fmt.Sprint(cl.sentBytes.Load()/1024),
+				fmt.Sprint(cl.recvMsgs.Load()), fmt.Sprint(cl.recvBytes.Load()/1024),
+				fmt.Sprint(int(time.Since(cl.connected).Seconds())))
+		}
+	case "k", "d":
+		s.statsBans(c, query)
+	case "f":
+		s.statsFilters(c)
+	}
+	s.numeric(c, rplEndOfStats, query, "End of /STATS report")
+}
@@ -0,0 +1,85 @@
+package irc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMOTDReloadsOnRehash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd.txt")
+	if err := os.WriteFile(path, []byte("first motd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.MOTDFile = path
+	s := startServer(t, cfg)
+	c := login(t, s, "alice")
+
+	c.Send("MOTD")
+	readUntil(t, c, " 372 alice :- first motd")
+
+	if err := os.WriteFile(path, []byte("second motd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.Rehash(cfg)
+	c.Send("MOTD")
+	readUntil(t, c, " 372 alice :- second motd")
+}
+
+func TestLusersCounts(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	c := login(t, s, "alice")
+	login(t, s, "bob")
+	c.Join("#room")
+	readUntil(t, c, "JOIN #room")
+
+	c.Send("LUSERS")
+	if line := readUntil(t, c, " 251 "); !strings.Contains(line, "There are 2 users") {
+		t.Errorf("unexpected LUSERS reply %q", line)
+	}
+	readUntil(t, c, " 254 alice 1 :channels formed")
+}
+
+func TestVersionTimeAdminInfo(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Admin = AdminConfig{Location: "Basement", Email: "ops@example.com"}
+	s := startServer(t, cfg)
+	c := login(t, s, "alice")
+
+	c.Send("VERSION")
+	readUntil(t, c, " 351 alice "+Version)
+	readUntil(t, c, " 005 alice ")
+	c.Send("TIME")
+	readUntil(t, c, " 391 alice "+cfg.ServerName)
+	c.Send("ADMIN")
+	readUntil(t, c, " 257 alice :Basement")
+	readUntil(t, c, " 259 alice :ops@example.com")
+	c.Send("INFO")
+	readUntil(t, c, " 374 alice ")
+	c.Send("TIME other.server")
+	readUntil(t, c, " 402 alice other.server ")
+}
+
+func TestStatsRequiresOper(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Opers = []OperConfig{{Name: "admin", Password: "secret"}}
+	s := startServer(t, cfg)
+	c := login(t, s, "alice")
+
+	c.Send("STATS u")
+	readUntil(t, c, " 481 alice ")
+	c.Send("OPER admin wrong")
+	readUntil(t, c, " 464 alice ")
+	c.Send("OPER admin secret")
+	readUntil(t, c, " 381 alice ")
+
+	c.Send("STATS u")
+	readUntil(t, c, " 242 alice :Server Up 0 days")
+	readUntil(t, c, " 219 alice u ")
+	c.Send("STATS m")
+	readUntil(t, c, " 212 alice OPER 2 ")
+	c.Send("STATS l")
+	readUntil(t, c, " 211 alice alice[")
+}
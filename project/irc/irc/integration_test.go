@@ -1,19 +1,102 @@
 package irc
 
 import (
+	"bytes"
 	"errors"
 	"net"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	ic "vibes/client"
 )
 
+// startServer runs a server with cfg on a random port until the test ends.
+func startServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	s := NewServerWithConfig(":0", cfg)
+	// Keep the events of s and show them only when the test fails.
+	var mu sync.Mutex
+	var events bytes.Buffer
+	s.SetLogSink(NewJSONSink(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return events.Write(p)
+	})))
+	t.Cleanup(func() {
+		if t.Failed() {
+			mu.Lock()
+			t.Logf("events of %s:\n%s", s.config().ServerName, events.String())
+			mu.Unlock()
+		}
+	})
+	go s.Run()
+	<-s.Ready()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// login connects to s and registers as nick, consuming the welcome burst.
+func login(t *testing.T, s *Server, nick string) *ic.Client {
+	t.Helper()
+	c, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Login(nick); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, c, " 001 "+nick+" ")
+	// MOTD or ERR_NOMOTD ends the welcome burst.
+	for {
+		line := readUntil(t, c, " "+nick+" ")
+		if strings.Contains(line, " 376 ") || strings.Contains(line, " 422 ") {
+			return c
+		}
+	}
+}
+
+// readUntil reads lines from c until one contains substr. It fails the test
+// if no such line arrives within a few seconds.
+func readUntil(t *testing.T, c *ic.Client, substr string) string {
+	t.Helper()
+	found := make(chan string, 1)
+	go func() {
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				close(found)
+				return
+			}
+			if strings.Contains(line, substr) {
+				found <- line
+				return
+			}
+		}
+	}()
+	select {
+	case line, ok := <-found:
+		if !ok {
+			t.Fatalf("connection closed before %q was received", substr)
+		}
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%q not received", substr)
+		return ""
+	}
+}
+
 func TestClientFlow(t *testing.T) {
 	s := NewServer(":0")
 	go func() {
 		if err := s.Run(); err != nil && !errors.Is(err, net.ErrClosed) {
-			t.Fatalf("server error: %v", err)
+			t.Errorf("server error: %v", err)
 		}
 	}()
 	<-s.Ready()
@@ -39,45 +122,87 @@ func TestClientFlow(t *testing.T) {
 	}
 
 	c1.Join("#room")
+	readUntil(t, c1, "alice JOIN #room")
 	c2.Join("#room")
 
-    //fmt.Printf("c1 and c2 joined...\n")
-
-    // read join messages: one for c1 and two after c2 joins
-    c1.ReadLine()
-    c2.ReadLine()
-    c1.ReadLine()
+	// read join messages: c2 sees its own join and c1 sees bob arrive
+	readUntil(t, c2, "bob JOIN #room")
+	readUntil(t, c1, "bob JOIN #room")
 
 	c1.Msg("#room", "hello")
+	readUntil(t, c2, "PRIVMSG #room :hello")
 
-	received := false
-	for i := 0; i < 5; i++ {
-		line, err := c2.ReadLine()
+	c2.Part("#room")
+	readUntil(t, c1, "PART #room")
+
+	// A PART from someone not on the channel is refused, not broadcast.
+	c2.Part("#room")
+	readUntil(t, c2, " 442 bob #room ")
+	c1.Send("PING :done")
+	for {
+		line, err := c1.ReadLine()
 		if err != nil {
 			t.Fatal(err)
 		}
-		if strings.Contains(line, "PRIVMSG #room :hello") {
-			received = true
+		if strings.Contains(line, "PART") {
+			t.Errorf("member saw a PART of a non-member: %q", line)
+		}
+		if strings.Contains(line, "PONG") {
 			break
 		}
 	}
-	if !received {
-		t.Fatal("privmsg not received")
-	}
+}
 
-	c2.Part("#room")
-	partReceived := false
-	for i := 0; i < 5; i++ {
-		line, err := c1.ReadLine()
+// readISupport collects the RPL_ISUPPORT lines sent to nick up to the next
+// line of another kind.
+func readISupport(t *testing.T, c *ic.Client, nick string) string {
+	t.Helper()
+	var tokens []string
+	line := readUntil(t, c, " 005 "+nick+" ")
+	for strings.Contains(line, " 005 ") {
+		tokens = append(tokens, strings.TrimSpace(line))
+		next, err := c.ReadLine()
 		if err != nil {
 			t.Fatal(err)
 		}
-		if strings.Contains(line, "PART #room") {
-			partReceived = true
-			break
-		}
+		line = next
 	}
-	if !partReceived {
-		t.Fatal("part not received")
+	return strings.Join(tokens, " ")
+}
+
+func TestRegistrationSendsISupport(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NetworkName = "Test Net"
+	cfg.NickLen = 12
+	s := startServer(t, cfg)
+
+	c, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Login("alice")
+
+	readUntil(t, c, " 001 alice ")
+	tokens := readISupport(t, c, "alice")
+	if !strings.Contains(tokens, "NETWORK=Test\\x20Net") || !strings.Contains(tokens, "NICKLEN=12") {
+		t.Errorf("unexpected ISUPPORT tokens %q", tokens)
 	}
+
+	cfg.NickLen = 16
+	s.Rehash(cfg)
+	c.Send("PING :end") // terminates the resent RPL_ISUPPORT lines
+	if tokens := readISupport(t, c, "alice"); !strings.Contains(tokens, "NICKLEN=16") {
+		t.Errorf("rehash did not resend ISUPPORT: %q", tokens)
+	}
+}
+
+func TestInputTooLong(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	c := login(t, s, "alice")
+
+	c.Msg("#room", strings.Repeat("x", 70000))
+	readUntil(t, c, " 417 alice ")
+	c.Join("#room")
+	readUntil(t, c, "alice JOIN #room")
 }
@@ -0,0 +1,124 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxISupportTokens is the number of tokens sent in a single RPL_ISUPPORT
+// line. Together with the nickname and the trailing text it keeps each line
+// within the 15 parameter limit.
+const maxISupportTokens = 13
+
+// chanTypes lists the channel prefixes accepted by JOIN.
+const chanTypes = "#"
+
+// chanModes lists the channel modes implemented by the server in CHANMODES
+// order: list modes, modes that always take a parameter, modes that take a
+// parameter only when set, and flag modes.
+var chanModes = [4]string{"", "", "", ""}
+
+// memberModes lists the channel membership modes implemented by the server,
+// highest rank first, together with the prefix shown in NAMES replies.
+var memberModes = []struct{ mode, prefix byte }{}
+
+// targMax lists the commands accepting comma separated targets. A zero limit
+// means the command accepts any number of targets.
+func targMax(cfg Config) []string {
+	return []string{
+		"JOIN:",
+		fmt.Sprintf("NOTICE:%d", cfg.MaxTargets),
+		"PART:",
+		fmt.Sprintf("PRIVMSG:%d", cfg.MaxTargets),
+		fmt.Sprintf("TAGMSG:%d", cfg.MaxTargets),
+	}
+}
+
+// isupportTokens derives the RPL_ISUPPORT tokens from cfg and the features
+// implemented by the server.
+func isupportTokens(cfg Config) []string {
+	tokens := []string{
+		"BOT=B",
+		"CASEMAPPING=" + cfg.CaseMapping,
+		fmt.Sprintf("CHANLIMIT=%s:%d", chanTypes, cfg.MaxChannels),
+		"CHANMODES=" + strings.Join(chanModes[:], ","),
+		fmt.Sprintf("CHANNELLEN=%d", cfg.ChannelLen),
+		"CHANTYPES=" + chanTypes,
+		fmt.Sprintf("CHATHISTORY=%d", cfg.History.MaxQuery),
+	}
+	if lists := chanModes[0]; lists != "" {
+		tokens = append(tokens, fmt.Sprintf("MAXLIST=%s:%d", lists, cfg.MaxList))
+	}
+	var modes, prefixes strings.Builder
+	for _, m := range memberModes {
+		modes.WriteByte(m.mode)
+		prefixes.WriteByte(m.prefix)
+	}
+	prefix := ""
+	if modes.Len() > 0 {
+		prefix = "(" + modes.String() + ")" + prefixes.String()
+	}
+	tokens = append(tokens,
+		"MSGREFTYPES=msgid,timestamp",
+		"NETWORK="+escapeISupport(cfg.NetworkName),
+		fmt.Sprintf("NICKLEN=%d", cfg.NickLen),
+		"PREFIX="+prefix,
+		"TARGMAX="+strings.Join(targMax(cfg), ","),
+		fmt.Sprintf("TOPICLEN=%d", cfg.TopicLen),
+	)
+	if cfg.UTF8Policy == UTF8Reject {
+		tokens = append(tokens, "UTF8ONLY")
+	}
+	return tokens
+}
+
+// isupportLines splits tokens into groups small enough for one RPL_ISUPPORT
+// line each.
+func isupportLines(tokens []string) [][]string {
+	var lines [][]string
+	for len(tokens) > maxISupportTokens {
+		lines = append(lines, tokens[:maxISupportTokens])
+		tokens = tokens[maxISupportTokens:]
+	}
+	if len(tokens) > 0 {
+		lines = append(lines, tokens)
+	}
+	return lines
+}
+
+// escapeISupport escapes characters that may not appear in a token value.
+func escapeISupport(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case ' ', '\\', '=':
+			fmt.Fprintf(&b, "\\x%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// sendISupport sends the RPL_ISUPPORT lines for the current configuration.
+func (s *Server) sendISupport(c *Client) {
+	for _, tokens := range isupportLines(isupportTokens(s.config())) {
+		params := append(append([]string(nil), tokens...), "are supported by this server")
+		s.numeric(c, rplISupport, params...)
+	}
+}
+
+// foldCase maps name to its canonical form under the given casemapping so
+// that nicknames and channel names compare case-insensitively.
+func foldCase(mapping, name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			b[i] = c + 'a' - 'A'
+		case mapping == "rfc1459" && c >= '[' && c <= '^':
+			b[i] = c + '{' - '['
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,46 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestISupportTokensFollowConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NickLen = 9
+	cfg.ChannelLen = 32
+	cfg.MaxTargets = 2
+	cfg.CaseMapping = "ascii"
+	tokens := strings.Join(isupportTokens(cfg), " ")
+	for _, want := range []string{"NICKLEN=9", "CHANNELLEN=32", "CASEMAPPING=ascii", "CHANTYPES=#", "TARGMAX=JOIN:,NOTICE:2,PART:,PRIVMSG:2,TAGMSG:2"} {
+		if !strings.Contains(tokens, want) {
+			t.Errorf("expected %s in %q", want, tokens)
+		}
+	}
+}
+
+func TestISupportLinesSplit(t *testing.T) {
+	tokens := make([]string, 30)
+	for i := range tokens {
+		tokens[i] = "T"
+	}
+	lines := isupportLines(tokens)
+	if len(lines) != 3 || len(lines[0]) != maxISupportTokens || len(lines[2]) != 4 {
+		t.Errorf("unexpected split: %d lines", len(lines))
+	}
+}
+
+func TestEscapeISupport(t *testing.T) {
+	if got := escapeISupport(`a b=c\d`); got != `a\x20b\x3Dc\x5Cd` {
+		t.Errorf("unexpected escape %q", got)
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	if got := foldCase("rfc1459", "Nick[]\\^"); got != "nick{}|~" {
+		t.Errorf("rfc1459 fold: %q", got)
+	}
+	if got := foldCase("ascii", "Nick[]"); got != "nick[]" {
+		t.Errorf("ascii fold: %q", got)
+	}
+}
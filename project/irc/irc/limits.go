@@ -0,0 +1,68 @@
+package irc
+
+import "net"
+
+// reloadExempt parses Limits.Exempt of the current configuration. The
+// caller must hold s.mu.
+func (s *Server) reloadExempt() {
+	exempt, err := parseCIDRs(s.cfg.Load().Limits.Exempt)
+	if err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "limits exempt list: %v", err)
+	}
+	s.exempt = exempt
+}
+
+// admit decides whether the new connection c may be served and returns the
+// reason it is refused, or "" to accept it. D-lines apply to every
+// address; the connection limits not to the exempt ones. The caller must
+// hold s.mu.
+func (s *Server) admit(c *Client) string {
+	if ban, ok := s.dlined(c.ip); ok {
+		return "D-lined: " + ban.Reason
+	}
+	lim := s.cfg.Load().Limits
+	ip := net.ParseIP(c.ip)
+	if ip != nil && ipInNets(ip, s.exempt) {
+		return ""
+	}
+	total, sameIP, sameNet := 0, 0, 0
+	var network *net.IPNet
+	if ip != nil {
+		network = limitNetwork(ip, lim)
+	}
+	for _, other := range s.clients {
+		if other.peer != nil {
+			continue
+		}
+		total++
+		if ip == nil || other.ip == "" {
+			continue
+		}
+		otherIP := net.ParseIP(other.ip)
+		if otherIP.Equal(ip) {
+			sameIP++
+		}
+		if network.Contains(otherIP) {
+			sameNet++
+		}
+	}
+	switch {
+	case lim.MaxClients >= 0 && total >= lim.MaxClients:
+		return "Server is full, please try again later"
+	case lim.PerIP >= 0 && sameIP >= lim.PerIP:
+		return "Too many connections from your address"
+	case lim.PerCIDR >= 0 && sameNet >= lim.PerCIDR:
+		return "Too many connections from your network"
+	}
+	return ""
+}
+
+// limitNetwork returns the network ip is counted in for PerCIDR.
+func limitNetwork(ip net.IP, lim LimitsConfig) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(lim.CIDRv4, 8*net.IPv4len)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(lim.CIDRv6, 8*net.IPv6len)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
@@ -0,0 +1,54 @@
+package irc
+
+import (
+	"testing"
+
+	ic "vibes/client"
+)
+
+func TestConnectionLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limits = LimitsConfig{MaxClients: 3, PerIP: 2, PerCIDR: -1}
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Addr: "127.0.0.1:0", Proxy: true}}
+	s := startServer(t, cfg)
+
+	login(t, s, "one")
+	login(t, s, "two")
+	third, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { third.Close() })
+	readUntil(t, third, "(Too many connections from your address)")
+
+	other := dialListener(t, s, 0, []byte("PROXY TCP4 203.0.113.1 127.0.0.1 40000 6667\r\n"))
+	other.Login("three")
+	readUntil(t, other, " 001 three ")
+	full := dialListener(t, s, 0, []byte("PROXY TCP4 203.0.113.2 127.0.0.1 40000 6667\r\n"))
+	readUntil(t, full, "(Server is full, please try again later)")
+}
+
+func TestConnectionLimitsPerNetworkAndExempt(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limits = LimitsConfig{PerCIDR: 1, CIDRv4: 16, Exempt: []string{"203.0.200.0/24"}}
+	cfg.Listeners = []ListenerConfig{{Network: "tcp", Addr: "127.0.0.1:0", Proxy: true}}
+	s := startServer(t, cfg)
+
+	first := dialListener(t, s, 0, []byte("PROXY TCP4 198.51.1.1 127.0.0.1 40000 6667\r\n"))
+	first.Login("first")
+	readUntil(t, first, " 001 first ")
+	second := dialListener(t, s, 0, []byte("PROXY TCP4 198.51.2.2 127.0.0.1 40000 6667\r\n"))
+	readUntil(t, second, "(Too many connections from your network)")
+
+	for _, nick := range []string{"ex1", "ex2"} {
+		c := dialListener(t, s, 0, []byte("PROXY TCP4 203.0.200.9 127.0.0.1 40000 6667\r\n"))
+		c.Login(nick)
+		readUntil(t, c, " 001 "+nick+" ")
+	}
+
+	cfg.Limits.Exempt = []string{"198.51.0.0/16"}
+	s.Rehash(cfg)
+	third := dialListener(t, s, 0, []byte("PROXY TCP4 198.51.3.3 127.0.0.1 40000 6667\r\n"))
+	third.Login("third")
+	readUntil(t, third, " 001 third ")
+}
@@ -0,0 +1,797 @@
+package irc
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server linking
+//
+// Servers listed in Config.Links join into one network shaped like a tree.
+// A link starts out like a client connection: the connecting side sends
+//
+//	PASS <password>
+//	SERVER <name> <sid> :<description>
+//
+// and the other side answers the same way once the password matches. Both
+// then burst everything they know as SERVER, UID, SJOIN and TOPIC lines
+// ended by EOB, and from then on forward every change. Users are named by their UID,
+// the SID of their server followed by a counter, so lines stay unambiguous
+// across nick changes. A nick collision is settled by timestamp: the user
+// that took the nick last is renamed to its UID, both users when the
+// timestamps are equal. Every server applies the same rule, so settling a
+// collision needs no messages of its own.
+
+// serverDescription is sent to linked servers and shown in WHOIS and LINKS.
+const serverDescription = "vibes IRC server"
+
+// maxLinkLineLen is the line length accepted from linked servers. Server
+// lines may be longer than the client line they relay.
+const maxLinkLineLen = 2 * maxLineLen
+
+// linkDialTimeout bounds the time CONNECT waits for a connection.
+const linkDialTimeout = 10 * time.Second
+
+// sjoinChunk is the number of users listed in one SJOIN line.
+const sjoinChunk = 20
+
+// linkedServer is a server of the network other than this one.
+type linkedServer struct {
+	name, sid, desc string
+	// hops is the distance from this server, 1 for direct links.
+	hops int
+	// uplink is the name of the server it is linked to.
+	uplink string
+	// via is the link connection leading to it.
+	via *Client
+}
+
+// sidFor derives a server ID from a server name, for configurations that
+// do not set one.
+func sidFor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	const alnum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	v := h.Sum32()
+	return string([]byte{'0' + byte(v%10), alnum[v/10%36], alnum[v/360%36]})
+}
+
+// validSID reports whether sid is a digit followed by two upper case
+// letters or digits.
+func validSID(sid string) bool {
+	if len(sid) != 3 || sid[0] < '0' || sid[0] > '9' {
+		return false
+	}
+	for i := 1; i < 3; i++ {
+		if !(sid[i] >= '0' && sid[i] <= '9' || sid[i] >= 'A' && sid[i] <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// sendLink writes a line to a server link. Unlike send it never truncates.
+func (c *Client) sendLink(line string) {
+	c.write(line + "\r\n")
+}
+
+// linkConns returns the established server links other than except. The
+// caller must hold s.mu.
+func (s *Server) linkConns(except *Client) []*Client {
+	var links []*Client
+	for c := range s.links {
+		if c != except {
+			links = append(links, c)
+		}
+	}
+	return links
+}
+
+// propagate sends line to every linked server except the link it came
+// from.
+func (s *Server) propagate(except *Client, line string) {
+	s.mu.RLock()
+	links := s.linkConns(except)
+	s.mu.RUnlock()
+	for _, l := range links {
+		l.sendLink(line)
+	}
+}
+
+// linkConfig returns the link block for the server called name. The caller
+// must hold s.mu.
+func (s *Server) linkConfig(name string) (LinkConfig, bool) {
+	for _, lc := range s.cfg.Load().Links {
+		if strings.EqualFold(lc.Name, name) {
+			return lc, true
+		}
+	}
+	return LinkConfig{}, false
+}
+
+// serverBySID returns the linked server with the given ID. The caller must
+// hold s.mu.
+func (s *Server) serverBySID(sid string) *linkedServer {
+	for _, srv := range s.servers {
+		if srv.sid == sid {
+			return srv
+		}
+	}
+	return nil
+}
+
+// serverKnown reports whether name or sid is already used by this server or
+// one it is linked with. The caller must hold s.mu.
+func (s *Server) serverKnown(name, sid string) bool {
+	return strings.EqualFold(name, s.cfg.Load().ServerName) || sid == s.sid ||
+		s.servers[strings.ToLower(name)] != nil || s.serverBySID(sid) != nil
+}
+
+// uplinkSID returns the ID of the server srv is linked to. The caller must
+// hold s.mu.
+func (s *Server) uplinkSID(srv *linkedServer) string {
+	if up := s.servers[strings.ToLower(srv.uplink)]; up != nil {
+		return up.sid
+	}
+	return s.sid
+}
+
+// newUID returns a unique ID for a user of this server. The caller must
+// hold s.mu.
+func (s *Server) newUID() string {
+	s.nextUID++
+	return fmt.Sprintf("%s%06d", s.sid, s.nextUID)
+}
+
+// introduceUser gives a newly registered local user its UID and announces
+// it to the linked servers.
+func (s *Server) introduceUser(c *Client) {
+	s.mu.Lock()
+	c.id = s.newUID()
+	c.ts = time.Now().Unix()
+	s.uids[c.id] = c
+	line := s.uidLine(c)
+	s.mu.Unlock()
+	s.propagate(nil, line)
+}
+
+// uidLine formats the UID line introducing c. The caller must hold s.mu.
+func (s *Server) uidLine(c *Client) string {
+	sid, account := s.sid, c.account
+	if c.server != nil {
+		sid = c.server.sid
+	}
+	if account == "" {
+		account = "*"
+	}
+	return fmt.Sprintf(":%s UID %s %d %s %s %s %s %s :%s", sid, c.nickname(), c.ts, c.id,
+		c.Username, c.Host, modeString(c.modes), account, c.Realname)
+}
+
+// handleServer completes the handshake of a server link: it checks the
+// password sent with PASS, answers with our own PASS and SERVER if the
+// other side connected to us and sends the burst.
+func (s *Server) handleServer(c *Client, params []string) {
+	if len(params) < 3 {
+		s.quit(c, "Invalid SERVER")
+		return
+	}
+	name, sid, desc := params[0], params[1], params[len(params)-1]
+	s.mu.Lock()
+	lc, ok := s.linkConfig(name)
+	reason := ""
+	switch {
+	case !ok || subtle.ConstantTimeCompare([]byte(lc.Password), []byte(c.pass)) != 1:
+		reason = "Bad link credentials"
+	case c.linkTo != "" && !strings.EqualFold(c.linkTo, name):
+		reason = "Unexpected server name"
+	case !validSID(sid):
+		reason = "Invalid server ID"
+	case s.serverKnown(name, sid):
+		reason = "Server already exists"
+	}
+	if reason != "" {
+		s.mu.Unlock()
+		s.logWarn(EventLink, Fields{"server": name, "reason": reason}, "Refused link with %s: %s", name, reason)
+		s.quit(c, reason)
+		return
+	}
+	ourName := s.cfg.Load().ServerName
+	s.mu.Unlock()
+	if c.linkTo == "" {
+		c.sendLink("PASS " + lc.Password)
+		c.sendLink(fmt.Sprintf("SERVER %s %s :%s", ourName, s.sid, serverDescription))
+	}
+
+	c.sendq.setLimit(s.cfg.Load().Limits.LinkSendQ)
+	s.mu.Lock()
+	peer := &linkedServer{name: name, sid: sid, desc: desc, hops: 1, uplink: ourName, via: c}
+	c.peer = peer
+	s.links[c] = true
+	s.servers[strings.ToLower(name)] = peer
+	burst := s.burst(c)
+	// Queued while s.mu is held, so that nothing sent to the link later
+	// overtakes the burst. Queueing never waits on the peer, which is
+	// sending its own burst at the same time.
+	for _, l := range burst {
+		c.sendLink(l)
+	}
+	s.mu.Unlock()
+	s.logInfo(EventLink, Fields{"server": name, "host": c.Host}, "Linked with %s (%s)", name, c.Host)
+	s.propagate(c, fmt.Sprintf(":%s SERVER %s 2 %s :%s", s.sid, name, sid, desc))
+}
+
+// burst returns the lines telling link everything this server knows about
+// the network, except what lies behind link itself. The caller must hold
+// s.mu.
+func (s *Server) burst(link *Client) []string {
+	var lines []string
+	servers := make([]*linkedServer, 0, len(s.servers))
+	for _, srv := range s.servers {
+		if srv.via != link {
+			servers = append(servers, srv)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].hops < servers[j].hops })
+	for _, srv := range servers {
+		lines = append(lines, fmt.Sprintf(":%s SERVER %s %d %s :%s", s.uplinkSID(srv), srv.name, srv.hops+1, srv.sid, srv.desc))
+	}
+	for _, u := range s.nicks.all() {
+		if u.registered && u.id != "" && u.via != link {
+			lines = append(lines, s.uidLine(u))
+		}
+	}
+	for _, ch := range s.channels.all() {
+		var ids []string
+		ch.mu.RLock()
+		for m := range ch.Members {
+			if m.id != "" && m.via != link {
+				ids = append(ids, m.id)
+			}
+		}
+		ts, topic, topicBy, topicAt := ch.ts, ch.topic, ch.topicBy, ch.topicAt
+		ch.mu.RUnlock()
+		sort.Strings(ids)
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > sjoinChunk {
+				n = sjoinChunk
+			}
+			lines = append(lines, fmt.Sprintf(":%s SJOIN %d %s :%s", s.sid, ts, ch.Name, strings.Join(ids[:n], " ")))
+			ids = ids[n:]
+		}
+		if topic != "" {
+			lines = append(lines, topicLine(s.sid, ch.Name, topic, topicBy, topicAt))
+		}
+	}
+	return append(lines, ":"+s.sid+" EOB")
+}
+
+// handleLinkLine handles a line received from a linked server.
+// linkCommands holds the commands handleLinkLine understands.
+var linkCommands = map[string]bool{
+	"PING": true, "PONG": true, "EOB": true, "ERROR": true, "SERVER": true, "SQUIT": true,
+	"UID": true, "NICK": true, "JOIN": true, "SJOIN": true, "PART": true, "KICK": true,
+	"TOPIC": true, "QUIT": true, "MODE": true, "PRIVMSG": true, "NOTICE": true,
+	"TAGMSG": true, "WALLOPS": true,
+}
+
+func (s *Server) handleLinkLine(l *Client, m *Message) {
+	switch m.Command {
+	case "PING":
+		token := ""
+		if len(m.Params) > 0 {
+			token = m.Params[0]
+		}
+		l.sendLink("PONG :" + token)
+	case "PONG":
+	case "EOB":
+		s.logDebug(EventLink, Fields{"server": l.peer.name, "sid": m.Source}, "End of burst from %s", m.Source)
+	case "ERROR":
+		s.logError(EventLink, Fields{"server": l.peer.name, "reason": strings.Join(m.Params, " ")}, "Link %s: %s", l.peer.name, strings.Join(m.Params, " "))
+	case "SERVER":
+		s.linkServer(l, m)
+	case "SQUIT":
+		s.linkSquit(l, m)
+	case "UID":
+		s.linkUID(l, m)
+	case "NICK":
+		s.linkNick(l, m)
+	case "JOIN", "SJOIN":
+		s.linkJoin(l, m)
+	case "PART":
+		s.linkPart(l, m)
+	case "KICK":
+		s.linkKick(l, m)
+	case "TOPIC":
+		s.linkTopic(l, m)
+	case "QUIT":
+		s.linkQuit(l, m)
+	case "MODE":
+		s.linkMode(l, m)
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		s.linkMessage(l, m)
+	case "WALLOPS":
+		s.linkWallops(l, m)
+	}
+}
+
+// remoteUser returns the user a line from the link l comes from.
+func (s *Server) remoteUser(l *Client, m *Message) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.uids[m.Source]; u != nil && u.via == l {
+		return u
+	}
+	return nil
+}
+
+// linkServer records a server introduced behind l.
+func (s *Server) linkServer(l *Client, m *Message) {
+	if len(m.Params) < 4 {
+		return
+	}
+	hops, _ := strconv.Atoi(m.Params[1])
+	name, sid, desc := m.Params[0], m.Params[2], m.Params[3]
+	s.mu.Lock()
+	if s.serverKnown(name, sid) {
+		s.mu.Unlock()
+		s.logError(EventLink, Fields{"server": name, "link": l.peer.name}, "Server %s introduced twice, dropping link with %s", name, l.peer.name)
+		s.quit(l, "Server "+name+" already exists")
+		return
+	}
+	uplink := l.peer.name
+	if up := s.serverBySID(m.Source); up != nil {
+		uplink = up.name
+	}
+	s.servers[strings.ToLower(name)] = &linkedServer{name: name, sid: sid, desc: desc, hops: hops, uplink: uplink, via: l}
+	s.mu.Unlock()
+	s.logInfo(EventLink, Fields{"server": name, "uplink": uplink}, "Server %s joined the network via %s", name, uplink)
+	s.propagate(l, fmt.Sprintf(":%s SERVER %s %d %s :%s", m.Source, name, hops+1, sid, desc))
+}
+
+// linkUID adds a user introduced by a linked server.
+func (s *Server) linkUID(l *Client, m *Message) {
+	if len(m.Params) < 8 {
+		return
+	}
+	ts, _ := strconv.ParseInt(m.Params[1], 10, 64)
+	u := &Client{
+		Username:   m.Params[3],
+		Host:       m.Params[4],
+		Realname:   m.Params[7],
+		Channels:   make(map[string]bool),
+		registered: true,
+		id:         m.Params[2],
+		ts:         ts,
+		via:        l,
+	}
+	u.setNick(m.Params[0])
+	if acct := m.Params[6]; acct != "*" {
+		u.account = acct
+	}
+	for _, mode := range strings.TrimPrefix(m.Params[5], "+") {
+		u.setMode(byte(mode), true)
+	}
+	s.mu.Lock()
+	u.server = s.serverBySID(m.Source)
+	// Only the link a server was introduced through may introduce its
+	// users.
+	if u.server == nil || u.server.via != l || s.uids[u.id] != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.uids[u.id] = u
+	renames := s.claimNick(u, u.nickname(), ts)
+	s.mu.Unlock()
+	s.announceRenames(renames)
+	s.propagate(l, m.String())
+}
+
+// nickRename is a nick change forced by a collision, announced to the
+// peers of the renamed user.
+type nickRename struct {
+	old, new string
+	peers    map[*Client]bool
+	channels []string
+}
+
+// claimNick gives nick to u unless a user who took it earlier holds it. The
+// loser of a collision is renamed to its UID, as are both users when their
+// timestamps are equal. The caller must hold s.mu.
+func (s *Server) claimNick(u *Client, nick string, ts int64) []nickRename {
+	var renames []nickRename
+	if other := s.nicks.get(s.fold(nick)); other != nil && other != u {
+		if other.ts >= ts {
+			renames = append(renames, s.renameUser(other, other.id))
+		}
+		if ts >= other.ts {
+			nick = u.id
+		}
+	}
+	u.ts = ts
+	old := u.nickname()
+	known := s.nicks.get(s.fold(old)) == u
+	if old == nick && known {
+		return renames
+	}
+	if known {
+		s.recordWhowas(u)
+		s.nicks.deleteIf(s.fold(old), u)
+	}
+	u.setNick(nick)
+	s.nicks.set(s.fold(nick), u)
+	if known {
+		renames = append(renames, nickRename{old, nick, s.peers(u), s.channelNames(u)})
+	}
+	return renames
+}
+
+// renameUser changes the nick of c without a collision check. The caller
+// must hold s.mu.
+func (s *Server) renameUser(c *Client, nick string) nickRename {
+	old := c.nickname()
+	s.recordWhowas(c)
+	s.nicks.deleteIf(s.fold(old), c)
+	c.setNick(nick)
+	s.nicks.set(s.fold(nick), c)
+	s.logInfo(EventNick, Fields{"old": old, "nick": nick, "collision": true}, "Nick collision: %s renamed to %s", old, nick)
+	return nickRename{old, nick, s.peers(c), s.channelNames(c)}
+}
+
+func (s *Server) announceRenames(renames []nickRename) {
+	for _, r := range renames {
+		s.broadcast(r.peers, fmt.Sprintf(":%s NICK %s", r.old, r.new))
+		for _, name := range r.channels {
+			s.logChannel(name, "nick", r.old, r.new, "")
+		}
+		s.emitNick(NickEvent{r.old, r.new})
+	}
+}
+
+// linkNick applies a nick change of a remote user.
+func (s *Server) linkNick(l *Client, m *Message) {
+	u := s.remoteUser(l, m)
+	if u == nil || len(m.Params) < 2 {
+		return
+	}
+	ts, _ := strconv.ParseInt(m.Params[1], 10, 64)
+	s.mu.Lock()
+	renames := s.claimNick(u, m.Params[0], ts)
+	s.mu.Unlock()
+	s.announceRenames(renames)
+	s.propagate(l, m.String())
+}
+
+// linkJoin adds remote users to a channel: one user for JOIN, a list for
+// SJOIN. The channel keeps the oldest creation time it is given.
+func (s *Server) linkJoin(l *Client, m *Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+	ts, _ := strconv.ParseInt(m.Params[0], 10, 64)
+	name := m.Params[1]
+	var ids []string
+	if m.Command == "SJOIN" {
+		if len(m.Params) < 3 {
+			return
+		}
+		ids = strings.Fields(m.Params[2])
+	} else {
+		ids = []string{m.Source}
+	}
+	if !validChannel(name, len(name)) {
+		return
+	}
+	key := s.fold(name)
+	s.mu.RLock()
+	users := make([]*Client, 0, len(ids))
+	for _, id := range ids {
+		if u := s.uids[id]; u != nil && u.via == l {
+			users = append(users, u)
+		}
+	}
+	s.mu.RUnlock()
+	var ch *Channel
+	var joined []*Client
+	for _, u := range users {
+		var added bool
+		if ch, added = s.addMember(u, key, name, ts); added {
+			joined = append(joined, u)
+		}
+	}
+	if len(joined) > 0 {
+		members := ch.members()
+		for _, u := range joined {
+			s.logChannel(ch.Name, "join", u.nickname(), "", "")
+			s.emitJoin(JoinEvent{u.nickname(), ch.Name})
+			s.broadcast(members, fmt.Sprintf(":%s JOIN %s", u.nickname(), ch.Name))
+		}
+	}
+	s.propagate(l, m.String())
+}
+
+// linkPart removes a remote user from a channel.
+func (s *Server) linkPart(l *Client, m *Message) {
+	u := s.remoteUser(l, m)
+	if u == nil || len(m.Params) < 1 {
+		return
+	}
+	reason := ""
+	if len(m.Params) > 1 {
+		reason = m.Params[1]
+	}
+	s.leaveChannel(u, m.Params[0], reason)
+	s.propagate(l, m.String())
+}
+
+// linkKick removes a user from a channel on behalf of a remote server.
+func (s *Server) linkKick(l *Client, m *Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+	s.mu.Lock()
+	srv := s.serverBySID(m.Source)
+	u := s.uids[m.Params[1]]
+	s.mu.Unlock()
+	if srv == nil || srv.via != l || u == nil {
+		return
+	}
+	s.kick(srv.name, m.Params[0], u, m.Params[2])
+	s.propagate(l, m.String())
+}
+
+// linkTopic sets a channel topic changed by a remote user or server.
+func (s *Server) linkTopic(l *Client, m *Message) {
+	if len(m.Params) < 4 {
+		return
+	}
+	s.mu.Lock()
+	source := ""
+	if u := s.uids[m.Source]; u != nil && u.via == l {
+		source = u.nickname()
+	} else if srv := s.serverBySID(m.Source); srv != nil && srv.via == l {
+		source = srv.name
+	}
+	s.mu.Unlock()
+	if source == "" {
+		return
+	}
+	at, _ := strconv.ParseInt(m.Params[2], 10, 64)
+	s.setTopic(source, m.Params[0], m.Params[3], m.Params[1], time.Unix(at, 0))
+	s.propagate(l, m.String())
+}
+
+// linkQuit removes a remote user that quit.
+func (s *Server) linkQuit(l *Client, m *Message) {
+	u := s.remoteUser(l, m)
+	if u == nil {
+		return
+	}
+	reason := ""
+	if len(m.Params) > 0 {
+		reason = m.Params[0]
+	}
+	s.removeUsers([]*Client{u}, reason)
+	s.propagate(l, m.String())
+}
+
+// linkMode applies user mode changes of a remote user.
+func (s *Server) linkMode(l *Client, m *Message) {
+	u := s.remoteUser(l, m)
+	if u == nil || len(m.Params) < 2 {
+		return
+	}
+	s.mu.Lock()
+	on := true
+	for _, mode := range m.Params[1] {
+		switch mode {
+		case '+', '-':
+			on = mode == '+'
+		default:
+			u.setMode(byte(mode), on)
+		}
+	}
+	nick := u.nickname()
+	s.mu.Unlock()
+	s.emitMode(ModeEvent{nick, m.Params[1]})
+	s.propagate(l, m.String())
+}
+
+// propagateModes tells the linked servers about user mode changes of c.
+func (s *Server) propagateModes(c *Client, changes string) {
+	if c.id != "" {
+		s.propagate(nil, fmt.Sprintf(":%s MODE %s %s", c.id, c.id, changes))
+	}
+}
+
+// linkMessage delivers a PRIVMSG, NOTICE or TAGMSG from a remote user.
+func (s *Server) linkMessage(l *Client, m *Message) {
+	u := s.remoteUser(l, m)
+	if u == nil || len(m.Params) < 1 || (m.Command != "TAGMSG" && len(m.Params) < 2) {
+		return
+	}
+	text := ""
+	if m.Command != "TAGMSG" {
+		text = m.Params[1]
+	}
+	tags := m.Tags
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	delete(tags, "bot")
+	s.deliverMessage(u, l, m.Command, m.Params[0], text, tags)
+}
+
+// linkWallops delivers WALLOPS from a remote operator.
+func (s *Server) linkWallops(l *Client, m *Message) {
+	u := s.remoteUser(l, m)
+	if u == nil || len(m.Params) < 1 {
+		return
+	}
+	s.sendWallops(u, m.Params[0])
+	s.propagate(l, m.String())
+}
+
+// linkSquit handles SQUIT from a linked server. It either reports that a
+// server behind the link split, asks us to drop one of our links, or has to
+// be passed on towards the server it names.
+func (s *Server) linkSquit(l *Client, m *Message) {
+	if len(m.Params) < 1 {
+		return
+	}
+	name, reason := m.Params[0], "Remote SQUIT"
+	if len(m.Params) > 1 {
+		reason = m.Params[1]
+	}
+	s.mu.Lock()
+	if strings.EqualFold(name, s.cfg.Load().ServerName) {
+		s.mu.Unlock()
+		s.quit(l, reason)
+		return
+	}
+	srv := s.servers[strings.ToLower(name)]
+	s.mu.Unlock()
+	switch {
+	case srv == nil:
+	case srv.via == l:
+		s.netsplit(srv, reason)
+		s.propagate(l, m.String())
+	case srv.via.peer == srv:
+		s.quit(srv.via, reason)
+	default:
+		srv.via.sendLink(m.String())
+	}
+}
+
+// netsplit removes srv, the servers behind it and all their users. Local
+// users see the departed users quit with the names of the two servers
+// that split as the reason.
+func (s *Server) netsplit(srv *linkedServer, reason string) {
+	s.mu.Lock()
+	lost := map[*linkedServer]bool{srv: true}
+	for changed := true; changed; {
+		changed = false
+		for _, other := range s.servers {
+			if !lost[other] && lost[s.servers[strings.ToLower(other.uplink)]] {
+				lost[other] = true
+				changed = true
+			}
+		}
+	}
+	var users []*Client
+	for _, u := range s.uids {
+		if lost[u.server] {
+			users = append(users, u)
+		}
+	}
+	for other := range lost {
+		delete(s.servers, strings.ToLower(other.name))
+	}
+	s.mu.Unlock()
+	s.logWarn(EventLink, Fields{"server": srv.name, "lost": len(lost), "reason": reason}, "Netsplit: lost %s and %d servers behind it (%s)", srv.name, len(lost)-1, reason)
+	s.removeUsers(users, srv.uplink+" "+srv.name)
+}
+
+// linkClosed handles the loss of a server link.
+func (s *Server) linkClosed(l *Client, reason string) {
+	s.mu.Lock()
+	delete(s.clients, l.Conn)
+	delete(s.links, l)
+	_, known := s.servers[strings.ToLower(l.peer.name)]
+	s.mu.Unlock()
+	if known {
+		s.netsplit(l.peer, reason)
+	}
+	s.propagate(l, fmt.Sprintf(":%s SQUIT %s :%s", s.sid, l.peer.name, reason))
+}
+
+// handleLinks lists the servers of the network to operators.
+func (s *Server) handleLinks(c *Client) {
+	s.mu.Lock()
+	ours := s.cfg.Load().ServerName
+	servers := make([]linkedServer, 0, len(s.servers))
+	for _, srv := range s.servers {
+		servers = append(servers, *srv)
+	}
+	s.mu.Unlock()
+	sort.Slice(servers, func(i, j int) bool { return servers[i].name < servers[j].name })
+	s.numeric(c, rplLinks, ours, ours, "0 "+serverDescription)
+	for _, srv := range servers {
+		s.numeric(c, rplLinks, srv.name, srv.uplink, fmt.Sprintf("%d %s", srv.hops, srv.desc))
+	}
+	s.numeric(c, rplEndOfLinks, "*", "End of /LINKS list")
+}
+
+// handleConnect lets operators link with a server listed in the
+// configuration.
+func (s *Server) handleConnect(c *Client, params []string) {
+	s.mu.Lock()
+	lc, ok := s.linkConfig(params[0])
+	linked := s.servers[strings.ToLower(params[0])] != nil
+	server := s.cfg.Load().ServerName
+	s.mu.Unlock()
+	if !ok {
+		s.numeric(c, errNoSuchServer, params[0], "No such server")
+		return
+	}
+	if linked {
+		c.reply(fmt.Sprintf(":%s NOTICE %s :%s is already linked", server, c.nickname(), lc.Name))
+		return
+	}
+	if err := s.Connect(lc.Name); err != nil {
+		c.reply(fmt.Sprintf(":%s NOTICE %s :Connect to %s failed: %v", server, c.nickname(), lc.Name, err))
+		return
+	}
+	s.logInfo(EventOper, Fields{"nick": c.nickname(), "server": lc.Name}, "%s connected to %s", c.nickname(), lc.Name)
+	c.reply(fmt.Sprintf(":%s NOTICE %s :Connecting to %s", server, c.nickname(), lc.Name))
+}
+
+// handleSquit lets operators split a server from the network.
+func (s *Server) handleSquit(c *Client, params []string) {
+	reason := "SQUIT by " + c.nickname()
+	if len(params) > 1 && params[1] != "" {
+		reason = params[1]
+	}
+	s.mu.Lock()
+	srv := s.servers[strings.ToLower(params[0])]
+	s.mu.Unlock()
+	switch {
+	case srv == nil:
+		s.numeric(c, errNoSuchServer, params[0], "No such server")
+	case srv.via.peer == srv:
+		s.logInfo(EventOper, Fields{"nick": c.nickname(), "server": srv.name, "reason": reason}, "%s split %s: %s", c.nickname(), srv.name, reason)
+		s.quit(srv.via, reason)
+	default:
+		s.logInfo(EventOper, Fields{"nick": c.nickname(), "server": srv.name, "reason": reason}, "%s split %s: %s", c.nickname(), srv.name, reason)
+		srv.via.sendLink(fmt.Sprintf(":%s SQUIT %s :%s", s.sid, srv.name, reason))
+	}
+}
+
+// Connect links the server with the server called name from the
+// configuration. The handshake continues in the background.
+func (s *Server) Connect(name string) error {
+	s.mu.Lock()
+	lc, ok := s.linkConfig(name)
+	ourName := s.cfg.Load().ServerName
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("irc: no link configured for %s", name)
+	}
+	conn, err := net.DialTimeout("tcp", lc.Address, linkDialTimeout)
+	if err != nil {
+		return err
+	}
+	c := s.newClient(conn)
+	c.linkTo = lc.Name
+	c.sendLink("PASS " + lc.Password)
+	c.sendLink(fmt.Sprintf("SERVER %s %s :%s", ourName, s.sid, serverDescription))
+	go s.serve(c)
+	return nil
+}
@@ -0,0 +1,185 @@
+package irc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startLinked starts a server called name that accepts links from any of
+// the names in peers.
+func startLinked(t *testing.T, name string, peers ...string) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ServerName = name
+	cfg.Opers = []OperConfig{{Name: "admin", Password: "secret"}}
+	for _, p := range peers {
+		cfg.Links = append(cfg.Links, LinkConfig{Name: p, Password: "linkpw"})
+	}
+	return startServer(t, cfg)
+}
+
+// waitFor polls s until cond, called with s.mu held, reports true.
+func waitFor(t *testing.T, s *Server, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		ok := cond()
+		s.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: timed out waiting for %s", s.config().ServerName, what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitNick waits until s knows a user called nick.
+func waitNick(t *testing.T, s *Server, nick string) {
+	t.Helper()
+	waitFor(t, s, nick, func() bool { return s.nicks.get(s.fold(nick)) != nil })
+}
+
+// link connects a to b and waits until both know each other.
+func link(t *testing.T, a, b *Server) {
+	t.Helper()
+	name := b.config().ServerName
+	cfg := a.config()
+	cfg.Links = append(cfg.Links[:len(cfg.Links):len(cfg.Links)], LinkConfig{Name: name, Address: b.Addr, Password: "linkpw"})
+	a.cfg.Store(&cfg)
+	if err := a.Connect(name); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, a, name, func() bool { return a.servers[name] != nil })
+	ours := a.config().ServerName
+	waitFor(t, b, ours, func() bool { return b.servers[ours] != nil })
+}
+
+func TestLinkedServersShareUsersAndChannels(t *testing.T) {
+	a := startLinked(t, "a.test")
+	b := startLinked(t, "b.test", "a.test")
+	alice := login(t, a, "alice")
+	alice.Join("#room")
+	readUntil(t, alice, "JOIN #room")
+
+	link(t, a, b)
+	waitNick(t, b, "alice")
+	bob := login(t, b, "bob")
+	waitNick(t, a, "bob")
+	bob.Join("#room")
+	readUntil(t, bob, " 353 bob = #room :")
+	readUntil(t, alice, ":bob JOIN #room")
+
+	alice.Msg("#room", "hello from a")
+	readUntil(t, bob, ":alice PRIVMSG #room :hello from a")
+	bob.Msg("alice", "hi there")
+	readUntil(t, alice, ":bob PRIVMSG alice :hi there")
+
+	alice.Send("WHOIS bob")
+	readUntil(t, alice, " 312 alice bob b.test ")
+	bob.Send("NICK robert")
+	readUntil(t, alice, ":bob NICK robert")
+	bob.Send("QUIT :bye")
+	readUntil(t, alice, ":robert QUIT :Quit: bye")
+}
+
+func TestLinkNickCollisionRenamesNewerUser(t *testing.T) {
+	a := startLinked(t, "a.test")
+	b := startLinked(t, "b.test", "a.test")
+	first := login(t, a, "nick")
+	time.Sleep(1100 * time.Millisecond)
+	second := login(t, b, "nick")
+
+	link(t, a, b)
+	line := readUntil(t, second, ":nick NICK ")
+	fields := strings.Fields(line)
+	uid := strings.TrimPrefix(fields[len(fields)-1], ":")
+	if !strings.HasPrefix(uid, b.sid) {
+		t.Fatalf("newer user renamed to %q, want a UID of %s", uid, b.sid)
+	}
+	waitNick(t, a, uid)
+	first.Msg(uid, "you lost")
+	readUntil(t, second, ":nick PRIVMSG "+uid+" :you lost")
+}
+
+func TestSquitSplitsNetwork(t *testing.T) {
+	a := startLinked(t, "a.test")
+	b := startLinked(t, "b.test", "a.test")
+	c := startLinked(t, "c.test", "b.test")
+	link(t, a, b)
+	link(t, b, c)
+	carol := login(t, c, "carol")
+	carol.Join("#room")
+	readUntil(t, carol, "JOIN #room")
+	waitNick(t, a, "carol")
+
+	oper := login(t, a, "admin")
+	oper.Send("OPER admin secret")
+	readUntil(t, oper, " 381 ")
+	oper.Join("#room")
+	readUntil(t, oper, " 366 admin #room ")
+	oper.Send("LINKS")
+	readUntil(t, oper, " 364 admin a.test a.test :0 ")
+	readUntil(t, oper, " 364 admin b.test a.test :1 ")
+	readUntil(t, oper, " 364 admin c.test b.test :2 ")
+	readUntil(t, oper, " 365 admin ")
+
+	oper.Send("SQUIT c.test :maintenance")
+	readUntil(t, oper, ":carol QUIT :b.test c.test")
+	waitFor(t, a, "split", func() bool { return len(a.servers) == 1 })
+	oper.Send("SQUIT nowhere.test")
+	readUntil(t, oper, " 402 admin nowhere.test ")
+}
+
+// fakeLink links a server called name to s over a pipe and returns our end
+// of it, which is never read.
+func fakeLink(t *testing.T, s *Server, name, sid string) net.Conn {
+	t.Helper()
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() { ours.Close() })
+	go s.handleConn(theirs)
+	fmt.Fprintf(ours, "PASS linkpw\r\nSERVER %s %s :fake\r\n", name, sid)
+	waitFor(t, s, name, func() bool { return s.servers[name] != nil })
+	return ours
+}
+
+// TestLinkBurstDoesNotBlock checks that a link whose peer does not read,
+// such as one busy sending its own burst, holds up neither the burst nor
+// the rest of the server.
+func TestLinkBurstDoesNotBlock(t *testing.T) {
+	b := startLinked(t, "b.test", "x.test")
+	for i := 0; i < 200; i++ {
+		bot, err := b.NewBot(fmt.Sprintf("bot%d", i), strings.Repeat("r", 200), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bot.Join(fmt.Sprintf("#chan%d", i))
+	}
+	fakeLink(t, b, "x.test", "9XX")
+	alice := login(t, b, "alice")
+	alice.Join("#chan0")
+	readUntil(t, alice, " 366 alice #chan0 ")
+}
+
+// TestLinkRejectsForeignUID checks that a link cannot introduce users of a
+// server that lies behind another link.
+func TestLinkRejectsForeignUID(t *testing.T) {
+	a := startLinked(t, "a.test")
+	b := startLinked(t, "b.test", "a.test", "x.test")
+	link(t, a, b)
+	x := fakeLink(t, b, "x.test", "9XX")
+	fmt.Fprintf(x, ":%s UID spoof 1 %sAAAAAA u h + * :spoofed\r\n", a.sid, a.sid)
+	fmt.Fprintf(x, ":9XX UID real 1 9XXAAAAAA u h + * :real\r\n")
+	waitNick(t, b, "real")
+	b.mu.Lock()
+	spoofed := b.nicks.get("spoof")
+	b.mu.Unlock()
+	if spoofed != nil {
+		t.Errorf("user of a.test introduced through x.test")
+	}
+}
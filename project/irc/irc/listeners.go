@@ -0,0 +1,134 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listener is a listener from Config.Listeners with its parsed settings.
+type listener struct {
+	net.Listener
+	cfg ListenerConfig
+	// proxyFrom holds the sources that must send a PROXY header, nil when
+	// every source must.
+	proxyFrom []*net.IPNet
+}
+
+// listen opens the listener described by lc. A socket file left behind by
+// a previous run is removed first.
+func listen(lc ListenerConfig) (*listener, error) {
+	l := &listener{cfg: lc}
+	if lc.Proxy {
+		nets, err := parseCIDRs(lc.ProxyFrom)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", lc.Addr, err)
+		}
+		l.proxyFrom = nets
+	}
+	switch lc.Network {
+	case "tcp":
+	case "unix":
+		if fi, err := os.Lstat(lc.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(lc.Addr)
+		}
+	default:
+		return nil, fmt.Errorf("listener %s: unknown network %q", lc.Addr, lc.Network)
+	}
+	ln, err := net.Listen(lc.Network, lc.Addr)
+	if err != nil {
+		return nil, err
+	}
+	l.Listener = ln
+	return l, nil
+}
+
+// listenAll opens the configured listeners, closing them all if one fails.
+func (s *Server) listenAll() error {
+	for _, lc := range s.config().Listeners {
+		l, err := listen(lc)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		s.listeners = append(s.listeners, l)
+		s.ListenerAddrs = append(s.ListenerAddrs, l.Addr().String())
+		s.logInfo(EventServer, Fields{"network": lc.Network, "addr": l.Addr().String()}, "IRC server listening on %s %s", lc.Network, l.Addr())
+	}
+	return nil
+}
+
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+// accept serves the connections arriving on ln until it is closed. l is
+// nil for the main listener.
+func (s *Server) accept(ln net.Listener, l *listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			s.logError(EventServer, Fields{"error": err.Error()}, "accept error: %v", err)
+			continue
+		}
+		s.logInfo(EventConnect, Fields{"remote": conn.RemoteAddr().String()}, "Client connected: %s", conn.RemoteAddr())
+		if l != nil && l.cfg.Proxy && l.mustProxy(conn.RemoteAddr()) {
+			go s.handleProxied(conn)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// mustProxy reports whether a connection from addr has to start with a
+// PROXY header.
+func (l *listener) mustProxy(addr net.Addr) bool {
+	if l.proxyFrom == nil {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && ipInNets(tcp.IP, l.proxyFrom)
+}
+
+// parseCIDRs parses a list of CIDR ranges. Plain addresses stand for
+// themselves.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ipInNets reports whether ip lies in one of nets.
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package irc
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ic "vibes/client"
+)
+
+// dialListener connects to the n-th configured listener of s and writes
+// header before anything else.
+func dialListener(t *testing.T, s *Server, n int, header []byte) *ic.Client {
+	t.Helper()
+	conn, err := net.Dial(s.config().Listeners[n].Network, s.ListenerAddrs[n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if len(header) > 0 {
+		if _, err := conn.Write(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ic.NewClient(conn)
+}
+
+// registeredHost registers c as nick and returns the host the server
+// recorded for it.
+func registeredHost(t *testing.T, c *ic.Client, nick string) string {
+	t.Helper()
+	c.Login(nick)
+	readUntil(t, c, " 001 "+nick+" ")
+	c.Send("WHOIS " + nick)
+	m, err := ParseMessage(strings.TrimRight(readUntil(t, c, " 311 "+nick+" "), "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Params[3]
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Listeners = []ListenerConfig{{Network: "unix", Addr: filepath.Join(t.TempDir(), "irc.sock")}}
+	s := startServer(t, cfg)
+
+	bot := dialListener(t, s, 0, nil)
+	if host := registeredHost(t, bot, "bot"); host != "localhost" {
+		t.Errorf("unix socket client has host %q, want localhost", host)
+	}
+	alice := login(t, s, "alice")
+	alice.Msg("bot", "hello over the socket")
+	readUntil(t, bot, ":alice PRIVMSG bot :hello over the socket")
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Listeners = []ListenerConfig{
+		{Network: "tcp", Addr: "127.0.0.1:0", Proxy: true},
+		{Network: "tcp", Addr: "127.0.0.1:0", Proxy: true, ProxyFrom: []string{"192.0.2.0/24", "198.51.100.1"}},
+	}
+	s := startServer(t, cfg)
+
+	v1 := dialListener(t, s, 0, []byte("PROXY TCP4 203.0.113.7 127.0.0.1 40000 6667\r\n"))
+	if host := registeredHost(t, v1, "one"); host != "203.0.113.7" {
+		t.Errorf("PROXY v1 client has host %q", host)
+	}
+
+	v2 := append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12)
+	v2 = append(v2, 203, 0, 113, 8, 127, 0, 0, 1)
+	v2 = binary.BigEndian.AppendUint16(v2, 40001)
+	v2 = binary.BigEndian.AppendUint16(v2, 6667)
+	if host := registeredHost(t, dialListener(t, s, 0, v2), "two"); host != "203.0.113.8" {
+		t.Errorf("PROXY v2 client has host %q", host)
+	}
+
+	missing := dialListener(t, s, 0, nil)
+	missing.Login("three")
+	if line, err := missing.ReadLine(); err == nil {
+		t.Errorf("connection without PROXY header answered with %q", line)
+	}
+
+	direct := dialListener(t, s, 1, nil)
+	if host := registeredHost(t, direct, "four"); host != "127.0.0.1" {
+		t.Errorf("untrusted source has host %q, want its own address", host)
+	}
+}
@@ -0,0 +1,222 @@
+package irc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event log
+//
+// A server reports what happens to it as events: a type such as join or
+// quit, a level, a message for people and fields for programs. Events
+// below Config.Log.Level are dropped and the rest go to the LogSink given
+// to SetLogSink, by default JSON lines on standard error. Every server has
+// its own sink, so programs and tests running several servers can tell
+// their events apart.
+
+// LogLevel is the severity of an event.
+type LogLevel int
+
+// Log levels, from the most verbose.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// parseLogLevel parses a level name as used in Config.Log.Level.
+func parseLogLevel(name string) (LogLevel, bool) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return LogLevel(i), true
+		}
+	}
+	return LevelInfo, false
+}
+
+// EventType names what an event is about.
+type EventType string
+
+// Event types.
+const (
+	// EventServer covers the server itself: listeners, configuration and
+	// storage.
+	EventServer     EventType = "server"
+	EventConnect    EventType = "connect"
+	EventDisconnect EventType = "disconnect"
+	EventRegister   EventType = "register"
+	EventLogin      EventType = "login"
+	EventNick       EventType = "nick"
+	EventJoin       EventType = "join"
+	EventPart       EventType = "part"
+	EventQuit       EventType = "quit"
+	EventKick       EventType = "kick"
+	EventTopic      EventType = "topic"
+	EventMode       EventType = "mode"
+	// EventOper covers operator actions: OPER itself, bans, kills,
+	// CONNECT and SQUIT.
+	EventOper    EventType = "oper"
+	EventFilter  EventType = "filter"
+	EventGateway EventType = "gateway"
+	EventLink    EventType = "link"
+)
+
+// Fields holds the structured data of an event.
+type Fields map[string]any
+
+// Event is one entry of the event log.
+type Event struct {
+	Time    time.Time
+	Level   LogLevel
+	Type    EventType
+	Message string
+	Fields  Fields
+}
+
+// MarshalJSON encodes e as a flat object: time, level, event and msg
+// followed by the fields in alphabetical order.
+func (e Event) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `{"time":%q,"level":%q,"event":%q,"msg":`,
+		e.Time.UTC().Format(time.RFC3339Nano), e.Level.String(), string(e.Type))
+	msg, err := json.Marshal(e.Message)
+	if err != nil {
+		return nil, err
+	}
+	b.Write(msg)
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		switch k {
+		case "time", "level", "event", "msg":
+		default:
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := json.Marshal(e.Fields[k])
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(e.Fields[k]))
+		}
+		key, _ := json.Marshal(k)
+		b.WriteByte(',')
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// LogSink receives the events of a server. Log may be called from many
+// goroutines at once, sometimes while the server holds its lock, so it must
+// not call back into the server.
+type LogSink interface {
+	Log(e Event)
+}
+
+// LogSinkFunc adapts a function to LogSink.
+type LogSinkFunc func(e Event)
+
+// Log calls f(e).
+func (f LogSinkFunc) Log(e Event) { f(e) }
+
+type jsonSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSink returns a sink writing each event to w as a line of JSON.
+func NewJSONSink(w io.Writer) LogSink {
+	return &jsonSink{w: w}
+}
+
+func (j *jsonSink) Log(e Event) {
+	data, err := e.MarshalJSON()
+	if err != nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.w.Write(append(data, '\n'))
+}
+
+// defaultSink is used by servers without a sink of their own.
+var defaultSink = NewJSONSink(os.Stderr)
+
+// SetLogSink sends the events of s to sink, or to standard error when sink
+// is nil.
+func (s *Server) SetLogSink(sink LogSink) {
+	if sink == nil {
+		sink = defaultSink
+	}
+	s.logSink.Store(&sink)
+}
+
+// setLogLevel drops events below the level called name from now on.
+func (s *Server) setLogLevel(name string) {
+	level, _ := parseLogLevel(name)
+	s.logLevel.Store(int32(level))
+}
+
+// logEvent sends an event to the sink of s if level is high enough.
+func (s *Server) logEvent(level LogLevel, typ EventType, fields Fields, format string, args ...any) {
+	if level < LogLevel(s.logLevel.Load()) {
+		return
+	}
+	sink := defaultSink
+	if p := s.logSink.Load(); p != nil {
+		sink = *p
+	}
+	sink.Log(Event{Time: time.Now(), Level: level, Type: typ, Message: fmt.Sprintf(format, args...), Fields: fields})
+}
+
+func (s *Server) logDebug(typ EventType, fields Fields, format string, args ...any) {
+	s.logEvent(LevelDebug, typ, fields, format, args...)
+}
+
+func (s *Server) logInfo(typ EventType, fields Fields, format string, args ...any) {
+	s.logEvent(LevelInfo, typ, fields, format, args...)
+}
+
+func (s *Server) logWarn(typ EventType, fields Fields, format string, args ...any) {
+	s.logEvent(LevelWarn, typ, fields, format, args...)
+}
+
+func (s *Server) logError(typ EventType, fields Fields, format string, args ...any) {
+	s.logEvent(LevelError, typ, fields, format, args...)
+}
+
+// httpErrorLog returns a logger for the HTTP server called name that turns
+// its messages into error events.
+func (s *Server) httpErrorLog(name string) *log.Logger {
+	return log.New(httpLogWriter{s, name}, "", 0)
+}
+
+type httpLogWriter struct {
+	s    *Server
+	name string
+}
+
+func (w httpLogWriter) Write(p []byte) (int, error) {
+	w.s.logError(EventServer, Fields{"listener": w.name}, "%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
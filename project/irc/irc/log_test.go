@@ -0,0 +1,117 @@
+package irc
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventMarshalJSON(t *testing.T) {
+	e := Event{
+		Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Level:   LevelWarn,
+		Type:    EventJoin,
+		Message: `alice joined "#chat"`,
+		Fields:  Fields{"nick": "alice", "channel": "#chat", "msg": "ignored", "count": 2},
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"time":"2024-05-01T12:00:00Z","level":"warn","event":"join","msg":"alice joined \"#chat\"","channel":"#chat","count":2,"nick":"alice"}`
+	if string(data) != want {
+		t.Errorf("got  %s\nwant %s", data, want)
+	}
+}
+
+// eventRecorder is a LogSink keeping the events it receives.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Log(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// find returns the first recorded event of type typ whose fields include
+// want.
+func (r *eventRecorder) find(typ EventType, want Fields) (Event, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+next:
+	for _, e := range r.events {
+		if e.Type != typ {
+			continue
+		}
+		for k, v := range want {
+			if e.Fields[k] != v {
+				continue next
+			}
+		}
+		return e, true
+	}
+	return Event{}, false
+}
+
+func TestServerEvents(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Log.Level = "warn"
+	s := startServer(t, cfg)
+	rec := &eventRecorder{}
+	s.SetLogSink(rec)
+
+	alice := login(t, s, "alice")
+	alice.Send("OPER admin wrong")
+	readUntil(t, alice, " 464 ")
+	if _, ok := rec.find(EventOper, Fields{"nick": "alice", "oper": "admin"}); !ok {
+		t.Error("failed OPER not logged")
+	}
+	if _, ok := rec.find(EventRegister, nil); ok {
+		t.Error("info event logged at level warn")
+	}
+
+	cfg.Log.Level = "info"
+	s.Rehash(cfg)
+	alice.Join("#chat")
+	readUntil(t, alice, " 366 ")
+	alice.Send("NICK alicia")
+	readUntil(t, alice, "NICK alicia")
+	for _, want := range []struct {
+		typ    EventType
+		fields Fields
+	}{
+		{EventJoin, Fields{"nick": "alice", "channel": "#chat"}},
+		{EventNick, Fields{"old": "alice", "nick": "alicia"}},
+	} {
+		e, ok := rec.find(want.typ, want.fields)
+		if !ok {
+			t.Errorf("no %s event with %v", want.typ, want.fields)
+			continue
+		}
+		if e.Level != LevelInfo || e.Message == "" {
+			t.Errorf("%s event = %+v", want.typ, e)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]LogLevel{"debug": LevelDebug, "WARN": LevelWarn, "error": LevelError} {
+		if got, ok := parseLogLevel(name); !ok || got != want {
+			t.Errorf("parseLogLevel(%q) = %v, %v", name, got, ok)
+		}
+	}
+	if _, ok := parseLogLevel("loud"); ok {
+		t.Error("unknown level accepted")
+	}
+	if cfg := (Config{Log: LogConfig{Level: "loud"}}).withDefaults(); cfg.Log.Level != "info" {
+		t.Errorf("unknown level defaults to %q", cfg.Log.Level)
+	}
+	if !strings.Contains(LogLevel(7).String(), "7") {
+		t.Error("unnamed level")
+	}
+}
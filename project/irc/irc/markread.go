@@ -0,0 +1,111 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// readMarkerCap is the capability enabling MARKREAD.
+const readMarkerCap = "draft/read-marker"
+
+// readMarkerParam formats a read marker as a MARKREAD parameter.
+func readMarkerParam(t time.Time) string {
+	if t.IsZero() {
+		return "*"
+	}
+	return "timestamp=" + t.UTC().Format(serverTimeFormat)
+}
+
+// handleMarkRead implements the draft/read-marker MARKREAD command. Read
+// markers belong to accounts and only move forward; every change is sent to
+// all connections logged in to the account.
+func (s *Server) handleMarkRead(c *Client, params []string) {
+	if len(params) == 0 || params[0] == "" {
+		s.fail(c, "MARKREAD", "NEED_MORE_PARAMS", "Missing parameters")
+		return
+	}
+	s.mu.RLock()
+	account := c.account
+	s.mu.RUnlock()
+	if account == "" {
+		s.fail(c, "MARKREAD", "ACCOUNT_REQUIRED", "You must be logged in to use read markers")
+		return
+	}
+	target := params[0]
+	acctKey, key := s.fold(account), s.fold(target)
+	current, err := s.history.ReadMarker(acctKey, key)
+	if err != nil {
+		s.fail(c, "MARKREAD", "INTERNAL_ERROR", target, "Read marker could not be retrieved")
+		return
+	}
+	if len(params) == 1 {
+		s.sendReadMarker([]*Client{c.current()}, target, current)
+		return
+	}
+	ref, ok := parseHistoryRef(params[1], nil, false)
+	if !ok || !strings.HasPrefix(params[1], "timestamp=") {
+		s.fail(c, "MARKREAD", "INVALID_PARAMS", target, params[1], "Invalid timestamp")
+		return
+	}
+	if !ref.time.After(current) {
+		s.sendReadMarker([]*Client{c.current()}, target, current)
+		return
+	}
+	if err := s.history.SetReadMarker(acctKey, key, ref.time); err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "read marker update failed: %v", err)
+		s.fail(c, "MARKREAD", "INTERNAL_ERROR", target, "Read marker could not be saved")
+		return
+	}
+	s.sendReadMarker(s.accountConnections(account), target, ref.time)
+}
+
+// accountConnections returns the registered connections logged in to
+// account.
+func (s *Server) accountConnections(account string) []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.fold(account)
+	var conns []*Client
+	for _, conn := range s.clients {
+		if conn.registered && conn.account != "" && s.fold(conn.account) == key {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// sendReadMarker sends the read marker for target to the connections among
+// conns that negotiated the read-marker capability.
+func (s *Server) sendReadMarker(conns []*Client, target string, t time.Time) {
+	server := s.config().ServerName
+	line := fmt.Sprintf(":%s MARKREAD %s %s", server, target, readMarkerParam(t))
+	s.mu.Lock()
+	var recips []*Client
+	for _, conn := range conns {
+		if conn.hasCap(readMarkerCap) {
+			recips = append(recips, conn)
+		}
+	}
+	s.mu.Unlock()
+	for _, conn := range recips {
+		conn.send(line)
+	}
+}
+
+// joinReadMarker sends the read marker of a channel just joined by c to its
+// connections, as required before the end of NAMES.
+func (s *Server) joinReadMarker(c *Client, conns []*Client, channel string) {
+	s.mu.RLock()
+	account := c.account
+	s.mu.RUnlock()
+	if account == "" {
+		return
+	}
+	t, err := s.history.ReadMarker(s.fold(account), s.fold(channel))
+	if err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "read marker lookup failed: %v", err)
+		return
+	}
+	s.sendReadMarker(conns, channel, t)
+}
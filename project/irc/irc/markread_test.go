@@ -0,0 +1,33 @@
+package irc
+
+import "testing"
+
+func TestMarkReadSyncsAccountConnections(t *testing.T) {
+	s := startServer(t, accountConfig(AccountConfig{Name: "alice", Password: "secret"}))
+	laptop := loginAccount(t, s, "alice", "alice", "secret")
+	phone := loginAccount(t, s, "alice2", "alice", "secret")
+	laptop.Send("CAP REQ :draft/read-marker")
+	readUntil(t, laptop, "ACK")
+	phone.Send("CAP REQ :draft/read-marker")
+	readUntil(t, phone, "ACK")
+
+	laptop.Join("#room")
+	readUntil(t, laptop, "MARKREAD #room *")
+	readUntil(t, laptop, " 366 alice #room ")
+
+	laptop.Send("MARKREAD #room timestamp=2024-01-01T12:00:00.000Z")
+	readUntil(t, laptop, "MARKREAD #room timestamp=2024-01-01T12:00:00.000Z")
+	readUntil(t, phone, "MARKREAD #room timestamp=2024-01-01T12:00:00.000Z")
+
+	// Markers never move backwards.
+	phone.Send("MARKREAD #room timestamp=2023-01-01T12:00:00.000Z")
+	readUntil(t, phone, "MARKREAD #room timestamp=2024-01-01T12:00:00.000Z")
+	phone.Send("MARKREAD #ROOM")
+	readUntil(t, phone, "MARKREAD #ROOM timestamp=2024-01-01T12:00:00.000Z")
+	phone.Send("MARKREAD #room bogus")
+	readUntil(t, phone, "FAIL MARKREAD INVALID_PARAMS #room bogus ")
+
+	bob := login(t, s, "bob")
+	bob.Send("MARKREAD #room")
+	readUntil(t, bob, "FAIL MARKREAD ACCOUNT_REQUIRED ")
+}
@@ -0,0 +1,87 @@
+package irc
+
+import (
+	"fmt"
+	"time"
+)
+
+// queueMemo keeps a PRIVMSG sent to the offline account called nick until
+// the account logs in. It reports false if nick is not an account, or if the
+// account is online. The sender is told what happened with a NOTICE.
+func (s *Server) queueMemo(c *Client, nick string, item HistoryItem) bool {
+	server := s.config().ServerName
+	s.mu.Lock()
+	acct, ok := s.account(nick)
+	if !ok || s.nicks.get(s.fold(nick)) != nil || s.accountOnline(acct.Name) {
+		s.mu.Unlock()
+		return false
+	}
+	cfg := s.cfg.Load().Memos
+	key := s.fold(acct.Name)
+	historyKey := dmHistoryKey(s.dmSide(c), key)
+	pending := s.liveMemos(key, time.Now())
+	full := len(pending) >= cfg.MaxPerUser
+	if !full {
+		pending = append(pending, item)
+	}
+	s.memos[key] = pending
+	s.mu.Unlock()
+
+	if full {
+		c.reply(fmt.Sprintf(":%s NOTICE %s :%s has too many messages waiting; yours was not stored", server, c.nickname(), nick))
+		return true
+	}
+	s.storeHistory(historyKey, item)
+	c.reply(fmt.Sprintf(":%s NOTICE %s :%s is offline; your message will be delivered when they next log in", server, c.nickname(), nick))
+	return true
+}
+
+// accountOnline reports whether a registered connection is logged in to
+// account. The caller must hold s.mu.
+func (s *Server) accountOnline(account string) bool {
+	key := s.fold(account)
+	for _, conn := range s.clients {
+		if conn.registered && conn.account != "" && s.fold(conn.account) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// liveMemos returns the memos waiting for the account key, dropping those
+// older than the configured expiry. The caller must hold s.mu.
+func (s *Server) liveMemos(key string, now time.Time) []HistoryItem {
+	expiry := time.Duration(s.cfg.Load().Memos.Expiry)
+	var live []HistoryItem
+	for _, m := range s.memos[key] {
+		if now.Sub(m.Time) < expiry {
+			live = append(live, m)
+		}
+	}
+	if len(live) == 0 {
+		delete(s.memos, key)
+	}
+	return live
+}
+
+// deliverMemos sends the memos waiting for the account c logged in to,
+// in the same way history is replayed.
+func (s *Server) deliverMemos(c *Client) {
+	s.mu.Lock()
+	if c.account == "" {
+		s.mu.Unlock()
+		return
+	}
+	key := s.fold(c.account)
+	pending := s.liveMemos(key, time.Now())
+	delete(s.memos, key)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	for i := range pending {
+		pending[i].Target = c.nick()
+	}
+	s.logInfo(EventLogin, Fields{"nick": c.nick(), "count": len(pending)}, "Delivering %d offline messages to %s", len(pending), c.nick())
+	s.sendHistory(c, c.nick(), pending)
+}
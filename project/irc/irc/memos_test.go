@@ -0,0 +1,48 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOfflineMessagesDeliveredOnLogin(t *testing.T) {
+	cfg := accountConfig(AccountConfig{Name: "bob", Password: "secret"})
+	cfg.Memos.MaxPerUser = 1
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+
+	alice.Msg("bob", "call me")
+	readUntil(t, alice, "NOTICE alice :bob is offline")
+	alice.Msg("bob", "please")
+	readUntil(t, alice, "NOTICE alice :bob has too many messages waiting")
+	alice.Msg("nobody", "hi")
+	readUntil(t, alice, " 401 alice nobody ")
+
+	bob := loginAccount(t, s, "bobby", "bob", "secret")
+	readUntil(t, bob, ":alice PRIVMSG bobby :call me")
+	alice.Msg("bob", "again")
+	readUntil(t, alice, " 401 alice bob ")
+}
+
+func TestOfflineMessagesExpire(t *testing.T) {
+	cfg := accountConfig(AccountConfig{Name: "bob", Password: "secret"})
+	cfg.Memos.Expiry = Duration(time.Millisecond)
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	alice.Msg("bob", "too late")
+	readUntil(t, alice, "NOTICE alice :bob is offline")
+	time.Sleep(10 * time.Millisecond)
+
+	bob := loginAccount(t, s, "bob", "bob", "secret")
+	bob.Send("PING :sync")
+	for {
+		line := readUntil(t, bob, " ")
+		if strings.Contains(line, "PRIVMSG") {
+			t.Fatalf("expired message delivered: %q", line)
+		}
+		if strings.Contains(line, "PONG") {
+			return
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package irc
+
+import (
+	"bufio"
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxLineLen is the size of a protocol line excluding message tags,
+	// counting the trailing CRLF.
+	maxLineLen = 512
+	// maxTagsLen is the size of the tag section of a line, counting the
+	// leading '@' and the space that separates it from the rest.
+	maxTagsLen = 8191
+)
+
+var (
+	// ErrInputTooLong is returned for lines exceeding maxLineLen or
+	// maxTagsLen.
+	ErrInputTooLong = errors.New("irc: input line too long")
+	// ErrInvalidMessage is returned for lines containing NUL, CR or LF
+	// or lacking a command.
+	ErrInvalidMessage = errors.New("irc: invalid message")
+)
+
+// UTF-8 policies selectable with Config.UTF8Policy.
+const (
+	// UTF8Allow passes invalid UTF-8 through untouched.
+	UTF8Allow = "allow"
+	// UTF8Replace replaces invalid sequences with U+FFFD.
+	UTF8Replace = "replace"
+	// UTF8Reject drops messages containing invalid UTF-8.
+	UTF8Reject = "reject"
+)
+
+// Message is a parsed IRC protocol line.
+type Message struct {
+	Tags    map[string]string
+	Source  string
+	Command string
+	Params  []string
+}
+
+// ParseMessage parses a single line without its trailing CRLF. The command
+// is returned in upper case.
+func ParseMessage(line string) (*Message, error) {
+	return parseMessage(line, maxLineLen)
+}
+
+// parseMessage is ParseMessage with maxLen in place of maxLineLen.
+func parseMessage(line string, maxLen int) (*Message, error) {
+	if strings.ContainsAny(line, "\x00\r\n") {
+		return nil, ErrInvalidMessage
+	}
+	m := &Message{}
+	if strings.HasPrefix(line, "@") {
+		end := strings.IndexByte(line, ' ')
+		if end < 0 {
+			return nil, ErrInvalidMessage
+		}
+		if end+1 > maxTagsLen {
+			return nil, ErrInputTooLong
+		}
+		m.Tags = parseTags(line[1:end])
+		line = strings.TrimLeft(line[end:], " ")
+	}
+	if len(line)+2 > maxLen {
+		return nil, ErrInputTooLong
+	}
+	if strings.HasPrefix(line, ":") {
+		end := strings.IndexByte(line, ' ')
+		if end < 0 {
+			return nil, ErrInvalidMessage
+		}
+		m.Source = line[1:end]
+		line = strings.TrimLeft(line[end:], " ")
+	}
+	for line != "" {
+		if strings.HasPrefix(line, ":") && m.Command != "" {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		word := line
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			word, line = line[:i], strings.TrimLeft(line[i:], " ")
+		} else {
+			line = ""
+		}
+		if m.Command == "" {
+			m.Command = strings.ToUpper(word)
+		} else {
+			m.Params = append(m.Params, word)
+		}
+	}
+	if m.Command == "" {
+		return nil, ErrInvalidMessage
+	}
+	return m, nil
+}
+
+// String formats m as a protocol line without the trailing CRLF.
+func (m *Message) String() string {
+	var b strings.Builder
+	b.WriteString(formatTags(m.Tags))
+	if m.Source != "" {
+		b.WriteByte(':')
+		b.WriteString(m.Source)
+		b.WriteByte(' ')
+	}
+	b.WriteString(m.Command)
+	for i, p := range m.Params {
+		b.WriteByte(' ')
+		if i == len(m.Params)-1 && (p == "" || strings.HasPrefix(p, ":") || strings.ContainsRune(p, ' ')) {
+			b.WriteByte(':')
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
+
+// formatTags formats tags as the "@key=value;... " prefix of a line, or
+// returns the empty string if there are no tags. Keys are sorted so the
+// output is stable.
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteByte('@')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(k)
+		if v := tags[k]; v != "" {
+			b.WriteByte('=')
+			b.WriteString(escapeTagValue(v))
+		}
+	}
+	b.WriteByte(' ')
+	return b.String()
+}
+
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(tag, "=")
+		tags[k] = unescapeTagValue(v)
+	}
+	return tags
+}
+
+var (
+	tagEscaper   = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+	tagUnescaper = strings.NewReplacer(`\\`, `\`, `\:`, ";", `\s`, " ", `\r`, "\r", `\n`, "\n", `\`, "")
+)
+
+func escapeTagValue(v string) string   { return tagEscaper.Replace(v) }
+func unescapeTagValue(v string) string { return tagUnescaper.Replace(v) }
+
+// applyUTF8Policy checks the parameters of m against policy. It reports
+// false if the message must be dropped.
+func applyUTF8Policy(m *Message, policy string) bool {
+	for i, p := range m.Params {
+		if utf8.ValidString(p) {
+			continue
+		}
+		switch policy {
+		case UTF8Reject:
+			return false
+		case UTF8Replace:
+			m.Params[i] = strings.ToValidUTF8(p, "�")
+		}
+	}
+	return true
+}
+
+// readLine reads one line from r without its line ending. Lines that do not
+// fit in the reader's buffer are discarded and reported as ErrInputTooLong.
+func readLine(r *bufio.Reader) (string, error) {
+	buf, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = r.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", ErrInputTooLong
+	}
+	if err != nil && len(buf) == 0 {
+		return "", err
+	}
+	return strings.TrimRight(string(buf), "\r\n"), nil
+}
+
+// truncateLine shortens line so that, without its tags, it fits in
+// maxLineLen once CRLF is appended. It never splits a UTF-8 sequence.
+func truncateLine(line string) string {
+	tags := ""
+	if strings.HasPrefix(line, "@") {
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			tags, line = line[:i+1], line[i+1:]
+		}
+	}
+	limit := maxLineLen - 2
+	if len(line) <= limit {
+		return tags + line
+	}
+	for limit > 0 && !utf8.RuneStart(line[limit]) {
+		limit--
+	}
+	return tags + line[:limit]
+}
@@ -0,0 +1,79 @@
+package irc
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseMessage(t *testing.T) {
+	m, err := ParseMessage(`@+typing=active;msgid=a\sb :alice!a@host privmsg #chan :hello there`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Command != "PRIVMSG" || m.Source != "alice!a@host" {
+		t.Errorf("unexpected command/source: %q %q", m.Command, m.Source)
+	}
+	if len(m.Params) != 2 || m.Params[0] != "#chan" || m.Params[1] != "hello there" {
+		t.Errorf("unexpected params: %q", m.Params)
+	}
+	if m.Tags["+typing"] != "active" || m.Tags["msgid"] != "a b" {
+		t.Errorf("unexpected tags: %v", m.Tags)
+	}
+}
+
+func TestParseMessageLimits(t *testing.T) {
+	long := "PRIVMSG #chan :" + strings.Repeat("a", maxLineLen)
+	if _, err := ParseMessage(long); !errors.Is(err, ErrInputTooLong) {
+		t.Errorf("expected ErrInputTooLong, got %v", err)
+	}
+	tagged := "@+x=" + strings.Repeat("b", 4000) + " PRIVMSG #chan :hi"
+	if _, err := ParseMessage(tagged); err != nil {
+		t.Errorf("tags within budget rejected: %v", err)
+	}
+	tagged = "@+x=" + strings.Repeat("b", maxTagsLen) + " PRIVMSG #chan :hi"
+	if _, err := ParseMessage(tagged); !errors.Is(err, ErrInputTooLong) {
+		t.Errorf("expected ErrInputTooLong for tags, got %v", err)
+	}
+	for _, bad := range []string{"PRIVMSG #chan :a\x00b", "PRIVMSG #chan :a\rb", ":src"} {
+		if _, err := ParseMessage(bad); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("expected ErrInvalidMessage for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestReadLineDiscardsLongLines(t *testing.T) {
+	input := strings.Repeat("x", 100) + "\r\nPING :ok\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(input), 16)
+	if _, err := readLine(r); !errors.Is(err, ErrInputTooLong) {
+		t.Fatalf("expected ErrInputTooLong, got %v", err)
+	}
+	line, err := readLine(r)
+	if err != nil || line != "PING :ok" {
+		t.Errorf("expected next line to survive, got %q %v", line, err)
+	}
+}
+
+func TestApplyUTF8Policy(t *testing.T) {
+	m := &Message{Command: "PRIVMSG", Params: []string{"#chan", "bad\xffbyte"}}
+	if applyUTF8Policy(m, UTF8Reject) {
+		t.Error("reject policy accepted invalid UTF-8")
+	}
+	if !applyUTF8Policy(m, UTF8Replace) || m.Params[1] != "bad�byte" {
+		t.Errorf("replace policy produced %q", m.Params[1])
+	}
+}
+
+func TestTruncateLineKeepsRunes(t *testing.T) {
+	line := "PRIVMSG #chan :" + strings.Repeat("é", maxLineLen)
+	got := truncateLine(line)
+	if len(got) > maxLineLen-2 || !utf8.ValidString(got) {
+		t.Errorf("bad truncation: len %d valid %v", len(got), utf8.ValidString(got))
+	}
+	tagged := "@time=now " + line
+	if got := truncateLine(tagged); !strings.HasPrefix(got, "@time=now ") || len(got) > maxLineLen-2+len("@time=now ") {
+		t.Errorf("tags not preserved: %q", got[:20])
+	}
+}
@@ -0,0 +1,241 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics
+//
+// The server counts commands, traffic, disconnects and write backlogs as it
+// goes, with atomic counters so handling a line never waits for s.mu on
+// their account. When Config.Metrics.Addr is set the counters are served in
+// the Prometheus text format at /metrics. The gauges are the sizes of the
+// server maps, read under a short hold of s.mu when metrics are scraped.
+
+// latencyBuckets are the upper bounds, in seconds, of the command latency
+// histograms.
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// sendQBuckets are the upper bounds, in bytes, of the SendQ histogram.
+var sendQBuckets = []float64{512, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// labelEscaper escapes label values as the Prometheus text format wants.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns v quoted as a label value.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// histogram is a Prometheus histogram safe for concurrent use.
+type histogram struct {
+	bounds []float64
+	// counts holds the observations per bucket, the last one for values
+	// above every bound. They are summed up when written.
+	counts []atomic.Int64
+	count  atomic.Int64
+	sum    atomic.Uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// write writes h as the metric name, with labels added to every sample.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var total int64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%s} %d\n", name, labels, sep, labelValue(le), total)
+	}
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(math.Float64frombits(h.sum.Load()), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count.Load())
+}
+
+// unknownCommand is the name commands the server does not know are counted
+// under, so that clients cannot add metrics by sending made up commands.
+const unknownCommand = "unknown"
+
+// commandLabel returns the name the command cmd sent by c is counted under.
+func (s *Server) commandLabel(c *Client, cmd string) string {
+	if c.peer != nil {
+		if linkCommands[cmd] {
+			return cmd
+		}
+		return unknownCommand
+	}
+	if _, ok := s.commands.lookup(cmd); ok {
+		return cmd
+	}
+	return unknownCommand
+}
+
+// commandStats counts how often a command was received, how many bytes it
+// took and how long handling it took.
+type commandStats struct {
+	count   atomic.Int64
+	bytes   atomic.Int64
+	latency *histogram
+}
+
+// metrics holds the counters of a server.
+type metrics struct {
+	commands    sync.Map // command name -> *commandStats
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	sendQ       *histogram
+	disconnects sync.Map // reason -> *atomic.Int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{sendQ: newHistogram(sendQBuckets)}
+}
+
+// command returns the counters of the command name.
+func (m *metrics) command(name string) *commandStats {
+	if st, ok := m.commands.Load(name); ok {
+		return st.(*commandStats)
+	}
+	st, _ := m.commands.LoadOrStore(name, &commandStats{latency: newHistogram(latencyBuckets)})
+	return st.(*commandStats)
+}
+
+// commandNames returns the names of the commands received so far, sorted.
+func (m *metrics) commandNames() []string {
+	var names []string
+	m.commands.Range(func(name, _ any) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// disconnected counts a connection closed for reason.
+func (m *metrics) disconnected(reason string) {
+	kind := disconnectKind(reason)
+	n, ok := m.disconnects.Load(kind)
+	if !ok {
+		n, _ = m.disconnects.LoadOrStore(kind, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
+}
+
+// disconnectKind sorts a quit reason into the few kinds exported as the
+// reason label, keeping user supplied text out of the metrics.
+func disconnectKind(reason string) string {
+	switch {
+	case reason == "Client Quit" || strings.HasPrefix(reason, "Quit: "):
+		return "quit"
+	case strings.HasPrefix(reason, "Ping timeout"):
+		return "ping_timeout"
+	case reason == "SendQ exceeded":
+		return "sendq"
+	case reason == "Connection closed":
+		return "closed"
+	case reason == "Connection reset by peer":
+		return "reset"
+	case strings.HasPrefix(reason, "Read error"):
+		return "read_error"
+	case strings.HasPrefix(reason, "K-lined"), strings.HasPrefix(reason, "D-lined"):
+		return "banned"
+	case strings.HasPrefix(reason, "Killed"):
+		return "killed"
+	case reason == "Server is full, please try again later", strings.HasPrefix(reason, "Too many connections"):
+		return "limit"
+	case strings.HasPrefix(reason, "WEBIRC"):
+		return "webirc"
+	}
+	return "other"
+}
+
+// serveMetrics serves the metrics endpoint on ln until it is closed.
+func (s *Server) serveMetrics(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	srv := &http.Server{Handler: mux, ErrorLog: s.httpErrorLog("metrics")}
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logError(EventServer, Fields{"listener": "metrics", "error": err.Error()}, "metrics listener failed: %v", err)
+	}
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.writeMetrics(w)
+}
+
+// writeMetrics writes the metrics of s in the Prometheus text format.
+func (s *Server) writeMetrics(w io.Writer) {
+	s.mu.RLock()
+	conns := len(s.clients)
+	s.mu.RUnlock()
+	users, channels := s.nicks.len(), s.channels.len()
+	m := s.metrics
+
+	gauge := func(name, help string, v int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	gauge("irc_connected_clients", "Open connections, unregistered clients and server links included.", conns)
+	gauge("irc_registered_users", "Registered users on the network, users of linked servers included.", users)
+	gauge("irc_channels", "Channels on the network.", channels)
+
+	names := m.commandNames()
+	fmt.Fprintf(w, "# HELP irc_messages_total Messages received per command.\n# TYPE irc_messages_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "irc_messages_total{command=%s} %d\n", labelValue(name), m.command(name).count.Load())
+	}
+	fmt.Fprintf(w, "# HELP irc_received_bytes_total Bytes received from clients and server links.\n# TYPE irc_received_bytes_total counter\nirc_received_bytes_total %d\n", m.bytesIn.Load())
+	fmt.Fprintf(w, "# HELP irc_sent_bytes_total Bytes sent to clients and server links.\n# TYPE irc_sent_bytes_total counter\nirc_sent_bytes_total %d\n", m.bytesOut.Load())
+
+	fmt.Fprintf(w, "# HELP irc_sendq_bytes Bytes waiting to be written to a connection, observed whenever a line is queued.\n# TYPE irc_sendq_bytes histogram\n")
+	m.sendQ.write(w, "irc_sendq_bytes", "")
+
+	var reasons []string
+	m.disconnects.Range(func(reason, _ any) bool {
+		reasons = append(reasons, reason.(string))
+		return true
+	})
+	sort.Strings(reasons)
+	fmt.Fprintf(w, "# HELP irc_disconnects_total Closed connections by reason.\n# TYPE irc_disconnects_total counter\n")
+	for _, reason := range reasons {
+		n, _ := m.disconnects.Load(reason)
+		fmt.Fprintf(w, "irc_disconnects_total{reason=%s} %d\n", labelValue(reason), n.(*atomic.Int64).Load())
+	}
+
+	fmt.Fprintf(w, "# HELP irc_command_duration_seconds Time taken to handle a command.\n# TYPE irc_command_duration_seconds histogram\n")
+	for _, name := range names {
+		m.command(name).latency.write(w, "irc_command_duration_seconds", "command="+labelValue(name))
+	}
+}
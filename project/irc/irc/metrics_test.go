@@ -0,0 +1,102 @@
+package irc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	for _, v := range []float64{0.5, 1, 5, 20} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	h.write(&b, "x", `a="b"`)
+	want := `x_bucket{a="b",le="1"} 2
+x_bucket{a="b",le="10"} 3
+x_bucket{a="b",le="+Inf"} 4
+x_sum{a="b"} 26.5
+x_count{a="b"} 4
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Metrics.Addr = "127.0.0.1:0"
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	alice.Join("#chat")
+	readUntil(t, alice, " 366 ")
+	alice.Send("QUIT :bye")
+	readUntil(t, alice, "ERROR :Closing Link")
+	waitFor(t, s, "alice to leave", func() bool { return s.nicks.len() == 1 })
+	for i := 0; i < 3; i++ {
+		bob.Send(fmt.Sprintf("MADEUP%d x", i))
+	}
+	bob.Send("PING :x")
+	readUntil(t, bob, "PONG")
+
+	resp, err := http.Get("http://" + s.MetricsAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	text := string(body)
+	for _, want := range []string{
+		"irc_registered_users 1\n",
+		"irc_channels 0\n",
+		`irc_messages_total{command="NICK"} 2` + "\n",
+		`irc_messages_total{command="JOIN"} 1` + "\n",
+		`irc_disconnects_total{reason="quit"} 1` + "\n",
+		`irc_command_duration_seconds_count{command="JOIN"} 1` + "\n",
+		`irc_messages_total{command="unknown"} 3` + "\n",
+		"# TYPE irc_sendq_bytes histogram\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics lack %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "MADEUP") {
+		t.Errorf("unknown commands got series of their own:\n%s", text)
+	}
+	if strings.Contains(text, "irc_sent_bytes_total 0\n") || strings.Contains(text, "irc_received_bytes_total 0\n") {
+		t.Errorf("traffic not counted:\n%s", text)
+	}
+}
+
+func TestDisconnectKind(t *testing.T) {
+	for reason, want := range map[string]string{
+		"Quit: see you":                          "quit",
+		"Ping timeout: 60 seconds":               "ping_timeout",
+		"SendQ exceeded":                         "sendq",
+		"K-lined":                                "banned",
+		"D-lined: bad network":                   "banned",
+		"Too many connections from your address": "limit",
+		"irc.a.local irc.b.local":                "other",
+	} {
+		if got := disconnectKind(reason); got != want {
+			t.Errorf("disconnectKind(%q) = %q, want %q", reason, got, want)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for v, want := range map[string]string{
+		"PRIVMSG":        `"PRIVMSG"`,
+		`a"b\c`:          `"a\"b\\c"`,
+		"line\nbreak":    `"line\nbreak"`,
+		"tab\tand é\x01": "\"tab\tand é\x01\"",
+	} {
+		if got := labelValue(v); got != want {
+			t.Errorf("labelValue(%q) = %s, want %s", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package irc
+
+// Numeric replies sent by the server.
+const (
+	rplWelcome  = "001"
+	rplYourHost = "002"
+	rplCreated  = "003"
+	rplMyInfo   = "004"
+	rplISupport = "005"
+
+	rplStatsLinkInfo = "211"
+	rplStatsCommands = "212"
+	rplStatsKLine    = "216"
+	rplEndOfStats    = "219"
+	rplUModeIs       = "221"
+	rplStatsDLine    = "225"
+	rplStatsUptime   = "242"
+	rplStatsDebug    = "249"
+	rplStatsConn     = "250"
+	rplLuserClient   = "251"
+	rplLuserOp       = "252"
+	rplLuserUnknown  = "253"
+	rplLuserChannels = "254"
+	rplLuserMe       = "255"
+	rplAdminMe       = "256"
+	rplAdminLoc1     = "257"
+	rplAdminLoc2     = "258"
+	rplAdminEmail    = "259"
+	rplLocalUsers    = "265"
+	rplGlobalUsers   = "266"
+	rplWhoisUser     = "311"
+	rplWhoisServer   = "312"
+	rplWhoisOperator = "313"
+	rplWhowasUser    = "314"
+	rplEndOfWho      = "315"
+	rplEndOfWhois    = "318"
+	rplWhoisChannels = "319"
+	rplChannelModeIs = "324"
+	rplWhoisAccount  = "330"
+	rplNoTopic       = "331"
+	rplTopic         = "332"
+	rplTopicWhoTime  = "333"
+	rplWhoisBot      = "335"
+	rplVersion       = "351"
+	rplWhoReply      = "352"
+	rplNamReply      = "353"
+	rplLinks         = "364"
+	rplEndOfLinks    = "365"
+	rplEndOfNames    = "366"
+	rplEndOfWhowas   = "369"
+	rplInfo          = "371"
+	rplMOTD          = "372"
+	rplEndOfInfo     = "374"
+	rplMOTDStart     = "375"
+	rplEndOfMOTD     = "376"
+	rplYoureOper     = "381"
+	rplTime          = "391"
+	rplWhoisSecure   = "671"
+	rplLoggedIn      = "900"
+	rplSASLSuccess   = "903"
+	rplSASLMechs     = "908"
+
+	errUnknownError      = "400"
+	errNoSuchNick        = "401"
+	errNoSuchServer      = "402"
+	errNoSuchChannel     = "403"
+	errTooManyChannels   = "405"
+	errWasNoSuchNick     = "406"
+	errTooManyTargets    = "407"
+	errInvalidCapCmd     = "410"
+	errNoTextToSend      = "412"
+	errInputTooLong      = "417"
+	errUnknownCommand    = "421"
+	errNoMOTD            = "422"
+	errNoAdminInfo       = "423"
+	errNoNicknameGiven   = "431"
+	errErroneusNickname  = "432"
+	errNicknameInUse     = "433"
+	errNotOnChannel      = "442"
+	errNotRegistered     = "451"
+	errNeedMoreParams    = "461"
+	errAlreadyRegistered = "462"
+	errPasswdMismatch    = "464"
+	errYoureBannedCreep  = "465"
+	errUnknownMode       = "472"
+	errBadChanMask       = "476"
+	errNoPrivileges      = "481"
+	errUModeUnknownFlag  = "501"
+	errUsersDontMatch    = "502"
+	errSASLFail          = "904"
+	errSASLTooLong       = "905"
+	errSASLAborted       = "906"
+	errSASLAlready       = "907"
+)
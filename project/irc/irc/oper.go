@@ -0,0 +1,59 @@
+package irc
+
+import (
+	"crypto/subtle"
+	"fmt"
+)
+
+// isOper reports whether c has operator privileges.
+func (s *Server) isOper(c *Client) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return c.hasMode('o')
+}
+
+func (s *Server) handleOper(c *Client, params []string) {
+	name, password := params[0], params[1]
+	for _, op := range s.config().Opers {
+		if op.Name != name {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(op.Password), []byte(password)) != 1 {
+			break
+		}
+		s.mu.Lock()
+		c.setMode('o', true)
+		s.mu.Unlock()
+		s.logInfo(EventOper, Fields{"nick": c.nickname(), "oper": name}, "%s is now an IRC operator (%s)", c.nickname(), name)
+		s.numeric(c, rplYoureOper, "You are now an IRC operator")
+		c.send(":" + c.nickname() + " MODE " + c.nickname() + " :+o")
+		s.propagateModes(c, "+o")
+		s.emitMode(ModeEvent{c.nickname(), "+o"})
+		return
+	}
+	s.logWarn(EventOper, Fields{"nick": c.nickname(), "oper": name}, "Failed OPER attempt by %s (%s)", c.nickname(), name)
+	s.numeric(c, errPasswdMismatch, "Password incorrect")
+}
+
+// handleWallops lets operators send a message to every user with +w set.
+func (s *Server) handleWallops(c *Client, params []string) {
+	if params[0] == "" {
+		s.numeric(c, errNeedMoreParams, "WALLOPS", "Not enough parameters")
+		return
+	}
+	s.sendWallops(c, params[0])
+	s.propagate(nil, fmt.Sprintf(":%s WALLOPS :%s", c.id, params[0]))
+}
+
+// sendWallops delivers WALLOPS from c to the local users with +w set.
+func (s *Server) sendWallops(c *Client, text string) {
+	s.mu.RLock()
+	recips := make(map[*Client]bool)
+	for _, cl := range s.nicks.all() {
+		if cl.registered && cl.hasMode('w') {
+			recips[cl] = true
+		}
+	}
+	s.mu.RUnlock()
+	s.broadcast(recips, fmt.Sprintf(":%s WALLOPS :%s", c.nickname(), text))
+}
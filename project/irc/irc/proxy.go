@@ -0,0 +1,141 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol
+//
+// A proxy in front of the server, such as HAProxy, starts every connection
+// with a header naming the client it accepted the connection from. Version
+// 1 is a text line:
+//
+//	PROXY TCP4 <source> <destination> <source port> <destination port>\r\n
+//
+// version 2 a binary header starting with proxyV2Signature. The source
+// address replaces the address of the proxy for everything the server
+// does with the connection.
+
+// proxyHeaderTimeout bounds the wait for the PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// maxProxyV1Len is the longest version 1 header, CR LF included.
+const maxProxyV1Len = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errBadProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyConn is a connection whose client address came from a PROXY header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+
+// handleProxied reads the PROXY header of conn and serves it as a
+// connection from the client named in the header.
+func (s *Server) handleProxied(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	r := bufio.NewReaderSize(conn, maxTagsLen+maxLineLen)
+	remote, err := readProxyHeader(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.logWarn(EventConnect, Fields{"remote": conn.RemoteAddr().String(), "error": err.Error()}, "Dropped connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	s.logDebug(EventConnect, Fields{"proxy": conn.RemoteAddr().String(), "remote": remote.String()}, "Proxied connection from %s for %s", conn.RemoteAddr(), remote)
+	s.handleConn(&proxyConn{Conn: conn, r: r, remote: remote})
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY header. It returns a nil
+// address for headers that do not carry one, such as health checks by the
+// proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if prefix, err := r.Peek(6); err != nil || string(prefix) != "PROXY " {
+		return nil, errBadProxyHeader
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Len {
+			return nil, errBadProxyHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, errBadProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch head[12] & 0x0F {
+	case 0x0: // LOCAL: the proxy's own connection
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errBadProxyHeader
+	}
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Other families carry no address the server can use.
+	return nil, nil
+}
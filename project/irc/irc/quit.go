@@ -0,0 +1,158 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// handleQuit answers QUIT with ERROR and closes the connection. The quit
+// itself is announced once the read loop notices the closed connection.
+func (s *Server) handleQuit(c *Client, params []string) {
+	reason := "Client Quit"
+	if len(params) > 0 && params[0] != "" {
+		if text, ok := s.filterText(c, "QUIT", "", params[0]); ok {
+			reason = "Quit: " + text
+		}
+	}
+	s.quit(c, reason)
+}
+
+// quit disconnects c with the given reason. The client is told why through
+// an ERROR message. Only the first reason given for a client is kept.
+func (s *Server) quit(c *Client, reason string) {
+	s.mu.Lock()
+	if c.quitReason != "" {
+		s.mu.Unlock()
+		return
+	}
+	c.quitReason = reason
+	s.mu.Unlock()
+	c.send(fmt.Sprintf("ERROR :Closing Link: %s (%s)", c.Host, reason))
+	c.closeAfterFlush()
+}
+
+// quitting reports whether c is being disconnected.
+func (s *Server) quitting(c *Client) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return c.quitReason != ""
+}
+
+// readErrorReason describes why reading from a connection failed.
+func readErrorReason(err error) string {
+	switch {
+	case errors.Is(err, io.EOF):
+		return "Connection closed"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "Connection reset by peer"
+	default:
+		return "Read error: " + err.Error()
+	}
+}
+
+// removeClient drops c from the server state and sends a single QUIT to
+// every client sharing at least one channel with it. Connections attached
+// to an always-on session are only detached from it, and closing a server
+// link splits the servers behind it from the network.
+func (s *Server) removeClient(c *Client, reason string) {
+	s.mu.Lock()
+	if c.quitReason == "" {
+		c.quitReason = reason
+	}
+	reason = c.quitReason
+	s.mu.Unlock()
+	s.metrics.disconnected(reason)
+	if c.user != nil {
+		s.detach(c, reason)
+		return
+	}
+	s.mu.Lock()
+	delete(s.clients, c.Conn)
+	s.mu.Unlock()
+	if c.peer != nil {
+		s.linkClosed(c, reason)
+		return
+	}
+	s.removeUsers([]*Client{c}, reason)
+	if c.registered {
+		s.propagate(nil, fmt.Sprintf(":%s QUIT :%s", c.id, reason))
+	}
+}
+
+// removeUsers drops users from the server state. Each registered user's QUIT
+// is sent once to every local client sharing a channel with it. A user is
+// marked gone before leaving its channels, so a join racing with the
+// removal cannot put it back on one.
+func (s *Server) removeUsers(users []*Client, reason string) {
+	quits := make([]map[*Client]bool, len(users))
+	channels := make([][]string, len(users))
+	for i, c := range users {
+		c.chanMu.Lock()
+		c.gone = true
+		c.chanMu.Unlock()
+		quits[i] = make(map[*Client]bool)
+		for _, key := range c.channelKeys() {
+			ch, members, member := s.removeMember(c, key)
+			if !member {
+				continue
+			}
+			channels[i] = append(channels[i], ch.Name)
+			for m := range members {
+				quits[i][m] = true
+			}
+		}
+		delete(quits[i], c)
+		sort.Strings(channels[i])
+	}
+	s.mu.Lock()
+	for _, c := range users {
+		s.recordWhowas(c)
+		if c.nickname() != "" {
+			s.nicks.deleteIf(s.fold(c.nickname()), c)
+		}
+		delete(s.uids, c.id)
+	}
+	s.mu.Unlock()
+
+	for i, c := range users {
+		if c.registered {
+			s.logInfo(EventQuit, Fields{"nick": c.nickname(), "reason": reason}, "%s quit (%s)", c.nickname(), reason)
+			for _, name := range channels[i] {
+				s.logChannel(name, "quit", c.nickname(), "", reason)
+			}
+			s.broadcast(quits[i], fmt.Sprintf(":%s QUIT :%s", c.nickname(), reason))
+		}
+	}
+}
+
+// keepAlive pings c once it has been idle for the ping interval and
+// disconnects it if nothing arrives within the ping timeout. It returns
+// when done is closed.
+func (s *Server) keepAlive(c *Client, done <-chan struct{}) {
+	timer := time.NewTimer(time.Duration(s.config().PingInterval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+		cfg := s.config()
+		interval, timeout := time.Duration(cfg.PingInterval), time.Duration(cfg.PingTimeout)
+		idle := time.Since(time.Unix(0, c.lastActive.Load()))
+		switch {
+		case idle >= interval+timeout:
+			s.quit(c, fmt.Sprintf("Ping timeout: %d seconds", int(idle.Seconds())))
+			return
+		case idle >= interval:
+			c.send("PING :" + cfg.ServerName)
+			timer.Reset(interval + timeout - idle)
+		default:
+			timer.Reset(interval - idle)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package irc
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuitBroadcastOncePerPeer(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+
+	alice.Send("JOIN #a,#b")
+	readUntil(t, alice, " 366 alice #b ")
+	bob.Send("JOIN #a,#b")
+	readUntil(t, alice, ":bob JOIN #b")
+
+	bob.Send("QUIT :see you")
+	readUntil(t, bob, "ERROR :Closing Link: ")
+	readUntil(t, alice, ":bob QUIT :Quit: see you")
+
+	// A second QUIT or a PART for the other channel must not follow.
+	alice.Send("PING :done")
+	line, err := alice.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, "PONG :done") {
+		t.Errorf("expected PONG, got %q", line)
+	}
+}
+
+func TestQuitDoesNotLeakPart(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+
+	alice.Join("#a")
+	readUntil(t, alice, " 366 alice #a ")
+	bob.Join("#a")
+	readUntil(t, alice, ":bob JOIN #a")
+	bob.Send("QUIT")
+	if line := readUntil(t, alice, ":bob "); !strings.Contains(line, "QUIT :Client Quit") {
+		t.Errorf("expected QUIT, got %q", line)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = Duration(100 * time.Millisecond)
+	cfg.PingTimeout = Duration(100 * time.Millisecond)
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	idle := login(t, s, "idle")
+
+	// alice keeps talking so only idle times out.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(30 * time.Millisecond):
+				alice.Send("PING :keepalive")
+			}
+		}
+	}()
+
+	alice.Join("#room")
+	readUntil(t, alice, " 366 alice #room ")
+	idle.Join("#room")
+	readUntil(t, alice, ":idle JOIN #room")
+
+	readUntil(t, idle, "PING :")
+	readUntil(t, alice, ":idle QUIT :Ping timeout: ")
+}
+
+func TestConnectionReset(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	alice.Join("#room")
+	readUntil(t, alice, " 366 alice #room ")
+
+	conn, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("NICK bob\r\nUSER bob 0 * :bob\r\nJOIN #room\r\n"))
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(line, " 366 bob ") {
+			break
+		}
+	}
+	readUntil(t, alice, ":bob JOIN #room")
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	readUntil(t, alice, ":bob QUIT :Connection reset by peer")
+}
@@ -0,0 +1,127 @@
+package irc
+
+import (
+	"sync"
+	"time"
+)
+
+// Send queues
+//
+// What the server sends to a connection goes through its send queue, so
+// that sending never waits on a slow or stuck peer, even with locks held.
+// A writer goroutine, started when lines are queued and gone once the queue
+// is empty, writes them out in order. A connection whose queue grows beyond
+// its limit, Limits.SendQ or Limits.LinkSendQ for server links, is closed
+// with "SendQ exceeded".
+
+// closeFlushTimeout bounds how long a closing connection may take to write
+// out what is left in its send queue, such as its ERROR line.
+const closeFlushTimeout = 5 * time.Second
+
+type sendQueue struct {
+	mu      sync.Mutex
+	lines   []string
+	size    int64
+	limit   int64
+	writing bool
+	// closing is set once the connection should be closed when the queue
+	// is empty, and overflowed once it was closed for exceeding its limit.
+	closing    bool
+	overflowed bool
+}
+
+// setLimit sets the number of bytes the queue may hold. There is no limit
+// when it is 0 or less.
+func (q *sendQueue) setLimit(limit int64) {
+	q.mu.Lock()
+	q.limit = limit
+	q.mu.Unlock()
+}
+
+// push queues out for c and returns the number of bytes now waiting. It
+// never blocks. Lines queued after the connection started closing are
+// dropped.
+func (c *Client) push(out string) int64 {
+	q := &c.sendq
+	q.mu.Lock()
+	if q.closing {
+		size := q.size
+		q.mu.Unlock()
+		return size
+	}
+	q.lines = append(q.lines, out)
+	q.size += int64(len(out))
+	size := q.size
+	if q.limit > 0 && q.size > q.limit {
+		q.lines, q.size = nil, 0
+		q.closing, q.overflowed = true, true
+		q.mu.Unlock()
+		c.Conn.Close()
+		return size
+	}
+	start := !q.writing
+	q.writing = true
+	q.mu.Unlock()
+	if start {
+		go c.writeQueue()
+	}
+	return size
+}
+
+// writeQueue writes the queued lines of c until the queue is empty, then
+// closes the connection if it is closing.
+func (c *Client) writeQueue() {
+	q := &c.sendq
+	for {
+		q.mu.Lock()
+		lines := q.lines
+		q.lines = nil
+		if len(lines) == 0 {
+			q.writing = false
+			closing := q.closing && !q.overflowed
+			q.mu.Unlock()
+			if closing {
+				c.Conn.Close()
+			}
+			return
+		}
+		q.mu.Unlock()
+		for _, line := range lines {
+			_, err := c.Conn.Write([]byte(line))
+			q.mu.Lock()
+			q.size -= int64(len(line))
+			if err != nil {
+				// The connection is gone; nothing more can be written.
+				q.lines, q.size = nil, 0
+				q.closing = true
+				q.writing = false
+				q.mu.Unlock()
+				return
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// closeAfterFlush closes the connection of c once what is queued for it
+// has been written, or closeFlushTimeout has passed.
+func (c *Client) closeAfterFlush() {
+	q := &c.sendq
+	q.mu.Lock()
+	q.closing = true
+	idle := !q.writing
+	q.mu.Unlock()
+	if idle {
+		c.Conn.Close()
+		return
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+}
+
+// sendQExceeded reports whether the connection of c was closed because its
+// send queue grew beyond the limit.
+func (c *Client) sendQExceeded() bool {
+	c.sendq.mu.Lock()
+	defer c.sendq.mu.Unlock()
+	return c.sendq.overflowed
+}
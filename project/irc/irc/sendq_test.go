@@ -0,0 +1,43 @@
+package irc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestSendQExceeded checks that a client that stops reading is
+// disconnected once its send queue is full, without holding up the server.
+func TestSendQExceeded(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limits.SendQ = 4096
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	alice.Join("#busy")
+	readUntil(t, alice, " 366 ")
+
+	// The client end of the pipe is never read, so every line the server
+	// sends to slow stays in its queue.
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.handleConn(server)
+	fmt.Fprintf(client, "NICK slow\r\nUSER slow 0 * :slow\r\nJOIN #busy\r\n")
+	for i := 0; ; i++ {
+		if i == 1000 {
+			t.Fatal("slow client never disconnected")
+		}
+		if _, err := fmt.Fprintf(client, "PING :%s\r\n", strings.Repeat("x", 200)); err != nil {
+			break
+		}
+	}
+	readUntil(t, alice, ":slow QUIT :SendQ exceeded")
+	alice.Send("PING :still here")
+	readUntil(t, alice, "PONG")
+
+	n, ok := s.metrics.disconnects.Load("sendq")
+	if !ok || n.(*atomic.Int64).Load() != 1 {
+		t.Errorf("SendQ disconnect not counted")
+	}
+}
@@ -4,43 +4,229 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	Logger      = log.Default()
-	ErrorLogger = log.Default()
-)
+// Version is reported to clients in RPL_YOURHOST and RPL_MYINFO.
+const Version = "vibes-0.1"
 
 // Client represents a connected IRC client.
 type Client struct {
-	Conn     net.Conn
+	// Conn is nil for the Client of an always-on session, which writes
+	// to the connections attached to it instead.
+	Conn net.Conn
+	// Nickname is guarded by s.mu and changed with setNick, which keeps a
+	// copy nickname reads without the lock.
 	Nickname string
+	curNick  atomic.Pointer[string]
 	Username string
+	Realname string
+	Host     string
+	// Channels holds the casefolded names of the channels the client is
+	// on, guarded by chanMu. gone is set once the client has been removed
+	// from the server and may join no more channels.
 	Channels map[string]bool
+	chanMu   sync.Mutex
+	gone     bool
+	// ip is the address the client connects from, empty for unix sockets.
+	// gateway names the WEBIRC gateway that gave it.
+	ip      string
+	gateway string
+
+	registered     bool
+	capNegotiating bool
+	caps           map[string]bool
+	modes          map[byte]bool
+	connected      time.Time
+	quitReason     string
+	lastActive     atomic.Int64
+	account        string
+	saslMech       string
+	saslBuf        strings.Builder
+
+	// user is the always-on session this connection is attached to.
+	user *Client
+	// The remaining fields belong to always-on sessions.
+	alwaysOn   bool
+	sessMu     sync.Mutex
+	sessions   []*Client
+	cmdMu      sync.Mutex
+	replyTo    atomic.Pointer[Client]
+	detachedAt time.Time
+	delivered  map[string]time.Time
+
+	// id is the network wide user ID and ts the time the current nick
+	// was taken, both used by server links.
+	id string
+	ts int64
+	// server and via are set for users on other servers: the server the
+	// user is on and the link leading to it.
+	server *linkedServer
+	via    *Client
+	// peer is set on connections that are server links. pass is the
+	// password sent with PASS and linkTo the server an outgoing link is
+	// expected to reach.
+	peer   *linkedServer
+	pass   string
+	linkTo string
+
+	sentMsgs, sentBytes atomic.Int64
+	recvMsgs, recvBytes atomic.Int64
+	// sendq holds what waits to be written to the connection and metrics
+	// the counters of its server.
+	sendq   sendQueue
+	metrics *metrics
+	// flood is the allowance left for commands of the connection.
+	flood floodBucket
+}
+
+// Channel holds the members of a channel. Name keeps the spelling used by
+// the client that created the channel. The other fields are guarded by mu.
+type Channel struct {
+	Name    string
+	mu      sync.RWMutex
+	Members map[*Client]bool
+	// ts is the creation time, kept consistent across linked servers.
+	ts int64
+	// topic was set by topicBy, a nick!user@host or server name, at
+	// topicAt.
+	topic   string
+	topicBy string
+	topicAt time.Time
+	// dead is set once the channel has been removed from the server.
+	dead bool
 }
 
 // Server maintains IRC state.
 type Server struct {
 	Addr     string
 	ln       net.Listener
-	mu       sync.Mutex
+	mu       sync.RWMutex
+	cfg      atomic.Pointer[Config]
+	created  time.Time
 	clients  map[net.Conn]*Client
-	channels map[string]map[*Client]bool
+	nicks    *nickIndex
+	channels *channelIndex
 	ready    chan struct{}
+
+	// ListenerAddrs holds the addresses of Config.Listeners, in order, once
+	// Run has opened them.
+	ListenerAddrs []string
+	listeners     []*listener
+	// WebSocketAddr is the address WebSocket connections are accepted on,
+	// set by Run when WebSocket is enabled.
+	WebSocketAddr string
+	wsLn          net.Listener
+	// MetricsAddr is the address metrics are served on, set by Run when
+	// the metrics endpoint is enabled.
+	MetricsAddr string
+	metricsLn   net.Listener
+	metrics     *metrics
+	chanLog     *chanLogger
+	hooks       hooks
+	commands    commandRegistry
+	// AdminAddr is the address of the admin API, set by Run when it is
+	// enabled.
+	AdminAddr string
+	adminLn   net.Listener
+	// logSink receives the events at or above logLevel.
+	logSink  atomic.Pointer[LogSink]
+	logLevel atomic.Int32
+
+	motd     []string
+	whowas   *whowasHistory
+	history  HistoryStore
+	sessions map[string]*Client
+	sid      string
+	servers  map[string]*linkedServer
+	links    map[*Client]bool
+	uids     map[string]*Client
+	nextUID  int
+	memos    map[string][]HistoryItem
+	bans     banList
+	bansFile string
+	filters  atomic.Pointer[[]*filter]
+	// exempt holds the parsed Limits.Exempt.
+	exempt     []*net.IPNet
+	gateways   []gateway
+	totalConns int
+	maxClients int
+
+	// restored holds the channels of the snapshot nobody has joined since
+	// the server started, by casefolded name.
+	restoredMu sync.Mutex
+	restored   map[string]snapshotChannel
+	snapshotMu sync.Mutex
+	// closing is closed by Close.
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
-// NewServer creates a new IRC server.
+// NewServer creates a new IRC server using DefaultConfig.
 func NewServer(addr string) *Server {
-	return &Server{
+	return NewServerWithConfig(addr, DefaultConfig())
+}
+
+// NewServerWithConfig creates a new IRC server using cfg.
+func NewServerWithConfig(addr string, cfg Config) *Server {
+	s := &Server{
 		Addr:     addr,
+		created:  time.Now(),
 		clients:  make(map[net.Conn]*Client),
-		channels: make(map[string]map[*Client]bool),
+		nicks:    newNickIndex(),
+		channels: newChannelIndex(),
 		ready:    make(chan struct{}),
+		metrics:  newMetrics(),
+		chanLog:  newChanLogger(),
+		sessions: make(map[string]*Client),
+		servers:  make(map[string]*linkedServer),
+		links:    make(map[*Client]bool),
+		uids:     make(map[string]*Client),
+		memos:    make(map[string][]HistoryItem),
+		restored: make(map[string]snapshotChannel),
+		closing:  make(chan struct{}),
+		commands: commandRegistry{cmds: builtinCommands()},
+	}
+	cfg = cfg.withDefaults()
+	s.cfg.Store(&cfg)
+	s.sid = cfg.ServerID
+	s.setLogLevel(cfg.Log.Level)
+	s.chanLog.configure(cfg)
+	s.whowas = newWhowasHistory(cfg.WhowasLength)
+	history, err := newHistoryStore(cfg.History)
+	if err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "failed to open history store, keeping history in memory: %v", err)
+		history = NewMemoryHistory(cfg.History.Length)
 	}
+	s.history = history
+	s.reloadFilters()
+	s.reloadExempt()
+	s.reloadGateways()
+	s.bansFile = cfg.BansFile
+	if s.bans, err = loadBans(s.bansFile); err != nil {
+		s.logError(EventServer, Fields{"file": s.bansFile, "error": err.Error()}, "failed to load bans: %v", err)
+	}
+	s.reloadMOTD()
+	s.restoreSnapshot()
+	return s
+}
+
+// reloadMOTD rereads the configured MOTD file. The previous MOTD is kept if
+// the file cannot be read.
+func (s *Server) reloadMOTD() {
+	motd, err := loadMOTD(s.config().MOTDFile)
+	if err != nil {
+		s.logError(EventServer, Fields{"error": err.Error()}, "failed to load MOTD: %v", err)
+		return
+	}
+	s.mu.Lock()
+	s.motd = motd
+	s.mu.Unlock()
 }
 
 // Ready returns a channel that is closed once the server is ready to accept
@@ -49,6 +235,41 @@ func (s *Server) Ready() <-chan struct{} {
 	return s.ready
 }
 
+// Config returns the configuration currently in effect.
+func (s *Server) Config() Config {
+	return s.config()
+}
+
+func (s *Server) config() Config {
+	return *s.cfg.Load()
+}
+
+// Rehash replaces the server configuration, reloads the MOTD and re-sends
+// RPL_ISUPPORT to every registered client so they pick up the new limits.
+func (s *Server) Rehash(cfg Config) {
+	cfg = cfg.withDefaults()
+	s.mu.Lock()
+	s.cfg.Store(&cfg)
+	s.setLogLevel(cfg.Log.Level)
+	s.chanLog.configure(cfg)
+	s.whowas = s.whowas.resize(cfg.WhowasLength)
+	s.reloadFilters()
+	s.reloadExempt()
+	s.reloadGateways()
+	recips := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		if c.registered {
+			recips = append(recips, c)
+		}
+	}
+	s.mu.Unlock()
+	s.reloadMOTD()
+	s.logInfo(EventServer, nil, "Configuration reloaded")
+	for _, c := range recips {
+		s.sendISupport(c)
+	}
+}
+
 func (s *Server) Run() error {
 	ln, err := net.Listen("tcp", s.Addr)
 	if err != nil {
@@ -56,160 +277,675 @@ func (s *Server) Run() error {
 	}
 	s.ln = ln
 	s.Addr = ln.Addr().String()
-	close(s.ready)
-	Logger.Printf("IRC server listening on %s", s.Addr)
-	fmt.Printf("IRC server started on %s\n", s.Addr)
-	for {
-		conn, err := ln.Accept()
+	if err := s.listenAll(); err != nil {
+		ln.Close()
+		return err
+	}
+	if addr := s.config().WebSocket.Addr; addr != "" {
+		wsLn, err := net.Listen("tcp", addr)
 		if err != nil {
-			if errors.Is(err, net.ErrClosed) {
-				return nil
-			}
-			ErrorLogger.Println("accept error:", err)
-			continue
+			s.closeListeners()
+			ln.Close()
+			return err
 		}
-		Logger.Printf("Client connected: %s", conn.RemoteAddr())
-		go s.handleConn(conn)
+		s.wsLn = wsLn
+		s.WebSocketAddr = wsLn.Addr().String()
+		s.logInfo(EventServer, Fields{"listener": "websocket", "addr": s.WebSocketAddr}, "WebSocket listening on %s", s.WebSocketAddr)
+		go s.serveWebSocket(wsLn)
 	}
+	if addr := s.config().Metrics.Addr; addr != "" {
+		metricsLn, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		s.metricsLn = metricsLn
+		s.MetricsAddr = metricsLn.Addr().String()
+		s.logInfo(EventServer, Fields{"listener": "metrics", "addr": s.MetricsAddr}, "Metrics listening on %s", s.MetricsAddr)
+		go s.serveMetrics(metricsLn)
+	}
+	if api := s.config().AdminAPI; api.Addr != "" {
+		if api.Token == "" {
+			s.Close()
+			return errors.New("admin API needs a token")
+		}
+		adminLn, err := net.Listen("tcp", api.Addr)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		s.adminLn = adminLn
+		s.AdminAddr = adminLn.Addr().String()
+		s.logInfo(EventServer, Fields{"listener": "admin", "addr": s.AdminAddr}, "Admin API listening on %s", s.AdminAddr)
+		go s.serveAdmin(adminLn)
+	}
+	for _, l := range s.listeners {
+		go s.accept(l, l)
+	}
+	if snap := s.config().Snapshot; snap.File != "" {
+		go s.snapshotLoop(time.Duration(snap.Interval))
+	}
+	go s.chanLogLoop()
+	close(s.ready)
+	s.logInfo(EventServer, Fields{"addr": s.Addr}, "IRC server listening on %s", s.Addr)
+	return s.accept(ln, nil)
 }
 
 func (s *Server) handleConn(conn net.Conn) {
-	client := &Client{Conn: conn, Channels: make(map[string]bool)}
+	client := connClient(conn)
+	s.mu.Lock()
+	reason := s.admit(client)
+	if reason == "" {
+		s.addClient(client)
+	}
+	s.mu.Unlock()
+	if reason != "" {
+		s.logWarn(EventConnect, Fields{"host": client.Host, "reason": reason}, "Refused connection from %s: %s", client.Host, reason)
+		s.metrics.disconnected(reason)
+		conn.Write([]byte(fmt.Sprintf("ERROR :Closing Link: %s (%s)\r\n", client.Host, reason)))
+		conn.Close()
+		return
+	}
+	s.serve(client)
+}
+
+// newClient registers a new connection with the server without checking
+// limits or bans.
+func (s *Server) newClient(conn net.Conn) *Client {
+	client := connClient(conn)
 	s.mu.Lock()
-	s.clients[conn] = client
+	s.addClient(client)
 	s.mu.Unlock()
+	return client
+}
+
+// connClient creates the Client of a new connection.
+func connClient(conn net.Conn) *Client {
+	client := &Client{Conn: conn, Channels: make(map[string]bool), connected: time.Now()}
+	client.Host = conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client.Host); err == nil {
+		client.Host = host
+		client.ip = host
+	}
+	if conn.RemoteAddr().Network() == "unix" {
+		client.Host = "localhost"
+	}
+	if strings.HasPrefix(client.Host, ":") {
+		// A leading colon would turn the host into a trailing parameter.
+		client.Host = "0" + client.Host
+	}
+	client.initialModes()
+	return client
+}
 
+// addClient records a new connection. The caller must hold s.mu.
+func (s *Server) addClient(client *Client) {
+	client.metrics = s.metrics
+	client.sendq.setLimit(s.cfg.Load().Limits.SendQ)
+	s.clients[client.Conn] = client
+	s.totalConns++
+	if len(s.clients) > s.maxClients {
+		s.maxClients = len(s.clients)
+	}
+}
+
+// serve reads and handles lines from client until its connection closes.
+func (s *Server) serve(client *Client) {
+	conn := client.Conn
+	done := make(chan struct{})
+	client.lastActive.Store(time.Now().UnixNano())
+	go s.keepAlive(client, done)
+	lines := make(chan string, lineQueue)
+	handled := make(chan struct{})
+	go s.handleLines(client, lines, handled)
+
+	reason := ""
 	defer func() {
-		Logger.Printf("Client disconnected: %s", conn.RemoteAddr())
-		s.mu.Lock()
-		for ch := range client.Channels {
-			s.mu.Unlock()
-			s.partChannel(client, ch)
-			s.mu.Lock()
-		}
-		delete(s.clients, conn)
-		s.mu.Unlock()
+		close(lines)
+		<-handled
+		close(done)
+		if client.sendQExceeded() {
+			reason = "SendQ exceeded"
+		}
+		s.logInfo(EventDisconnect, Fields{"remote": conn.RemoteAddr().String()}, "Client disconnected: %s", conn.RemoteAddr())
+		s.removeClient(client, reason)
 		conn.Close()
 	}()
 
-	reader := bufio.NewScanner(conn)
-	for reader.Scan() {
-		line := reader.Text()
-		s.handleLine(client, line)
+	reader := bufio.NewReaderSize(conn, maxTagsLen+maxLineLen)
+	for {
+		line, err := readLine(reader)
+		if errors.Is(err, ErrInputTooLong) {
+			s.numeric(client, errInputTooLong, "Input line was too long")
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				reason = readErrorReason(err)
+				if !errors.Is(err, io.EOF) {
+					s.logWarn(EventDisconnect, Fields{"remote": conn.RemoteAddr().String(), "error": err.Error()}, "read error: %v", err)
+				}
+			}
+			return
+		}
+		client.lastActive.Store(time.Now().UnixNano())
+		lines <- line
 	}
-	if err := reader.Err(); err != nil {
-		ErrorLogger.Println("read error:", err)
+}
+
+// lineQueue is how many lines read from a connection may wait to be
+// handled before reading stops.
+const lineQueue = 64
+
+// handleLines handles the lines read from c in order until lines is
+// closed, then closes handled. Commands waiting for flood control thus
+// don't hold up reading, and a throttled client still counts as active
+// and has its PONGs seen. Lines still queued once c has quit are dropped.
+func (s *Server) handleLines(c *Client, lines <-chan string, handled chan<- struct{}) {
+	defer close(handled)
+	for line := range lines {
+		if !s.quitting(c) {
+			s.handleLine(c, line)
+		}
 	}
 }
 
 func (s *Server) handleLine(c *Client, line string) {
-	parts := strings.SplitN(line, " ", 2)
-	cmd := strings.ToUpper(parts[0])
-	arg := ""
-	if len(parts) > 1 {
-		arg = parts[1]
-	}
-	switch cmd {
-	case "NICK":
-		c.Nickname = arg
-	case "USER":
-		c.Username = arg
-	case "PING":
-		c.Conn.Write([]byte("PONG :" + arg + "\r\n"))
-	case "JOIN":
-		s.joinChannel(c, arg)
-	case "PART":
-		s.partChannel(c, arg)
-	case "PRIVMSG":
-		s.handlePrivMsg(c, arg)
-	case "QUIT":
-		c.Conn.Close()
+	if line == "" {
+		return
+	}
+	limit := maxLineLen
+	if c.peer != nil {
+		limit = maxLinkLineLen
 	}
+	msg, err := parseMessage(line, limit)
+	switch {
+	case errors.Is(err, ErrInputTooLong):
+		s.numeric(c, errInputTooLong, "Input line was too long")
+		return
+	case err != nil:
+		s.numeric(c, errUnknownError, "Malformed message")
+		return
+	}
+	c.recvMsgs.Add(1)
+	c.recvBytes.Add(int64(len(line) + 2))
+	s.metrics.bytesIn.Add(int64(len(line) + 2))
+	st := s.metrics.command(s.commandLabel(c, msg.Command))
+	st.count.Add(1)
+	st.bytes.Add(int64(len(line) + 2))
+	defer func(start time.Time) {
+		st.latency.observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	if c.peer != nil {
+		s.handleLinkLine(c, msg)
+		return
+	}
+	if !applyUTF8Policy(msg, s.config().UTF8Policy) {
+		s.numeric(c, errUnknownError, msg.Command, "Message contains invalid UTF-8")
+		return
+	}
+	if msg = s.runCommandHooks(c, msg); msg == nil {
+		return
+	}
+	s.dispatch(c, msg)
 }
 
-func (s *Server) joinChannel(c *Client, name string) {
-	s.mu.Lock()
-	ch, ok := s.channels[name]
-	if !ok {
-		ch = make(map[*Client]bool)
-		s.channels[name] = ch
+// fold returns the casemapped form of a nickname or channel name.
+func (s *Server) fold(name string) string {
+	return foldCase(s.cfg.Load().CaseMapping, name)
+}
+
+// numeric sends a numeric reply to c. The last parameter is sent as the
+// trailing parameter.
+func (s *Server) numeric(c *Client, code string, params ...string) {
+	cfg := s.config()
+	nick := c.nick()
+	if nick == "" {
+		nick = "*"
 	}
-	ch[c] = true
-	if c.Channels == nil {
-		c.Channels = make(map[string]bool)
+	var b strings.Builder
+	fmt.Fprintf(&b, ":%s %s %s", cfg.ServerName, code, nick)
+	for i, p := range params {
+		if i == len(params)-1 {
+			b.WriteString(" :")
+		} else {
+			b.WriteByte(' ')
+		}
+		b.WriteString(p)
 	}
-	c.Channels[name] = true
-	s.mu.Unlock()
-	Logger.Printf("%s joined %s", c.Nickname, name)
-	s.broadcast(ch, fmt.Sprintf(":%s JOIN %s\r\n", c.Nickname, name))
+	c.reply(b.String())
 }
 
-func (s *Server) partChannel(c *Client, name string) {
-	s.mu.Lock()
-	ch := s.channels[name]
-	if ch != nil {
-		delete(ch, c)
-		if len(ch) == 0 {
-			delete(s.channels, name)
+// send writes a single protocol line to the client, truncating it to the
+// protocol limit. Lines sent to an always-on session go to every attached
+// connection.
+func (c *Client) send(line string) {
+	if c.Conn == nil {
+		for _, conn := range c.attached() {
+			conn.send(line)
 		}
+		return
+	}
+	c.write(truncateLine(strings.TrimRight(line, "\r\n")) + "\r\n")
+}
+
+// write queues out for the connection.
+func (c *Client) write(out string) {
+	n := int64(len(out))
+	c.sentMsgs.Add(1)
+	c.sentBytes.Add(n)
+	size := c.push(out)
+	if m := c.metrics; m != nil {
+		m.bytesOut.Add(n)
+		m.sendQ.observe(float64(size))
+	}
+}
+
+func validNick(nick string, maxLen int) bool {
+	if nick == "" || len(nick) > maxLen {
+		return false
+	}
+	for i := 0; i < len(nick); i++ {
+		c := nick[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case strings.IndexByte("[]\\`_^{|}", c) >= 0:
+		case i > 0 && (c >= '0' && c <= '9' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func validChannel(name string, maxLen int) bool {
+	if len(name) < 2 || len(name) > maxLen || !strings.ContainsRune(chanTypes, rune(name[0])) {
+		return false
+	}
+	return !strings.ContainsAny(name, " ,\x07")
+}
+
+func (s *Server) handleNick(c *Client, params []string) {
+	if len(params) == 0 || params[0] == "" {
+		s.numeric(c, errNoNicknameGiven, "No nickname given")
+		return
+	}
+	nick := params[0]
+	if !validNick(nick, s.config().NickLen) {
+		s.numeric(c, errErroneusNickname, nick, "Erroneous nickname")
+		return
+	}
+	s.mu.Lock()
+	key := s.fold(nick)
+	other := s.nicks.get(key)
+	// The nickname of an always-on session may be requested by a
+	// connection that has yet to log in to the account. Registration
+	// decides whether it gets it.
+	tentative := other != nil && other != c && !c.registered && other.alwaysOn
+	if other != nil && other != c && !tentative {
+		s.mu.Unlock()
+		s.numeric(c, errNicknameInUse, nick, "Nickname is already in use")
+		return
+	}
+	old := c.nickname()
+	if old != "" && s.nicks.get(s.fold(old)) == c {
+		s.recordWhowas(c)
+		s.nicks.deleteIf(s.fold(old), c)
+	}
+	if tentative {
+		c.setNick(nick)
+		s.mu.Unlock()
+		s.tryRegister(c)
+		return
 	}
-	delete(c.Channels, name)
+	s.nicks.set(key, c)
+	c.setNick(nick)
+	c.ts = time.Now().Unix()
+	peers := s.peers(c)
+	channels := s.channelNames(c)
 	s.mu.Unlock()
-	Logger.Printf("%s left %s", c.Nickname, name)
-	if ch != nil {
-		s.broadcast(ch, fmt.Sprintf(":%s PART %s\r\n", c.Nickname, name))
+
+	if !c.registered {
+		s.tryRegister(c)
+		return
+	}
+	s.logInfo(EventNick, Fields{"old": old, "nick": nick}, "%s is now known as %s", old, nick)
+	for _, name := range channels {
+		s.logChannel(name, "nick", old, nick, "")
+	}
+	s.emitNick(NickEvent{old, nick})
+	s.broadcast(peers, fmt.Sprintf(":%s NICK %s\r\n", old, nick))
+	s.propagate(nil, fmt.Sprintf(":%s NICK %s %d", c.id, nick, c.ts))
+}
+
+func (s *Server) handleUser(c *Client, params []string) {
+	if c.registered {
+		s.numeric(c, errAlreadyRegistered, "You may not reregister")
+		return
 	}
+	// WHOIS can already find c by its nickname, so the fields change
+	// under s.mu.
+	s.mu.Lock()
+	c.Username = params[0]
+	c.Realname = params[len(params)-1]
+	s.mu.Unlock()
+	s.tryRegister(c)
 }
 
-func (s *Server) handlePrivMsg(c *Client, msg string) {
-	parts := strings.SplitN(msg, " ", 2)
-	if len(parts) != 2 {
+// tryRegister completes registration once both NICK and USER have been
+// received and sends the welcome burst.
+func (s *Server) tryRegister(c *Client) {
+	if c.registered || c.capNegotiating || c.nickname() == "" || c.Username == "" {
 		return
 	}
-	target, body := parts[0], parts[1]
-	if strings.HasPrefix(body, ":") {
-		body = body[1:]
+	if s.banned(c) {
+		return
 	}
-	if strings.HasPrefix(target, "#") {
-		s.mu.Lock()
-		ch := s.channels[target]
+	if s.registerSession(c) {
+		return
+	}
+	s.mu.Lock()
+	if key := s.fold(c.nickname()); s.nicks.get(key) != c {
+		// The nickname belongs to an always-on session.
+		nick := c.nickname()
+		c.setNick("")
 		s.mu.Unlock()
-		s.broadcast(ch, fmt.Sprintf(":%s PRIVMSG %s :%s\r\n", c.Nickname, target, body))
-	} else {
-		s.mu.Lock()
-		var recipient *Client
-		for _, client := range s.clients {
-			if client.Nickname == target {
-				recipient = client
-				break
+		s.numeric(c, errNicknameInUse, nick, "Nickname is already in use")
+		return
+	}
+	c.registered = true
+	if c.account != "" {
+		c.setMode('r', true)
+	}
+	s.mu.Unlock()
+	s.logInfo(EventRegister, Fields{"nick": c.nickname(), "user": c.Username, "host": c.Host, "account": c.account}, "%s registered", c.nickname())
+	s.introduceUser(c)
+	s.welcome(c)
+}
+
+// welcome sends the registration burst.
+func (s *Server) welcome(c *Client) {
+	cfg := s.config()
+	nick := c.nick()
+	s.numeric(c, rplWelcome, fmt.Sprintf("Welcome to the %s IRC Network %s", cfg.NetworkName, nick))
+	s.numeric(c, rplYourHost, fmt.Sprintf("Your host is %s, running version %s", cfg.ServerName, Version))
+	s.numeric(c, rplCreated, "This server was created "+s.created.Format(time.RFC1123))
+	s.numeric(c, rplMyInfo, myInfoParams(cfg)...)
+	s.sendISupport(c)
+	s.handleLusers(c)
+	s.handleMOTD(c)
+	s.deliverMemos(c)
+}
+
+// myInfoParams returns the RPL_MYINFO parameters. The channel mode list is
+// omitted while the server implements no channel modes.
+func myInfoParams(cfg Config) []string {
+	params := []string{cfg.ServerName, Version, userModes}
+	var modes strings.Builder
+	for _, m := range memberModes {
+		modes.WriteByte(m.mode)
+	}
+	for _, group := range chanModes {
+		modes.WriteString(group)
+	}
+	if modes.Len() > 0 {
+		params = append(params, modes.String())
+	}
+	return params
+}
+
+// peers returns c together with every client sharing a channel with it.
+func (s *Server) peers(c *Client) map[*Client]bool {
+	peers := map[*Client]bool{c: true}
+	for _, key := range c.channelKeys() {
+		if ch := s.channels.get(key); ch != nil {
+			ch.mu.RLock()
+			for m := range ch.Members {
+				peers[m] = true
 			}
+			ch.mu.RUnlock()
 		}
-		s.mu.Unlock()
-		if recipient != nil {
-			s.broadcast(map[*Client]bool{recipient: true}, fmt.Sprintf(":%s PRIVMSG %s :%s\r\n", c.Nickname, target, body))
+	}
+	return peers
+}
+
+func (s *Server) joinChannel(c *Client, name string) {
+	cfg := s.config()
+	if !validChannel(name, cfg.ChannelLen) {
+		s.numeric(c, errBadChanMask, name, "Bad Channel Mask")
+		return
+	}
+	key := s.fold(name)
+	if c.onChannel(key) {
+		return
+	}
+	if c.channelCount() >= cfg.MaxChannels {
+		s.numeric(c, errTooManyChannels, name, "You have joined too many channels")
+		return
+	}
+	ch, added := s.addMember(c, key, name, time.Now().Unix())
+	if !added {
+		return
+	}
+	ch.mu.RLock()
+	ts := ch.ts
+	members := make(map[*Client]bool, len(ch.Members))
+	for m := range ch.Members {
+		members[m] = true
+	}
+	ch.mu.RUnlock()
+	nick := c.nickname()
+	s.logInfo(EventJoin, Fields{"nick": nick, "channel": ch.Name}, "%s joined %s", nick, ch.Name)
+	s.logChannel(ch.Name, "join", nick, "", "")
+	s.emitJoin(JoinEvent{nick, ch.Name})
+	s.broadcast(members, fmt.Sprintf(":%s JOIN %s\r\n", nick, ch.Name))
+	s.propagate(nil, fmt.Sprintf(":%s JOIN %d %s", c.id, ts, ch.Name))
+	s.joinReadMarker(c, c.connections(), ch.Name)
+	s.sendTopic(c, ch.Name, false)
+	s.sendNames(c, ch.Name)
+	s.replayHistory(c, ch)
+}
+
+// partChannel takes c off a channel with PART. A reason stopped by a filter
+// is left out.
+func (s *Server) partChannel(c *Client, name, reason string) {
+	if reason != "" {
+		if text, ok := s.filterText(c, "PART", name, reason); ok {
+			reason = text
+		} else {
+			reason = ""
 		}
 	}
+	if !s.leaveChannel(c, name, reason) {
+		s.numeric(c, errNotOnChannel, name, "You're not on that channel")
+		return
+	}
+	s.propagate(nil, partLine(c.id, name, reason))
 }
 
-func (s *Server) broadcast(clients map[*Client]bool, msg string) {
-	if clients == nil {
+// partLine formats a PART of source from a channel.
+func partLine(source, name, reason string) string {
+	if reason == "" {
+		return fmt.Sprintf(":%s PART %s", source, name)
+	}
+	return fmt.Sprintf(":%s PART %s :%s", source, name, reason)
+}
+
+// leaveChannel removes c from a channel and tells the remaining members.
+// It reports whether c was on the channel.
+func (s *Server) leaveChannel(c *Client, name, reason string) bool {
+	ch, members, member := s.removeMember(c, s.fold(name))
+	if !member {
+		return false
+	}
+	name = ch.Name
+	delete(members, c)
+	nick := c.nickname()
+	s.logInfo(EventPart, Fields{"nick": nick, "channel": name}, "%s left %s", nick, name)
+	s.logChannel(name, "part", nick, "", reason)
+	s.emitPart(PartEvent{Nick: nick, Channel: name, Reason: reason})
+	s.broadcast(members, partLine(nick, name, reason))
+	return true
+}
+
+// handleMessage delivers PRIVMSG, NOTICE and TAGMSG to channels and users.
+// Client-only tags ("+name") travel with the message to recipients that
+// negotiated message-tags; TAGMSG is only delivered to those recipients.
+func (s *Server) handleMessage(c *Client, m *Message) {
+	tagmsg := m.Command == "TAGMSG"
+	if !tagmsg && (len(m.Params) < 2 || m.Params[1] == "") {
+		if m.Command == "PRIVMSG" {
+			s.numeric(c, errNoTextToSend, "No text to send")
+		}
+		return
+	}
+	clientTags, ok := clientOnlyTags(m.Tags)
+	if !ok {
+		s.numeric(c, errInputTooLong, "Input line was too long")
 		return
 	}
+	targets := strings.Split(m.Params[0], ",")
+	if len(targets) > s.config().MaxTargets {
+		s.numeric(c, errTooManyTargets, m.Params[0], "Too many targets")
+		return
+	}
+	text := ""
+	if !tagmsg {
+		if text, ok = s.filterText(c, m.Command, m.Params[0], m.Params[1]); !ok {
+			return
+		}
+	}
+	for _, target := range targets {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		tags := map[string]string{"msgid": newMsgID(), "time": now.Format(serverTimeFormat)}
+		for k, v := range clientTags {
+			tags[k] = v
+		}
+		if s.deliverMessage(c, nil, m.Command, target, text, tags) {
+			continue
+		}
+		if m.Command == "PRIVMSG" && !strings.HasPrefix(target, "#") {
+			item := HistoryItem{Time: now, MsgID: tags["msgid"], Source: c.nickname(), Command: m.Command, Target: target, Text: text, Tags: clientTags}
+			if !s.queueMemo(c, target, item) {
+				s.numeric(c, errNoSuchNick, target, "No such nick/channel")
+			}
+		}
+	}
+}
 
-	s.mu.Lock()
-	recips := make([]*Client, 0, len(clients))
-	for c := range clients {
-		recips = append(recips, c)
+// deliverMessage delivers a message from c to the local recipients of one
+// target, passes it on to the linked servers that need it and records it in
+// history. source is the link the message arrived on, nil for messages from
+// local users, whose own connections may see it too. Users on other servers
+// are addressed by UID. It reports false if the target does not exist.
+func (s *Server) deliverMessage(c, source *Client, command, target, text string, tags map[string]string) bool {
+	var recips map[*Client]bool
+	var route *Client
+	key, linkTarget, everywhere := "", target, false
+	chanName := ""
+	if strings.HasPrefix(target, "#") {
+		ch := s.channels.get(s.fold(target))
+		if ch == nil {
+			return false
+		}
+		key, everywhere = s.historyKey(ch.Name), true
+		chanName = ch.Name
+		recips = ch.members()
+	} else {
+		s.mu.RLock()
+		recipient := s.nicks.get(s.fold(target))
+		if source != nil {
+			recipient = s.uids[target]
+		}
+		if recipient == nil {
+			s.mu.RUnlock()
+			return false
+		}
+		if source != nil {
+			target = recipient.nickname()
+		}
+		recips = map[*Client]bool{recipient: true}
+		key = dmHistoryKey(s.dmSide(c), s.dmSide(recipient))
+		route, linkTarget = recipient.via, recipient.id
+		s.mu.RUnlock()
+	}
+	if source == nil {
+		// relay decides which of the sender's connections see it.
+		recips[c] = true
 	}
-	s.mu.Unlock()
 
-	for _, c := range recips {
-		c.Conn.Write([]byte(msg))
+	tagmsg := command == "TAGMSG"
+	line := fmt.Sprintf(":%s %s %s", c.nickname(), command, target)
+	linkLine := formatTags(tags) + fmt.Sprintf(":%s %s %s", c.id, command, linkTarget)
+	if !tagmsg {
+		line += " :" + text
+		linkLine += " :" + text
+	}
+	switch {
+	case everywhere:
+		s.propagate(source, linkLine)
+	case route != nil && route != source:
+		route.sendLink(linkLine)
+	}
+	s.relay(c, recips, tags, line, tagmsg)
+	if tagmsg {
+		return true
 	}
+	now, err := time.Parse(serverTimeFormat, tags["time"])
+	if err != nil {
+		now = time.Now().UTC().Truncate(time.Millisecond)
+	}
+	if everywhere {
+		typ := "message"
+		if command == "NOTICE" {
+			typ = "notice"
+		}
+		s.writeChannelLog(chanLogEntry{Time: now, Channel: chanName, Type: typ, Nick: c.nickname(), Text: text})
+	}
+	clientTags, _ := clientOnlyTags(tags)
+	eventTarget := target
+	if everywhere {
+		eventTarget = chanName
+	}
+	s.emitMessage(MessageEvent{Time: now, Command: command, Nick: c.nickname(), Target: eventTarget, Text: text, Tags: clientTags})
+	s.markDelivered(recips, key, now)
+	s.storeHistory(key, HistoryItem{
+		Time:    now,
+		MsgID:   tags["msgid"],
+		Source:  c.nickname(),
+		Command: command,
+		Target:  target,
+		Text:    text,
+		Tags:    clientTags,
+	})
+	return true
 }
 
-// Close shuts down the server listener.
+// broadcast sends msg to clients, a set owned by the caller such as a copy
+// of the members of a channel.
+func (s *Server) broadcast(clients map[*Client]bool, msg string) {
+	for c := range clients {
+		c.send(msg)
+	}
+}
+
+// Close shuts down the server listeners and writes a last snapshot.
 func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		s.saveSnapshot()
+	})
+	s.closeListeners()
+	if s.wsLn != nil {
+		s.wsLn.Close()
+	}
+	if s.metricsLn != nil {
+		s.metricsLn.Close()
+	}
+	if s.adminLn != nil {
+		s.adminLn.Close()
+	}
 	if s.ln != nil {
 		return s.ln.Close()
 	}
@@ -0,0 +1,297 @@
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshots
+//
+// State that outlives connections is written to Config.Snapshot.File so
+// that a restart, for an upgrade say, does not lose it: the creation time
+// and topic of channels, the K-lines and D-lines, the offline messages
+// waiting for accounts and the always-on sessions with their nicknames,
+// modes, channels and delivery markers. The file is replaced atomically,
+// so a crash while writing leaves the previous snapshot in place.
+//
+// Channel modes and list modes such as bans are not saved because the
+// server has none yet: chanModes is empty. Accounts are not saved either;
+// they come from the configuration file.
+//
+// On startup sessions rejoin their channels straight away. Other channels
+// take their old creation time and topic back when the first user joins
+// them.
+
+// snapshotVersion is the version of the snapshot format.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version  int                      `json:"version"`
+	Time     time.Time                `json:"time"`
+	Channels []snapshotChannel        `json:"channels"`
+	Sessions []snapshotSession        `json:"sessions"`
+	Memos    map[string][]HistoryItem `json:"memos,omitempty"`
+	Bans     banList                  `json:"bans"`
+}
+
+type snapshotChannel struct {
+	Name    string    `json:"name"`
+	Created int64     `json:"created"`
+	Topic   string    `json:"topic,omitempty"`
+	TopicBy string    `json:"topic_by,omitempty"`
+	TopicAt time.Time `json:"topic_at,omitempty"`
+}
+
+type snapshotSession struct {
+	Account  string   `json:"account"`
+	Nick     string   `json:"nick"`
+	User     string   `json:"user"`
+	Realname string   `json:"realname"`
+	Host     string   `json:"host"`
+	Modes    string   `json:"modes"`
+	Channels []string `json:"channels"`
+	// Delivered holds the delivery markers by history key.
+	Delivered  map[string]time.Time `json:"delivered,omitempty"`
+	DetachedAt time.Time            `json:"detached_at,omitempty"`
+}
+
+// snapshot collects the state to save.
+func (s *Server) snapshot() snapshot {
+	snap := snapshot{Version: snapshotVersion, Time: time.Now().UTC()}
+	seen := make(map[string]bool)
+	for _, ch := range s.channels.all() {
+		ch.mu.RLock()
+		snap.Channels = append(snap.Channels, snapshotChannel{
+			Name: ch.Name, Created: ch.ts, Topic: ch.topic, TopicBy: ch.topicBy, TopicAt: ch.topicAt,
+		})
+		ch.mu.RUnlock()
+		seen[s.fold(ch.Name)] = true
+	}
+	s.restoredMu.Lock()
+	for key, ch := range s.restored {
+		if !seen[key] {
+			snap.Channels = append(snap.Channels, ch)
+		}
+	}
+	s.restoredMu.Unlock()
+	sort.Slice(snap.Channels, func(i, j int) bool { return snap.Channels[i].Name < snap.Channels[j].Name })
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.sessions {
+		sess := snapshotSession{
+			Account: u.account, Nick: u.nickname(), User: u.Username, Realname: u.Realname, Host: u.Host,
+			Modes: modeString(u.modes), Channels: s.channelNames(u),
+			Delivered: make(map[string]time.Time, len(u.delivered)), DetachedAt: u.detachedAt,
+		}
+		for key, t := range u.delivered {
+			sess.Delivered[key] = t
+		}
+		snap.Sessions = append(snap.Sessions, sess)
+	}
+	sort.Slice(snap.Sessions, func(i, j int) bool { return snap.Sessions[i].Account < snap.Sessions[j].Account })
+	if len(s.memos) > 0 {
+		snap.Memos = make(map[string][]HistoryItem, len(s.memos))
+		for key, items := range s.memos {
+			snap.Memos[key] = append([]HistoryItem(nil), items...)
+		}
+	}
+	now := time.Now()
+	snap.Bans = banList{KLines: activeBans(s.bans.KLines, now), DLines: activeBans(s.bans.DLines, now)}
+	return snap
+}
+
+// saveSnapshot writes the snapshot file, if one is configured. Failures are
+// logged as well as returned.
+func (s *Server) saveSnapshot() error {
+	path := s.config().Snapshot.File
+	if path == "" {
+		return nil
+	}
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	snap := s.snapshot()
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		s.logError(EventServer, Fields{"file": path, "error": err.Error()}, "saving snapshot failed: %v", err)
+		return err
+	}
+	s.logDebug(EventServer, Fields{"file": path, "channels": len(snap.Channels), "sessions": len(snap.Sessions)}, "Snapshot written to %s", path)
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data. The data goes to a
+// temporary file in the same directory, which is synced and then renamed
+// over path, so that path holds either its old or its new contents
+// whenever the process stops.
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	// Make the rename itself durable where directories can be synced.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// loadSnapshot reads the snapshot file at path. A missing file holds an
+// empty snapshot.
+func loadSnapshot(path string) (snapshot, error) {
+	var snap snapshot
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, err
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, err
+	}
+	if snap.Version != snapshotVersion {
+		return snapshot{}, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	return snap, nil
+}
+
+// restoreSnapshot brings back the state saved in the snapshot file. It is
+// called by NewServerWithConfig, before the server accepts connections.
+func (s *Server) restoreSnapshot() {
+	cfg := s.config()
+	path := cfg.Snapshot.File
+	if path == "" {
+		return
+	}
+	snap, err := loadSnapshot(path)
+	if err != nil {
+		s.logError(EventServer, Fields{"file": path, "error": err.Error()}, "failed to load snapshot: %v", err)
+		return
+	}
+	if snap.Time.IsZero() {
+		return
+	}
+
+	s.restoredMu.Lock()
+	for _, ch := range snap.Channels {
+		if validChannel(ch.Name, len(ch.Name)) {
+			s.restored[s.fold(ch.Name)] = ch
+		}
+	}
+	s.restoredMu.Unlock()
+
+	s.mu.Lock()
+	if cfg.BansFile == "" {
+		// The bans file, when there is one, is kept up to date on its own.
+		s.bans = snap.Bans
+		s.bans.parseDLines()
+	}
+	for key, items := range snap.Memos {
+		s.memos[key] = items
+	}
+	var sessions []*Client
+	var channels [][]string
+	for _, sess := range snap.Sessions {
+		acct, ok := s.account(sess.Account)
+		if !ok || !acct.AlwaysOn || !validNick(sess.Nick, cfg.NickLen) || s.nicks.get(s.fold(sess.Nick)) != nil {
+			continue
+		}
+		u := newSession(acct.Name, sess.Nick, sess.User, sess.Realname, sess.Host)
+		// Operator status has to be regained with OPER.
+		for _, m := range strings.TrimPrefix(sess.Modes, "+") {
+			if m != 'o' {
+				u.setMode(byte(m), true)
+			}
+		}
+		for key, t := range sess.Delivered {
+			u.delivered[key] = t
+		}
+		// The connections attached at the time of the snapshot are gone.
+		u.detachedAt = sess.DetachedAt
+		if u.detachedAt.IsZero() {
+			u.detachedAt = snap.Time
+		}
+		s.sessions[s.fold(acct.Name)] = u
+		s.nicks.set(s.fold(u.nickname()), u)
+		sessions = append(sessions, u)
+		channels = append(channels, sess.Channels)
+	}
+	s.mu.Unlock()
+
+	for i, u := range sessions {
+		s.introduceUser(u)
+		for _, name := range channels[i] {
+			if validChannel(name, len(name)) {
+				s.addMember(u, s.fold(name), name, time.Now().Unix())
+			}
+		}
+	}
+	s.logInfo(EventServer, Fields{"file": path, "channels": len(snap.Channels), "sessions": len(sessions)},
+		"Restored %d channels and %d sessions from %s", len(snap.Channels), len(sessions), path)
+}
+
+// newChannel returns a new channel called name, with the creation time and
+// topic it had before the restart if the snapshot holds it. It is called
+// with the shard of key locked.
+func (s *Server) newChannel(key, name string, ts int64) *Channel {
+	ch := &Channel{Name: name, Members: make(map[*Client]bool), ts: ts}
+	s.restoredMu.Lock()
+	saved, ok := s.restored[key]
+	delete(s.restored, key)
+	s.restoredMu.Unlock()
+	if ok {
+		ch.Name = saved.Name
+		if saved.Created < ts {
+			ch.ts = saved.Created
+		}
+		ch.topic, ch.topicBy, ch.topicAt = saved.Topic, saved.TopicBy, saved.TopicAt
+	}
+	return ch
+}
+
+// snapshotLoop saves a snapshot every interval until the server is closed.
+func (s *Server) snapshotLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			s.saveSnapshot()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package irc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	cfg := accountConfig(AccountConfig{Name: "alice", Password: "secret", AlwaysOn: true}, AccountConfig{Name: "carol", Password: "pw"})
+	cfg.Snapshot.File = filepath.Join(t.TempDir(), "state.json")
+	s := startServer(t, cfg)
+	alice := loginAccount(t, s, "alice", "alice", "secret")
+	alice.Join("#keep")
+	readUntil(t, alice, " 366 alice #keep ")
+	alice.Send("TOPIC #keep :kept topic")
+	readUntil(t, alice, "TOPIC #keep :kept topic")
+	bob := login(t, s, "bob")
+	bob.Join("#Quiet")
+	readUntil(t, bob, " 366 bob #Quiet ")
+	bob.Send("TOPIC #quiet :quiet topic")
+	readUntil(t, bob, "TOPIC #Quiet :quiet topic")
+	bob.Msg("carol", "see you later")
+	readUntil(t, bob, "carol is offline")
+	s.placeBan(false, ban{Mask: "*@banned.example", Reason: "go away", SetBy: "test", Set: time.Now()})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = startServer(t, cfg)
+	s.mu.Lock()
+	u := s.sessions["alice"]
+	klines, memos := len(s.bans.KLines), len(s.memos["carol"])
+	s.mu.Unlock()
+	if u == nil || u.Nickname != "alice" || !u.onChannel("#keep") {
+		t.Fatalf("session of alice not restored: %+v", u)
+	}
+	if klines != 1 || memos != 1 {
+		t.Errorf("restored %d K-lines and %d memos", klines, memos)
+	}
+
+	dave := login(t, s, "dave")
+	dave.Join("#keep")
+	readUntil(t, dave, " 332 dave #keep :kept topic")
+	if line := readUntil(t, dave, " 353 "); !strings.Contains(line, "alice") {
+		t.Errorf("alice missing from #keep: %q", line)
+	}
+	dave.Join("#quiet")
+	readUntil(t, dave, ":dave JOIN #Quiet")
+	readUntil(t, dave, " 332 dave #Quiet :quiet topic")
+
+	alice = loginAccount(t, s, "alice", "alice", "secret")
+	readUntil(t, alice, ":alice JOIN #keep")
+	carol := loginAccount(t, s, "carol", "carol", "pw")
+	readUntil(t, carol, ":bob PRIVMSG carol :see you later")
+}
+
+func TestSnapshotPeriodic(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Snapshot = SnapshotConfig{File: filepath.Join(t.TempDir(), "state.json"), Interval: Duration(20 * time.Millisecond)}
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	alice.Join("#chat")
+	readUntil(t, alice, " 366 ")
+	alice.Send("TOPIC #chat :saved")
+	readUntil(t, alice, "TOPIC #chat :saved")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		snap, err := loadSnapshot(cfg.Snapshot.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snap.Channels) == 1 && snap.Channels[0].Topic == "saved" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot = %+v", snap)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, err := os.ReadDir(filepath.Dir(cfg.Snapshot.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestSnapshotLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	snap, err := loadSnapshot(filepath.Join(dir, "missing.json"))
+	if err != nil || !snap.Time.IsZero() {
+		t.Errorf("missing file: %+v, %v", snap, err)
+	}
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte(`{"version": 1, "channels": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSnapshot(path); err == nil {
+		t.Error("truncated snapshot loaded")
+	}
+	if err := os.WriteFile(path, []byte(`{"version": 99}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSnapshot(path); err == nil {
+		t.Error("snapshot of an unknown version loaded")
+	}
+
+	if err := writeFileAtomic(path, []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "replaced" {
+		t.Errorf("file = %q", data)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "state.json"), []byte("new")); err == nil {
+		t.Error("write into a missing directory succeeded")
+	}
+}
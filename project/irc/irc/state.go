@@ -0,0 +1,297 @@
+package irc
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Server state
+//
+// Channels and nicknames live in indexes split into shards with a lock
+// each, so that looking up a channel or nick never waits on the server
+// lock or on unrelated names. Every Channel has a lock of its own guarding
+// its members and topic, and every Client one guarding the set of channels
+// it is on, so joins, parts and messages on different channels run in
+// parallel.
+//
+// Locks are taken in this order: s.mu, a channel shard, Channel.mu,
+// Client.chanMu. Nothing is locked while holding a nick shard or
+// s.restoredMu. Nick changes still hold s.mu, which guards the nicknames
+// and modes of clients; nickname reads a copy of the nickname that needs
+// no lock.
+
+const stateShards = 64
+
+// shardOf returns the shard holding key.
+func shardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % stateShards)
+}
+
+// channelIndex maps casefolded names to channels.
+type channelIndex struct {
+	shards [stateShards]struct {
+		mu sync.RWMutex
+		m  map[string]*Channel
+	}
+}
+
+func newChannelIndex() *channelIndex {
+	x := &channelIndex{}
+	for i := range x.shards {
+		x.shards[i].m = make(map[string]*Channel)
+	}
+	return x
+}
+
+// get returns the channel key, nil if it does not exist.
+func (x *channelIndex) get(key string) *Channel {
+	sh := &x.shards[shardOf(key)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.m[key]
+}
+
+// getOrCreate returns the channel key, adding the one returned by create if
+// it does not exist.
+func (x *channelIndex) getOrCreate(key string, create func() *Channel) *Channel {
+	sh := &x.shards[shardOf(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	ch := sh.m[key]
+	if ch == nil {
+		ch = create()
+		sh.m[key] = ch
+	}
+	return ch
+}
+
+// removeIfEmpty drops ch from the index if nobody is on it. A removed
+// channel is marked dead so that a join racing with the removal retries
+// with a new channel.
+func (x *channelIndex) removeIfEmpty(key string, ch *Channel) {
+	sh := &x.shards[shardOf(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if len(ch.Members) == 0 && !ch.dead && sh.m[key] == ch {
+		ch.dead = true
+		delete(sh.m, key)
+	}
+}
+
+// len returns the number of channels.
+func (x *channelIndex) len() int {
+	n := 0
+	for i := range x.shards {
+		sh := &x.shards[i]
+		sh.mu.RLock()
+		n += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// all returns every channel.
+func (x *channelIndex) all() []*Channel {
+	var chans []*Channel
+	for i := range x.shards {
+		sh := &x.shards[i]
+		sh.mu.RLock()
+		for _, ch := range sh.m {
+			chans = append(chans, ch)
+		}
+		sh.mu.RUnlock()
+	}
+	return chans
+}
+
+// nickIndex maps casefolded nicknames to users.
+type nickIndex struct {
+	shards [stateShards]struct {
+		mu sync.RWMutex
+		m  map[string]*Client
+	}
+}
+
+func newNickIndex() *nickIndex {
+	x := &nickIndex{}
+	for i := range x.shards {
+		x.shards[i].m = make(map[string]*Client)
+	}
+	return x
+}
+
+// get returns the user holding the nick key, nil if there is none.
+func (x *nickIndex) get(key string) *Client {
+	sh := &x.shards[shardOf(key)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.m[key]
+}
+
+// set gives the nick key to c.
+func (x *nickIndex) set(key string, c *Client) {
+	sh := &x.shards[shardOf(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.m[key] = c
+}
+
+// deleteIf frees the nick key if c holds it.
+func (x *nickIndex) deleteIf(key string, c *Client) {
+	sh := &x.shards[shardOf(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.m[key] == c {
+		delete(sh.m, key)
+	}
+}
+
+// len returns the number of nicks in use.
+func (x *nickIndex) len() int {
+	n := 0
+	for i := range x.shards {
+		sh := &x.shards[i]
+		sh.mu.RLock()
+		n += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// all returns every user holding a nick.
+func (x *nickIndex) all() []*Client {
+	var users []*Client
+	for i := range x.shards {
+		sh := &x.shards[i]
+		sh.mu.RLock()
+		for _, c := range sh.m {
+			users = append(users, c)
+		}
+		sh.mu.RUnlock()
+	}
+	return users
+}
+
+// nickname returns the nickname of c. Unlike the Nickname field it may be
+// read without holding s.mu.
+func (c *Client) nickname() string {
+	if nick := c.curNick.Load(); nick != nil {
+		return *nick
+	}
+	return ""
+}
+
+// setNick changes the nickname of c. The caller must hold s.mu once c is
+// known to the server.
+func (c *Client) setNick(nick string) {
+	c.Nickname = nick
+	c.curNick.Store(&nick)
+}
+
+// members returns a copy of the members of ch.
+func (ch *Channel) members() map[*Client]bool {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	members := make(map[*Client]bool, len(ch.Members))
+	for m := range ch.Members {
+		members[m] = true
+	}
+	return members
+}
+
+// has reports whether c is on ch.
+func (ch *Channel) has(c *Client) bool {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.Members[c]
+}
+
+// channelKeys returns the casefolded names of the channels c is on.
+func (c *Client) channelKeys() []string {
+	c.chanMu.Lock()
+	defer c.chanMu.Unlock()
+	keys := make([]string, 0, len(c.Channels))
+	for key := range c.Channels {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// onChannel reports whether c is on the channel key.
+func (c *Client) onChannel(key string) bool {
+	c.chanMu.Lock()
+	defer c.chanMu.Unlock()
+	return c.Channels[key]
+}
+
+// channelCount returns the number of channels c is on.
+func (c *Client) channelCount() int {
+	c.chanMu.Lock()
+	defer c.chanMu.Unlock()
+	return len(c.Channels)
+}
+
+// addMember puts c on the channel key, creating it as name with creation
+// time ts if it does not exist. An existing channel keeps the older of its
+// creation time and ts. added is false if c was already on the channel or
+// has been removed from the server.
+func (s *Server) addMember(c *Client, key, name string, ts int64) (ch *Channel, added bool) {
+	for {
+		ch = s.channels.getOrCreate(key, func() *Channel {
+			return s.newChannel(key, name, ts)
+		})
+		ch.mu.Lock()
+		if ch.dead {
+			ch.mu.Unlock()
+			continue
+		}
+		if ts < ch.ts {
+			ch.ts = ts
+		}
+		c.chanMu.Lock()
+		if !c.gone && !c.Channels[key] {
+			if c.Channels == nil {
+				c.Channels = make(map[string]bool)
+			}
+			ch.Members[c] = true
+			c.Channels[key] = true
+			added = true
+		}
+		c.chanMu.Unlock()
+		ch.mu.Unlock()
+		if !added {
+			s.channels.removeIfEmpty(key, ch)
+		}
+		return ch, added
+	}
+}
+
+// removeMember takes c off the channel key, removing the channel once it
+// is empty. It returns the channel, nil if it does not exist, the members
+// it had before and whether c was one of them.
+func (s *Server) removeMember(c *Client, key string) (ch *Channel, members map[*Client]bool, member bool) {
+	ch = s.channels.get(key)
+	if ch == nil {
+		c.chanMu.Lock()
+		delete(c.Channels, key)
+		c.chanMu.Unlock()
+		return nil, nil, false
+	}
+	ch.mu.Lock()
+	members = make(map[*Client]bool, len(ch.Members))
+	for m := range ch.Members {
+		members[m] = true
+	}
+	member = ch.Members[c]
+	delete(ch.Members, c)
+	c.chanMu.Lock()
+	delete(c.Channels, key)
+	c.chanMu.Unlock()
+	ch.mu.Unlock()
+	s.channels.removeIfEmpty(key, ch)
+	return ch, members, member
+}
@@ -0,0 +1,201 @@
+package irc
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// checkState verifies that the channel and nick indexes agree with the
+// clients in them.
+func checkState(t *testing.T, s *Server) {
+	t.Helper()
+	for _, ch := range s.channels.all() {
+		key := s.fold(ch.Name)
+		ch.mu.RLock()
+		if len(ch.Members) == 0 || ch.dead {
+			t.Errorf("%s: %d members, dead %v", ch.Name, len(ch.Members), ch.dead)
+		}
+		for m := range ch.Members {
+			if !m.onChannel(key) {
+				t.Errorf("%s is on %s but does not know it", m.Nickname, ch.Name)
+			}
+		}
+		ch.mu.RUnlock()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.nicks.all() {
+		if s.nicks.get(s.fold(u.Nickname)) != u {
+			t.Errorf("%s is not indexed under its nick", u.Nickname)
+		}
+		for _, key := range u.channelKeys() {
+			if ch := s.channels.get(key); ch == nil || !ch.has(u) {
+				t.Errorf("%s thinks it is on %s", u.Nickname, key)
+			}
+		}
+	}
+}
+
+// TestStateStress has bots join, part, talk, change nicks, set topics,
+// quit and get kicked concurrently while others read the state, then
+// checks that it is consistent. Run it with -race.
+func TestStateStress(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	const workers, rounds, channels = 16, 150, 4
+	observer, err := s.NewBot("observer", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			ch := fmt.Sprintf("#stress%d", i%channels)
+			observer.Send("NAMES " + ch)
+			observer.Send("WHO " + ch)
+			observer.Send("WHOIS stress0")
+			observer.Send("LUSERS")
+			if u := s.nicks.get(s.fold(fmt.Sprintf("stress%d", i%workers))); u != nil {
+				s.kick(s.config().ServerName, ch, u, "stress")
+			}
+			if i%20 == 0 {
+				s.Rehash(s.config())
+			}
+		}
+	}()
+
+	var workersWG sync.WaitGroup
+	bots := make([]*Bot, workers)
+	for w := 0; w < workers; w++ {
+		workersWG.Add(1)
+		go func(w int) {
+			defer workersWG.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			nick := fmt.Sprintf("stress%d", w)
+			b, err := s.NewBot(nick, "", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 0; i < rounds; i++ {
+				ch := fmt.Sprintf("#stress%d", rng.Intn(channels))
+				switch rng.Intn(7) {
+				case 0, 1:
+					b.Join(ch)
+				case 2:
+					b.Part(ch)
+				case 3:
+					b.Msg(ch, "hello")
+				case 4:
+					b.Send(fmt.Sprintf("TOPIC %s :topic %d", ch, i))
+				case 5:
+					if b.Nick() == nick {
+						b.Send(fmt.Sprintf("NICK %s_%d", nick, i))
+					} else {
+						b.Send("NICK " + nick)
+					}
+				case 6:
+					b.Quit("bye")
+					<-b.Done()
+					if b, err = s.NewBot(nick, "", nil); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+			bots[w] = b
+		}(w)
+	}
+	workersWG.Wait()
+	stop.Store(true)
+	wg.Wait()
+	checkState(t, s)
+
+	for _, b := range bots {
+		if b != nil {
+			b.Quit("done")
+			<-b.Done()
+		}
+	}
+	observer.Quit("done")
+	<-observer.Done()
+	checkState(t, s)
+	if n := s.channels.len(); n != 0 {
+		t.Errorf("%d channels left after everyone quit", n)
+	}
+	if n := s.nicks.len(); n != 0 {
+		t.Errorf("%d nicks left after everyone quit", n)
+	}
+}
+
+// TestJoinRacesQuit checks that a user quitting while joining channels is
+// left on none of them.
+func TestJoinRacesQuit(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	for i := 0; i < 50; i++ {
+		b, err := s.NewBot("racer", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := b.c
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 10; j++ {
+				s.joinChannel(c, fmt.Sprintf("#race%d", j))
+			}
+		}()
+		b.conn.Close()
+		<-b.Done()
+		<-done
+		if n := c.channelCount(); n != 0 {
+			t.Fatalf("removed user is on %d channels", n)
+		}
+	}
+	checkState(t, s)
+	if n := s.channels.len(); n != 0 {
+		t.Errorf("%d channels left", n)
+	}
+}
+
+// BenchmarkChannelMessages measures message delivery with thousands of
+// bots spread over channels, all talking at once.
+func BenchmarkChannelMessages(b *testing.B) {
+	const users, perChannel = 5000, 25
+	cfg := DefaultConfig()
+	cfg.MaxChannels = 2
+	s := NewServerWithConfig(":0", cfg)
+	s.SetLogSink(LogSinkFunc(func(Event) {}))
+	bots := make([]*Bot, users)
+	for i := range bots {
+		bot, err := s.NewBot(fmt.Sprintf("bench%d", i), "", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bot.Join(fmt.Sprintf("#bench%d", i/perChannel))
+		bots[i] = bot
+	}
+	defer func() {
+		for _, bot := range bots {
+			bot.Quit("done")
+			<-bot.Done()
+		}
+	}()
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(1)) * 7919 % users
+		for pb.Next() {
+			bot := bots[i]
+			bot.Msg(fmt.Sprintf("#bench%d", i/perChannel), "hello everyone")
+			i = (i + 1) % users
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+)
+
+// maxClientTagsLen is the size limit for the client-only tags of a single
+// message, as set by the message-tags specification.
+const maxClientTagsLen = 4094
+
+// serverTimeFormat is the layout of the time tag.
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+var msgidEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newMsgID returns a random identifier for the msgid tag.
+func newMsgID() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+	return strings.ToLower(msgidEncoding.EncodeToString(b))
+}
+
+// clientOnlyTags returns the client-only tags ("+name") of tags. It reports
+// false if they exceed maxClientTagsLen.
+func clientOnlyTags(tags map[string]string) (map[string]string, bool) {
+	var out map[string]string
+	size := 0
+	for k, v := range tags {
+		if !strings.HasPrefix(k, "+") {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string)
+		}
+		out[k] = v
+		size += len(k) + len(escapeTagValue(v)) + 2
+	}
+	return out, size <= maxClientTagsLen
+}
+
+// tagsFor filters tags down to what c negotiated: everything with
+// message-tags, only the time tag with server-time, nothing otherwise. The
+// caller must hold s.mu.
+func tagsFor(c *Client, tags map[string]string) map[string]string {
+	switch {
+	case c.hasCap("message-tags"):
+		return tags
+	case c.hasCap("server-time"):
+		return map[string]string{"time": tags["time"]}
+	}
+	return nil
+}
+
+// relay sends a message originating from the client from to recips.
+// Recipients see the tags their capabilities allow. The connection the
+// message came from only gets it back with echo-message, and a TAGMSG only
+// reaches connections that negotiated message-tags.
+func (s *Server) relay(from *Client, recips map[*Client]bool, tags map[string]string, line string, tagmsg bool) {
+	if recips == nil {
+		return
+	}
+	origin := from.current()
+	s.mu.RLock()
+	if from.hasMode('B') {
+		tags["bot"] = ""
+	}
+	out := make(map[*Client]string, len(recips))
+	for c := range recips {
+		for _, conn := range c.connections() {
+			if conn == origin && !conn.hasCap("echo-message") || tagmsg && !conn.hasCap("message-tags") {
+				continue
+			}
+			out[conn] = formatTags(tagsFor(conn, tags)) + line
+		}
+	}
+	s.mu.RUnlock()
+
+	for c, l := range out {
+		c.send(l)
+	}
+}
@@ -0,0 +1,82 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServerTimeAndMsgid(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	carol := login(t, s, "carol")
+
+	alice.Send("CAP REQ :message-tags server-time echo-message")
+	readUntil(t, alice, "ACK")
+	carol.Send("CAP REQ :server-time")
+	readUntil(t, carol, "ACK")
+	alice.Join("#room")
+	readUntil(t, alice, " 366 alice #room ")
+	bob.Join("#room")
+	readUntil(t, bob, " 366 bob #room ")
+	carol.Join("#room")
+	readUntil(t, carol, " 366 carol #room ")
+
+	alice.Msg("#room", "hello")
+	echo := readUntil(t, alice, "PRIVMSG #room :hello")
+	m, err := ParseMessage(strings.TrimSpace(echo))
+	if err != nil || m.Tags["msgid"] == "" || m.Tags["time"] == "" {
+		t.Fatalf("echo missing tags: %q", echo)
+	}
+	if line := readUntil(t, bob, "PRIVMSG #room :hello"); strings.HasPrefix(line, "@") {
+		t.Errorf("tags sent to client without caps: %q", line)
+	}
+	line := readUntil(t, carol, "PRIVMSG #room :hello")
+	if !strings.HasPrefix(line, "@time="+m.Tags["time"]+" ") {
+		t.Errorf("expected only the time tag, got %q", line)
+	}
+}
+
+func TestNoEchoWithoutCap(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	alice.Join("#room")
+	readUntil(t, alice, " 366 alice #room ")
+
+	alice.Send("NOTICE #room :first")
+	alice.Send("PING :after")
+	line, err := alice.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, "PONG :after") {
+		t.Errorf("sender received its own message: %q", line)
+	}
+}
+
+func TestTagmsgRelaysClientTags(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	carol := login(t, s, "carol")
+	alice.Send("CAP REQ :message-tags")
+	readUntil(t, alice, "ACK")
+	carol.Send("CAP REQ :message-tags")
+	readUntil(t, carol, "ACK")
+
+	alice.Send("@+typing=active;+draft/reply=abc;label=x TAGMSG carol,bob")
+	line := readUntil(t, carol, "TAGMSG carol")
+	m, err := ParseMessage(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Tags["+typing"] != "active" || m.Tags["+draft/reply"] != "abc" || hasTag(m, "label") {
+		t.Errorf("unexpected tags %v", m.Tags)
+	}
+
+	// bob lacks message-tags and must not see the TAGMSG.
+	alice.Send("@+draft/react=👍 PRIVMSG bob :hi")
+	if line := readUntil(t, bob, ":alice "); !strings.HasPrefix(line, ":alice PRIVMSG bob :hi") {
+		t.Errorf("unexpected line %q", line)
+	}
+}
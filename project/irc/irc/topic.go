@@ -0,0 +1,106 @@
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// handleTopic implements TOPIC <channel> [:<topic>]. The server has no
+// channel operators, so every member may change the topic.
+func (s *Server) handleTopic(c *Client, params []string) {
+	if params[0] == "" {
+		s.numeric(c, errNeedMoreParams, "TOPIC", "Not enough parameters")
+		return
+	}
+	key := s.fold(params[0])
+	ch := s.channels.get(key)
+	member := c.onChannel(key)
+	if ch == nil {
+		s.numeric(c, errNoSuchChannel, params[0], "No such channel")
+		return
+	}
+	if len(params) < 2 {
+		s.sendTopic(c, ch.Name, true)
+		return
+	}
+	if !member {
+		s.numeric(c, errNotOnChannel, ch.Name, "You're not on that channel")
+		return
+	}
+	text, ok := s.filterText(c, "TOPIC", ch.Name, params[1])
+	if !ok {
+		return
+	}
+	text = truncateTopic(text, s.config().TopicLen)
+	at := time.Now()
+	by := fmt.Sprintf("%s!%s@%s", c.nickname(), c.Username, c.Host)
+	if s.setTopic(c.nickname(), ch.Name, text, by, at) && c.id != "" {
+		s.propagate(nil, topicLine(c.id, ch.Name, text, by, at))
+	}
+}
+
+// sendTopic sends c the topic of a channel with RPL_TOPIC and
+// RPL_TOPICWHOTIME. A channel without a topic is answered with RPL_NOTOPIC
+// if always is set and not at all otherwise.
+func (s *Server) sendTopic(c *Client, name string, always bool) {
+	ch := s.channels.get(s.fold(name))
+	var topic, by string
+	var at time.Time
+	if ch != nil {
+		ch.mu.RLock()
+		name, topic, by, at = ch.Name, ch.topic, ch.topicBy, ch.topicAt
+		ch.mu.RUnlock()
+	}
+	if topic == "" {
+		if always {
+			s.numeric(c, rplNoTopic, name, "No topic is set")
+		}
+		return
+	}
+	s.numeric(c, rplTopic, name, topic)
+	s.numeric(c, rplTopicWhoTime, name, by, strconv.FormatInt(at.Unix(), 10))
+}
+
+// setTopic sets the topic of a channel and shows the change to its members
+// as coming from source, a nick or server name. It reports whether the
+// channel exists.
+func (s *Server) setTopic(source, name, text, by string, at time.Time) bool {
+	ch := s.channels.get(s.fold(name))
+	if ch == nil {
+		return false
+	}
+	ch.mu.Lock()
+	changed := ch.topic != text
+	ch.topic, ch.topicBy, ch.topicAt = text, by, at
+	name = ch.Name
+	members := make(map[*Client]bool, len(ch.Members))
+	for m := range ch.Members {
+		members[m] = true
+	}
+	ch.mu.Unlock()
+	if changed {
+		s.logInfo(EventTopic, Fields{"by": by, "channel": name, "topic": text}, "%s changed the topic of %s to %q", by, name, text)
+		s.logChannel(name, "topic", source, "", text)
+		s.broadcast(members, fmt.Sprintf(":%s TOPIC %s :%s", source, name, text))
+	}
+	return true
+}
+
+// topicLine returns the TOPIC line telling linked servers about a topic.
+func topicLine(source, name, text, by string, at time.Time) string {
+	return fmt.Sprintf(":%s TOPIC %s %s %d :%s", source, name, by, at.Unix(), text)
+}
+
+// truncateTopic shortens a topic to at most n bytes without splitting a
+// UTF-8 sequence.
+func truncateTopic(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
@@ -0,0 +1,51 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTopic(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TopicLen = 10
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	alice.Join("#chat")
+	readUntil(t, alice, " 366 ")
+
+	alice.Send("TOPIC #chat")
+	readUntil(t, alice, " 331 alice #chat :No topic is set")
+	bob.Send("TOPIC #chat :hijack")
+	readUntil(t, bob, " 442 bob #chat :You're not on that channel")
+	bob.Send("TOPIC #nowhere")
+	readUntil(t, bob, " 403 bob #nowhere ")
+
+	alice.Send("TOPIC #chat :Welcome to the chat")
+	readUntil(t, alice, ":alice TOPIC #chat :Welcome to")
+	bob.Join("#chat")
+	readUntil(t, bob, " 332 bob #chat :Welcome to")
+	if line := readUntil(t, bob, " 333 bob #chat "); !strings.Contains(line, " alice!alice@") {
+		t.Errorf("topic setter missing: %q", line)
+	}
+	readUntil(t, bob, " 366 ")
+}
+
+func TestTopicCrossesLinks(t *testing.T) {
+	a := startLinked(t, "a.test")
+	b := startLinked(t, "b.test", "a.test")
+	alice := login(t, a, "alice")
+	alice.Join("#room")
+	readUntil(t, alice, " 366 ")
+	alice.Send("TOPIC #room :before the link")
+	readUntil(t, alice, "TOPIC #room")
+
+	link(t, a, b)
+	waitNick(t, b, "alice")
+	bob := login(t, b, "bob")
+	bob.Join("#room")
+	readUntil(t, bob, " 332 bob #room :before the link")
+	readUntil(t, bob, " 366 ")
+	bob.Send("TOPIC #room :changed on b")
+	readUntil(t, alice, ":bob TOPIC #room :changed on b")
+}
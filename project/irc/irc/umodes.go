@@ -0,0 +1,161 @@
+package irc
+
+import (
+	"crypto/tls"
+	"sort"
+	"strings"
+)
+
+// userModes lists the user modes implemented by the server.
+const userModes = "BZiorw"
+
+// User modes clients may set and unset on themselves. +o can only be
+// dropped, +r and +Z are maintained by the server.
+const (
+	selfSettableModes = "Biw"
+	selfUnsettable    = "Biow"
+)
+
+// modeString formats a set of user modes as "+abc".
+func modeString(modes map[byte]bool) string {
+	letters := make([]string, 0, len(modes))
+	for m, on := range modes {
+		if on {
+			letters = append(letters, string(m))
+		}
+	}
+	sort.Strings(letters)
+	return "+" + strings.Join(letters, "")
+}
+
+// hasMode reports whether c has the user mode m set. The caller must hold
+// s.mu when c belongs to another connection.
+func (c *Client) hasMode(m byte) bool {
+	return c.modes[m]
+}
+
+// setMode sets or clears a user mode. The caller must hold s.mu.
+func (c *Client) setMode(m byte, on bool) {
+	if c.modes == nil {
+		c.modes = make(map[byte]bool)
+	}
+	if on {
+		c.modes[m] = true
+	} else {
+		delete(c.modes, m)
+	}
+}
+
+// initialModes sets the modes a client receives on connect.
+func (c *Client) initialModes() {
+	if _, ok := c.Conn.(*tls.Conn); ok {
+		c.setMode('Z', true)
+	}
+}
+
+// handleMode dispatches MODE to the user or channel variant.
+func (s *Server) handleMode(c *Client, params []string) {
+	if params[0] == "" {
+		s.numeric(c, errNeedMoreParams, "MODE", "Not enough parameters")
+		return
+	}
+	if strings.ContainsRune(chanTypes, rune(params[0][0])) {
+		s.handleChannelMode(c, params)
+		return
+	}
+	s.handleUserMode(c, params)
+}
+
+func (s *Server) handleUserMode(c *Client, params []string) {
+	target := s.nicks.get(s.fold(params[0]))
+	if target == nil {
+		s.numeric(c, errNoSuchNick, params[0], "No such nick/channel")
+		return
+	}
+	if target != c {
+		s.numeric(c, errUsersDontMatch, "Cant change mode for other users")
+		return
+	}
+	if len(params) < 2 {
+		s.mu.Lock()
+		modes := modeString(c.modes)
+		s.mu.Unlock()
+		s.numeric(c, rplUModeIs, modes)
+		return
+	}
+
+	var applied strings.Builder
+	unknown := false
+	dir := byte(0)
+	s.mu.Lock()
+	for i := 0; i < len(params[1]); i++ {
+		m := params[1][i]
+		switch {
+		case m == '+' || m == '-':
+			dir = m
+			continue
+		case !strings.ContainsRune(userModes, rune(m)):
+			unknown = true
+			continue
+		}
+		on := dir != '-'
+		if on && !strings.ContainsRune(selfSettableModes, rune(m)) ||
+			!on && !strings.ContainsRune(selfUnsettable, rune(m)) ||
+			c.hasMode(m) == on {
+			continue
+		}
+		c.setMode(m, on)
+		if on {
+			applied.WriteString("+")
+		} else {
+			applied.WriteString("-")
+		}
+		applied.WriteByte(m)
+	}
+	s.mu.Unlock()
+	if unknown {
+		s.numeric(c, errUModeUnknownFlag, "Unknown MODE flag")
+	}
+	if applied.Len() > 0 {
+		changes := compactModes(applied.String())
+		s.logInfo(EventMode, Fields{"nick": c.nickname(), "modes": changes}, "%s set modes %s", c.nickname(), changes)
+		c.send(":" + c.nickname() + " MODE " + c.nickname() + " :" + changes)
+		s.propagateModes(c, changes)
+		s.emitMode(ModeEvent{c.nickname(), changes})
+	}
+}
+
+// compactModes merges runs of the same direction, turning "+i+w-B" into
+// "+iw-B".
+func compactModes(changes string) string {
+	var b strings.Builder
+	dir := byte(0)
+	for i := 0; i < len(changes); i += 2 {
+		if changes[i] != dir {
+			dir = changes[i]
+			b.WriteByte(dir)
+		}
+		b.WriteByte(changes[i+1])
+	}
+	return b.String()
+}
+
+// handleChannelMode answers mode queries on channels. The server implements
+// no channel modes, so every change is rejected.
+func (s *Server) handleChannelMode(c *Client, params []string) {
+	ch := s.channels.get(s.fold(params[0]))
+	if ch == nil {
+		s.numeric(c, errNoSuchChannel, params[0], "No such channel")
+		return
+	}
+	if len(params) < 2 {
+		s.numeric(c, rplChannelModeIs, ch.Name, "+")
+		return
+	}
+	for _, m := range params[1] {
+		if m != '+' && m != '-' {
+			s.numeric(c, errUnknownMode, string(m), "is unknown mode char to me")
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUserModeChanges(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	c := login(t, s, "alice")
+	login(t, s, "bob")
+
+	c.Send("MODE alice +iwo")
+	readUntil(t, c, ":alice MODE alice :+iw")
+	c.Send("MODE alice")
+	readUntil(t, c, " 221 alice :+iw")
+	c.Send("MODE alice -w+x")
+	readUntil(t, c, " 501 alice ")
+	readUntil(t, c, ":alice MODE alice :-w")
+	c.Send("MODE bob +i")
+	readUntil(t, c, " 502 alice ")
+}
+
+func TestOperSetsUserMode(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Opers = []OperConfig{{Name: "admin", Password: "secret"}}
+	s := startServer(t, cfg)
+	c := login(t, s, "alice")
+	bob := login(t, s, "bob")
+
+	c.Send("OPER admin secret")
+	readUntil(t, c, ":alice MODE alice :+o")
+	bob.Send("WHOIS alice")
+	readUntil(t, bob, " 313 bob alice ")
+	bob.Send("WHO alice")
+	if line := readUntil(t, bob, " 352 bob * alice "); !strings.Contains(line, " H* ") {
+		t.Errorf("unexpected WHO flags %q", line)
+	}
+}
+
+func TestInvisibleHiddenFromNonSharingUsers(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+
+	alice.Send("MODE alice +i")
+	readUntil(t, alice, "MODE alice :+i")
+	alice.Join("#secret")
+	readUntil(t, alice, " 366 alice #secret ")
+
+	bob.Send("NAMES #secret")
+	if line := readUntil(t, bob, " #secret "); !strings.Contains(line, " 366 ") {
+		t.Errorf("invisible user listed in NAMES: %q", line)
+	}
+	bob.Send("WHO alice")
+	if line := readUntil(t, bob, " alice "); !strings.Contains(line, " 315 ") {
+		t.Errorf("invisible user listed in WHO: %q", line)
+	}
+
+	bob.Join("#secret")
+	if line := readUntil(t, bob, " 353 bob "); !strings.Contains(line, "alice") {
+		t.Errorf("invisible user hidden from channel member: %q", line)
+	}
+}
+
+func TestBotModeTagsMessages(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	bot := login(t, s, "bot")
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+
+	alice.Send("CAP REQ :message-tags")
+	readUntil(t, alice, "CAP alice ACK :message-tags")
+	bot.Send("MODE bot +B")
+	readUntil(t, bot, "MODE bot :+B")
+
+	bot.Msg("alice", "beep")
+	line := readUntil(t, alice, "PRIVMSG alice")
+	if m, err := ParseMessage(strings.TrimSpace(line)); err != nil || !hasTag(m, "bot") {
+		t.Errorf("missing bot tag: %q", line)
+	}
+	bot.Msg("bob", "beep")
+	if line := readUntil(t, bob, "PRIVMSG bob"); strings.HasPrefix(line, "@") {
+		t.Errorf("tags sent without message-tags: %q", line)
+	}
+	alice.Send("WHOIS bot")
+	readUntil(t, alice, " 335 alice bot ")
+}
+
+func hasTag(m *Message, name string) bool {
+	_, ok := m.Tags[name]
+	return ok
+}
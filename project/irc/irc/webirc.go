@@ -0,0 +1,114 @@
+package irc
+
+import (
+	"crypto/subtle"
+	"net"
+	"strings"
+)
+
+// handleWebIRC implements WEBIRC, sent by trusted gateways before
+// registration to give the address of the user they connect for:
+//
+//	WEBIRC <password> <gateway> <hostname> <ip> [:<options>]
+//
+// The gateway must connect from an address listed for it and send its
+// password; anything else closes the connection. The "secure" option marks
+// the user's connection to the gateway as using TLS.
+func (s *Server) handleWebIRC(c *Client, params []string) {
+	if c.registered {
+		s.numeric(c, errAlreadyRegistered, "You may not reregister")
+		return
+	}
+	password, hostname, ipText := params[0], params[2], params[3]
+	ip := net.ParseIP(ipText)
+	s.mu.Lock()
+	gw, ok := s.gateway(c.ip, password)
+	already := c.gateway != ""
+	s.mu.Unlock()
+	switch {
+	case already:
+		s.quit(c, "WEBIRC may only be sent once")
+		return
+	case !ok:
+		s.logWarn(EventGateway, Fields{"host": c.Host}, "Refused WEBIRC from %s", c.Host)
+		s.quit(c, "WEBIRC authentication failed")
+		return
+	case ip == nil:
+		s.quit(c, "WEBIRC with invalid IP address")
+		return
+	}
+	ipText = ip.String()
+	if !validHostname(hostname) {
+		hostname = ipText
+	}
+	if strings.HasPrefix(hostname, ":") {
+		hostname = "0" + hostname
+	}
+	s.mu.Lock()
+	c.gateway = gw.Name
+	c.ip = ipText
+	c.Host = hostname
+	if len(params) > 4 {
+		for _, opt := range strings.Fields(params[4]) {
+			if opt == "secure" {
+				c.setMode('Z', true)
+			}
+		}
+	}
+	s.mu.Unlock()
+	s.logInfo(EventGateway, Fields{"gateway": gw.Name, "host": hostname, "ip": ipText}, "Gateway %s connects %s (%s)", gw.Name, hostname, ipText)
+}
+
+// gateway is a gateway from Config.Gateways with its hosts parsed.
+type gateway struct {
+	GatewayConfig
+	hosts []*net.IPNet
+}
+
+// reloadGateways parses the hosts of the gateways of the current
+// configuration. A gateway with an invalid host is left out. The caller
+// must hold s.mu.
+func (s *Server) reloadGateways() {
+	var gateways []gateway
+	for _, gw := range s.cfg.Load().Gateways {
+		hosts, err := parseCIDRs(gw.Hosts)
+		if err != nil {
+			s.logError(EventServer, Fields{"gateway": gw.Name, "error": err.Error()}, "gateway %s: %v", gw.Name, err)
+			continue
+		}
+		gateways = append(gateways, gateway{GatewayConfig: gw, hosts: hosts})
+	}
+	s.gateways = gateways
+}
+
+// gateway returns the WEBIRC gateway that may connect from ip with
+// password. The caller must hold s.mu.
+func (s *Server) gateway(ip, password string) (GatewayConfig, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return GatewayConfig{}, false
+	}
+	for _, gw := range s.gateways {
+		if ipInNets(addr, gw.hosts) && subtle.ConstantTimeCompare([]byte(gw.Password), []byte(password)) == 1 {
+			return gw.GatewayConfig, true
+		}
+	}
+	return GatewayConfig{}, false
+}
+
+// validHostname reports whether h may be used as a client's host.
+func validHostname(h string) bool {
+	if h == "" || len(h) > 63 {
+		return false
+	}
+	for i := 0; i < len(h); i++ {
+		c := h[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.' || c == '-' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+
+	ic "vibes/client"
+)
+
+func TestWebIRCReplacesHost(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Gateways = []GatewayConfig{
+		{Name: "elsewhere", Password: "secret", Hosts: []string{"192.0.2.0/24"}},
+		{Name: "webchat", Password: "secret", Hosts: []string{"127.0.0.1", "::1"}},
+	}
+	s := startServer(t, cfg)
+
+	c, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Send("WEBIRC secret webchat user.example.com 203.0.113.9 :secure")
+	if host := registeredHost(t, c, "webuser"); host != "user.example.com" {
+		t.Errorf("WEBIRC client has host %q", host)
+	}
+	c.Send("MODE webuser")
+	if line := readUntil(t, c, " 221 webuser "); !strings.Contains(line, "Z") {
+		t.Errorf("secure gateway connection not marked +Z: %q", line)
+	}
+	c.Send("WEBIRC secret webchat other.example.com 203.0.113.10")
+	readUntil(t, c, " 462 webuser ")
+
+	bad, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bad.Close() })
+	bad.Send("WEBIRC wrong webchat user.example.com 203.0.113.9")
+	readUntil(t, bad, "(WEBIRC authentication failed)")
+
+	invalid, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { invalid.Close() })
+	invalid.Send("WEBIRC secret webchat bad_host! 2001:db8::1")
+	if host := registeredHost(t, invalid, "v6user"); host != "2001:db8::1" {
+		t.Errorf("invalid hostname replaced by %q, want the IP", host)
+	}
+
+	cfg.Gateways = []GatewayConfig{{Name: "webchat", Password: "secret", Hosts: []string{"192.0.2.0/24"}}}
+	s.Rehash(cfg)
+	moved, err := ic.Connect(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { moved.Close() })
+	moved.Send("WEBIRC secret webchat user.example.com 203.0.113.9")
+	readUntil(t, moved, "(WEBIRC authentication failed)")
+}
@@ -0,0 +1,378 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket transport
+//
+// Browsers reach the server over WebSocket as described by the IRCv3
+// WebSocket specification. Every message carries one IRC line without the
+// CR LF. The text.ircv3.net subprotocol uses text frames, whose content
+// must be UTF-8; binary.ircv3.net uses binary frames and passes lines
+// through unchanged. Clients that ask for neither get text frames. A
+// WebSocket connection is wrapped in a net.Conn that turns messages back
+// into lines, so it is served exactly like a TCP connection.
+
+const (
+	wsTextProtocol   = "text.ircv3.net"
+	wsBinaryProtocol = "binary.ircv3.net"
+)
+
+// wsGUID is appended to the client key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWSMessage bounds the size of a message read from a client: a line with
+// the largest allowed tags, plus room for a CR LF the client may include.
+const maxWSMessage = maxTagsLen + maxLineLen + 2
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocket close codes.
+const (
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+	wsCloseInvalid  = 1007
+	wsCloseTooBig   = 1009
+)
+
+// wsError is a protocol violation by the client. It is reported to the
+// client with the close code.
+type wsError struct {
+	code   int
+	reason string
+}
+
+func (e *wsError) Error() string { return "websocket: " + e.reason }
+
+// wsConn carries IRC lines over a WebSocket connection.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	binary bool
+
+	// pending holds the part of the current line not yet returned by Read.
+	pending []byte
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+// serveWebSocket accepts WebSocket connections on ln until it is closed.
+func (s *Server) serveWebSocket(ln net.Listener) {
+	srv := &http.Server{Handler: http.HandlerFunc(s.handleWebSocket), ErrorLog: s.httpErrorLog("websocket")}
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logError(EventServer, Fields{"listener": "websocket", "error": err.Error()}, "websocket listener failed: %v", err)
+	}
+}
+
+// handleWebSocket upgrades an HTTP request to a WebSocket connection and
+// serves it as an IRC client.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket connections only", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if origin := r.Header.Get("Origin"); !s.originAllowed(origin, r.Host) {
+		s.logWarn(EventConnect, Fields{"remote": r.RemoteAddr, "origin": origin}, "Refused WebSocket connection from %s: origin %q not allowed", r.RemoteAddr, origin)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	protocol := ""
+	for _, p := range headerTokens(r.Header, "Sec-WebSocket-Protocol") {
+		if p == wsTextProtocol || p == wsBinaryProtocol {
+			protocol = p
+			break
+		}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		s.logError(EventServer, Fields{"listener": "websocket", "error": err.Error()}, "websocket hijack failed: %v", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	s.logInfo(EventConnect, Fields{"remote": conn.RemoteAddr().String(), "websocket": protocolName(protocol)}, "WebSocket client connected: %s (%s)", conn.RemoteAddr(), protocolName(protocol))
+	s.handleConn(&wsConn{Conn: conn, r: rw.Reader, binary: protocol == wsBinaryProtocol})
+}
+
+// originAllowed reports whether a browser page from origin may connect to
+// host. Without configured origins only pages served from host itself are
+// allowed. Requests without an Origin header do not come from browsers and
+// are always allowed.
+func (s *Server) originAllowed(origin, host string) bool {
+	if origin == "" {
+		return true
+	}
+	origins := s.config().WebSocket.Origins
+	if len(origins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host != "" && strings.EqualFold(u.Host, host)
+	}
+	for _, pattern := range origins {
+		if matchMask("ascii", pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func protocolName(p string) string {
+	if p == "" {
+		return "no subprotocol"
+	}
+	return p
+}
+
+// headerTokens returns the comma separated values of the header name.
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// headerContains reports whether the header name lists token, ignoring
+// case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, t := range headerTokens(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read returns the lines of the messages received from the client, each
+// ended by CR LF.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		line := strings.TrimRight(string(msg), "\r\n")
+		if err == nil && strings.ContainsAny(line, "\r\n") {
+			err = &wsError{wsCloseProtocol, "several lines in one message"}
+		}
+		if err != nil {
+			var wsErr *wsError
+			if errors.As(err, &wsErr) {
+				c.writeClose(wsErr.code, wsErr.reason)
+			}
+			return 0, err
+		}
+		if line != "" {
+			c.pending = []byte(line + "\r\n")
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads the next data message, answering control frames on
+// the way.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	var msgOp byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeClose(wsCloseNormal, "")
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if msgOp != 0 {
+				return nil, &wsError{wsCloseProtocol, "expected continuation frame"}
+			}
+			msgOp = op
+		case wsContinuation:
+			if msgOp == 0 {
+				return nil, &wsError{wsCloseProtocol, "unexpected continuation frame"}
+			}
+		default:
+			return nil, &wsError{wsCloseProtocol, "unknown opcode"}
+		}
+		if len(msg)+len(payload) > maxWSMessage {
+			return nil, &wsError{wsCloseTooBig, "message too big"}
+		}
+		msg = append(msg, payload...)
+		if msgOp == wsText && fin && !utf8.Valid(msg) {
+			return nil, &wsError{wsCloseInvalid, "invalid UTF-8"}
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// readFrame reads one frame. Frames from clients must be masked.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 {
+		err = &wsError{wsCloseProtocol, "reserved bits set"}
+		return
+	}
+	if head[1]&0x80 == 0 {
+		err = &wsError{wsCloseProtocol, "unmasked frame"}
+		return
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsClose && (length > 125 || !fin) {
+		err = &wsError{wsCloseProtocol, "invalid control frame"}
+		return
+	}
+	if length > maxWSMessage {
+		err = &wsError{wsCloseTooBig, "message too big"}
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// Write sends each line in p as a message of its own.
+func (c *wsConn) Write(p []byte) (int, error) {
+	op := byte(wsText)
+	if c.binary {
+		op = wsBinary
+	}
+	for _, line := range strings.Split(string(p), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if op == wsText && !utf8.ValidString(line) {
+			line = strings.ToValidUTF8(line, "�")
+		}
+		if err := c.writeFrame(op, []byte(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeFrame sends an unfragmented, unmasked frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	if op == wsClose {
+		c.closed = true
+	}
+	return err
+}
+
+// writeClose starts the closing handshake with code and reason.
+func (c *wsConn) writeClose(code int, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	c.writeFrame(wsClose, append(payload, reason...))
+}
+
+// Close sends a close frame if none was sent yet and closes the
+// connection.
+func (c *wsConn) Close() error {
+	c.writeClose(wsCloseNormal, "")
+	return c.Conn.Close()
+}
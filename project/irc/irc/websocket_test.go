@@ -0,0 +1,168 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient is a minimal WebSocket client speaking IRC.
+type wsTestClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	resp *http.Response
+}
+
+// dialWebSocket opens a WebSocket connection to s offering protocol, with
+// origin as the Origin header when set.
+func dialWebSocket(t *testing.T, s *Server, protocol, origin string) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.WebSocketAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req := "GET / HTTP/1.1\r\nHost: " + s.WebSocketAddr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+	if protocol != "" {
+		req += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	if origin != "" {
+		req += "Origin: " + origin + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsTestClient{conn: conn, r: r, resp: resp}
+}
+
+// writeFrame sends a masked frame.
+func (c *wsTestClient) writeFrame(t *testing.T, op byte, payload string) {
+	t.Helper()
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads an unmasked frame sent by the server.
+func (c *wsTestClient) readFrame(t *testing.T) (byte, string) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := int(head[1] & 0x7F)
+	if n == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0F, string(payload)
+}
+
+// readUntil reads frames until one contains substr and returns it.
+func (c *wsTestClient) readUntil(t *testing.T, substr string) (byte, string) {
+	t.Helper()
+	for {
+		op, line := c.readFrame(t)
+		if strings.Contains(line, substr) {
+			return op, line
+		}
+	}
+}
+
+func webSocketConfig(origins ...string) Config {
+	cfg := DefaultConfig()
+	cfg.WebSocket = WebSocketConfig{Addr: "127.0.0.1:0", Origins: origins}
+	return cfg
+}
+
+func TestWebSocketClientSharesChannels(t *testing.T) {
+	s := startServer(t, webSocketConfig())
+	ws := dialWebSocket(t, s, "binary.ircv3.net, text.ircv3.net", "")
+	if ws.resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered with %s", ws.resp.Status)
+	}
+	if p := ws.resp.Header.Get("Sec-WebSocket-Protocol"); p != "binary.ircv3.net" {
+		t.Fatalf("negotiated protocol %q, want the first one offered", p)
+	}
+	ws.writeFrame(t, wsBinary, "NICK web")
+	ws.writeFrame(t, wsBinary, "USER web 0 * :Web Client\r\n")
+	if op, line := ws.readUntil(t, " 001 web "); op != wsBinary || strings.HasSuffix(line, "\n") {
+		t.Fatalf("got opcode %d line %q, want one binary message per line", op, line)
+	}
+	ws.writeFrame(t, wsBinary, "JOIN #room")
+	ws.readUntil(t, " 366 web #room ")
+
+	alice := login(t, s, "alice")
+	alice.Join("#room")
+	ws.readUntil(t, ":alice JOIN #room")
+	alice.Msg("#room", "hello browser")
+	ws.readUntil(t, ":alice PRIVMSG #room :hello browser")
+
+	ws.writeFrame(t, wsPing, "are you there")
+	if _, payload := ws.readUntil(t, "are you there"); payload != "are you there" {
+		t.Fatalf("unexpected pong payload %q", payload)
+	}
+	ws.writeFrame(t, wsBinary, "PRIVMSG #room :hello terminal")
+	readUntil(t, alice, ":web PRIVMSG #room :hello terminal")
+}
+
+func TestWebSocketSameOriginByDefault(t *testing.T) {
+	s := startServer(t, webSocketConfig())
+	refused := dialWebSocket(t, s, "", "https://evil.example.com")
+	if refused.resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("foreign origin answered with %s", refused.resp.Status)
+	}
+	ws := dialWebSocket(t, s, "", "http://"+s.WebSocketAddr)
+	if ws.resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("same origin answered with %s", ws.resp.Status)
+	}
+}
+
+func TestWebSocketTextProtocolAndOrigins(t *testing.T) {
+	s := startServer(t, webSocketConfig("https://chat.example.com", "https://*.vibes.test"))
+
+	refused := dialWebSocket(t, s, "text.ircv3.net", "https://evil.example.com")
+	if refused.resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("foreign origin answered with %s", refused.resp.Status)
+	}
+
+	ws := dialWebSocket(t, s, "", "https://app.vibes.test")
+	if ws.resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("allowed origin answered with %s", ws.resp.Status)
+	}
+	ws.writeFrame(t, wsText, "NICK web")
+	ws.writeFrame(t, wsText, "USER web 0 * :Web Client")
+	if op, _ := ws.readUntil(t, " 001 web "); op != wsText {
+		t.Fatalf("got opcode %d without a subprotocol, want text", op)
+	}
+	ws.writeFrame(t, wsText, "PING :one\r\nPING :two")
+	if op, payload := ws.readUntil(t, "several lines"); op != wsClose || binary.BigEndian.Uint16([]byte(payload)) != wsCloseProtocol {
+		t.Fatalf("got opcode %d payload %q, want a protocol error close", op, payload)
+	}
+}
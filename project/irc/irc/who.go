@@ -0,0 +1,205 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+)
+
+// matchMask reports whether name matches the wildcard mask, where '*'
+// matches any run of characters and '?' matches exactly one. Both are
+// compared under the given casemapping.
+func matchMask(mapping, mask, name string) bool {
+	return matchFolded(foldCase(mapping, mask), foldCase(mapping, name))
+}
+
+// matchFolded matches with two pointers, backtracking only to the last
+// '*', so that it takes O(len(mask)*len(name)) time whatever the mask.
+func matchFolded(mask, name string) bool {
+	m, n := 0, 0
+	star, next := -1, 0
+	for n < len(name) {
+		switch {
+		case m < len(mask) && (mask[m] == '?' || mask[m] == name[n]):
+			m++
+			n++
+		case m < len(mask) && mask[m] == '*':
+			star, next = m, n
+			m++
+		case star >= 0:
+			// Let the last '*' swallow one more character.
+			next++
+			m, n = star+1, next
+		default:
+			return false
+		}
+	}
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+	return m == len(mask)
+}
+
+// sharesChannel reports whether a and b are on a common channel.
+func sharesChannel(a, b *Client) bool {
+	for _, key := range a.channelKeys() {
+		if b.onChannel(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleTo reports whether target shows up in WHO and NAMES replies sent
+// to c. Invisible users are only listed to users sharing a channel with
+// them and to operators. The caller must hold s.mu.
+func visibleTo(c, target *Client) bool {
+	return c == target || !target.hasMode('i') || c.hasMode('o') || sharesChannel(c, target)
+}
+
+// whoFlags returns the flags column of RPL_WHOREPLY. The caller must hold
+// s.mu.
+func whoFlags(target *Client) string {
+	flags := "H"
+	if target.hasMode('o') {
+		flags += "*"
+	}
+	if target.hasMode('B') {
+		flags += "B"
+	}
+	return flags
+}
+
+type whoEntry struct {
+	channel string
+	client  *Client
+	flags   string
+	server  string
+}
+
+// serverOf returns the name of the server c is on. The caller must hold
+// s.mu.
+func (s *Server) serverOf(c *Client) string {
+	if c.server != nil {
+		return c.server.name
+	}
+	return s.cfg.Load().ServerName
+}
+
+func (s *Server) handleWho(c *Client, params []string) {
+	mask := "*"
+	if len(params) > 0 && params[0] != "" && params[0] != "0" {
+		mask = params[0]
+	}
+	var entries []whoEntry
+	s.mu.RLock()
+	if ch := s.channels.get(s.fold(mask)); ch != nil {
+		for m := range ch.members() {
+			if visibleTo(c, m) {
+				entries = append(entries, whoEntry{ch.Name, m, whoFlags(m), s.serverOf(m)})
+			}
+		}
+	} else {
+		for _, m := range s.nicks.all() {
+			if matchMask(s.cfg.Load().CaseMapping, mask, m.nickname()) && visibleTo(c, m) {
+				entries = append(entries, whoEntry{"*", m, whoFlags(m), s.serverOf(m)})
+			}
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].client.nickname() < entries[j].client.nickname() })
+	for _, e := range entries {
+		s.numeric(c, rplWhoReply, e.channel, e.client.Username, e.client.Host, e.server,
+			e.client.nickname(), e.flags, "0 "+e.client.Realname)
+	}
+	s.numeric(c, rplEndOfWho, mask, "End of /WHO list")
+}
+
+func (s *Server) handleWhois(c *Client, params []string) {
+	if len(params) == 0 {
+		s.numeric(c, errNoNicknameGiven, "No nickname given")
+		return
+	}
+	nick := params[len(params)-1]
+	s.mu.RLock()
+	target := s.nicks.get(s.fold(nick))
+	var channels []string
+	var oper, bot, secure bool
+	account, server, desc := "", "", serverDescription
+	user, realname := "", ""
+	if target != nil {
+		user, realname = target.Username, target.Realname
+		channels = s.channelNames(target)
+		oper, bot, secure = target.hasMode('o'), target.hasMode('B'), target.hasMode('Z')
+		account = target.account
+		server = s.serverOf(target)
+		if target.server != nil {
+			desc = target.server.desc
+		}
+	}
+	s.mu.RUnlock()
+	if target == nil {
+		s.numeric(c, errNoSuchNick, nick, "No such nick/channel")
+		s.numeric(c, rplEndOfWhois, nick, "End of /WHOIS list")
+		return
+	}
+	s.numeric(c, rplWhoisUser, target.nickname(), user, target.Host, "*", realname)
+	if len(channels) > 0 {
+		s.numeric(c, rplWhoisChannels, target.nickname(), strings.Join(channels, " "))
+	}
+	s.numeric(c, rplWhoisServer, target.nickname(), server, desc)
+	if oper {
+		s.numeric(c, rplWhoisOperator, target.nickname(), "is an IRC operator")
+	}
+	if account != "" {
+		s.numeric(c, rplWhoisAccount, target.nickname(), account, "is logged in as")
+	}
+	if bot {
+		s.numeric(c, rplWhoisBot, target.nickname(), "is a bot")
+	}
+	if secure {
+		s.numeric(c, rplWhoisSecure, target.nickname(), "is using a secure connection")
+	}
+	s.numeric(c, rplEndOfWhois, target.nickname(), "End of /WHOIS list")
+}
+
+func (s *Server) handleNames(c *Client, params []string) {
+	if len(params) == 0 || params[0] == "" {
+		s.numeric(c, rplEndOfNames, "*", "End of /NAMES list")
+		return
+	}
+	for _, name := range strings.Split(params[0], ",") {
+		s.sendNames(c, name)
+	}
+}
+
+// sendNames sends the RPL_NAMREPLY lines for one channel followed by
+// RPL_ENDOFNAMES.
+func (s *Server) sendNames(c *Client, name string) {
+	s.mu.RLock()
+	ch := s.channels.get(s.fold(name))
+	var nicks []string
+	if ch != nil {
+		name = ch.Name
+		for m := range ch.members() {
+			if visibleTo(c, m) {
+				nicks = append(nicks, m.nickname())
+			}
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(nicks)
+	// Keep each reply comfortably below the line length limit.
+	for len(nicks) > 0 {
+		n, size := 0, 0
+		for n < len(nicks) && size+len(nicks[n])+1 < 400 {
+			size += len(nicks[n]) + 1
+			n++
+		}
+		if n == 0 {
+			n = 1
+		}
+		s.numeric(c, rplNamReply, "=", name, strings.Join(nicks[:n], " "))
+		nicks = nicks[n:]
+	}
+	s.numeric(c, rplEndOfNames, name, "End of /NAMES list")
+}
@@ -0,0 +1,129 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+
+	ic "vibes/client"
+)
+
+func TestMatchMask(t *testing.T) {
+	cases := []struct {
+		mask, name string
+		want       bool
+	}{
+		{"*", "alice", true},
+		{"al*", "Alice", true},
+		{"a?ice", "alice", true},
+		{"a?ice", "aice", false},
+		{"*ce", "alice", true},
+		{"b*", "alice", false},
+		{"nick[1]", "NICK{1}", true},
+		{"", "", true},
+		{"", "a", false},
+		{"**", "", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+		{"a*?", "a", false},
+		{"a*?", "ab", true},
+		// Backtracking over every star would take exponential time here.
+		{strings.Repeat("*a", 14) + "*b", strings.Repeat("a", 29), false},
+		{strings.Repeat("*a", 14) + "*b", strings.Repeat("a", 29) + "b", true},
+	}
+	for _, tc := range cases {
+		if got := matchMask("rfc1459", tc.mask, tc.name); got != tc.want {
+			t.Errorf("matchMask(%q, %q) = %v, want %v", tc.mask, tc.name, got, tc.want)
+		}
+	}
+}
+
+// readWho sends WHO mask as c and returns the RPL_WHOREPLY lines.
+func readWho(t *testing.T, c *ic.Client, nick, mask string) []string {
+	t.Helper()
+	c.Send("WHO " + mask)
+	var replies []string
+	for {
+		line := readUntil(t, c, " "+nick+" ")
+		switch {
+		case strings.Contains(line, " 352 "):
+			replies = append(replies, line)
+		case strings.Contains(line, " 315 "):
+			return replies
+		}
+	}
+}
+
+func TestWhoHidesInvisibleUsers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Opers = []OperConfig{{Name: "admin", Password: "secret"}}
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	bob := login(t, s, "bob")
+	carol := login(t, s, "carol")
+	oper := login(t, s, "oper")
+
+	alice.Send("MODE alice +i")
+	readUntil(t, alice, "MODE alice :+i")
+	alice.Join("#hidden")
+	readUntil(t, alice, " 366 alice #hidden ")
+	carol.Join("#hidden")
+	readUntil(t, carol, " 366 carol #hidden ")
+	oper.Send("OPER admin secret")
+	readUntil(t, oper, "MODE oper :+o")
+
+	// bob shares no channel with alice: she is left out of WHO for the
+	// channel, for a mask and for her nick, and out of NAMES.
+	for _, mask := range []string{"#hidden", "a*", "alice"} {
+		for _, line := range readWho(t, bob, "bob", mask) {
+			if strings.Contains(line, " alice ") {
+				t.Errorf("WHO %s shows invisible user: %q", mask, line)
+			}
+		}
+	}
+	bob.Send("NAMES #hidden")
+	if line := readUntil(t, bob, " #hidden "); !strings.Contains(line, " 353 ") || strings.Contains(line, "alice") {
+		t.Errorf("NAMES shows invisible user: %q", line)
+	}
+
+	// Users sharing a channel with her and operators still see her.
+	if replies := readWho(t, carol, "carol", "a*"); len(replies) != 1 || !strings.Contains(replies[0], " alice ") {
+		t.Errorf("WHO a* to channel member = %q", replies)
+	}
+	if replies := readWho(t, oper, "oper", "alice"); len(replies) != 1 {
+		t.Errorf("WHO alice to operator = %q", replies)
+	}
+	oper.Send("NAMES #hidden")
+	if line := readUntil(t, oper, " 353 oper "); !strings.Contains(line, "alice") {
+		t.Errorf("NAMES to operator: %q", line)
+	}
+}
+
+func TestWhoFlags(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Opers = []OperConfig{{Name: "admin", Password: "secret"}}
+	s := startServer(t, cfg)
+	alice := login(t, s, "alice")
+	bot := login(t, s, "bot")
+	oper := login(t, s, "oper")
+	for _, c := range []*ic.Client{alice, bot, oper} {
+		c.Join("#flags")
+		readUntil(t, c, " 366 ")
+	}
+	bot.Send("MODE bot +B")
+	readUntil(t, bot, "MODE bot :+B")
+	oper.Send("OPER admin secret")
+	readUntil(t, oper, "MODE oper :+o")
+
+	want := map[string]string{"alice": "H", "bot": "HB", "oper": "H*"}
+	replies := readWho(t, alice, "alice", "#flags")
+	if len(replies) != len(want) {
+		t.Fatalf("WHO #flags = %q", replies)
+	}
+	for _, line := range replies {
+		// :server 352 alice #flags user host server nick flags :0 realname
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[8] != want[fields[7]] {
+			t.Errorf("unexpected WHO reply %q", line)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package irc
+
+import (
+	"strconv"
+	"time"
+)
+
+// whowasEntry records a nickname that was given up by a quit or a nick
+// change.
+type whowasEntry struct {
+	key      string
+	nick     string
+	user     string
+	host     string
+	realname string
+	when     time.Time
+}
+
+// whowasHistory is a fixed size ring of departed nicknames. Once full, new
+// entries overwrite the oldest ones.
+type whowasHistory struct {
+	entries []whowasEntry
+	next    int
+	full    bool
+}
+
+func newWhowasHistory(size int) *whowasHistory {
+	return &whowasHistory{entries: make([]whowasEntry, size)}
+}
+
+func (h *whowasHistory) add(e whowasEntry) {
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// lookup returns up to count entries recorded for key, newest first. A
+// count of zero or less returns every entry.
+func (h *whowasHistory) lookup(key string, count int) []whowasEntry {
+	var found []whowasEntry
+	for _, e := range h.all() {
+		if e.key != key {
+			continue
+		}
+		found = append(found, e)
+		if count > 0 && len(found) == count {
+			break
+		}
+	}
+	return found
+}
+
+// resize changes the capacity of the ring, keeping the newest entries.
+func (h *whowasHistory) resize(size int) *whowasHistory {
+	if size == len(h.entries) {
+		return h
+	}
+	all := h.all()
+	nh := newWhowasHistory(size)
+	for i := len(all) - 1; i >= 0; i-- {
+		nh.add(all[i])
+	}
+	return nh
+}
+
+// all returns every entry, newest first.
+func (h *whowasHistory) all() []whowasEntry {
+	n := h.next
+	if h.full {
+		n = len(h.entries)
+	}
+	all := make([]whowasEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		all = append(all, h.entries[(h.next-i+len(h.entries))%len(h.entries)])
+	}
+	return all
+}
+
+// recordWhowas remembers the current identity of c. The caller must hold
+// s.mu.
+func (s *Server) recordWhowas(c *Client) {
+	if !c.registered || c.nickname() == "" {
+		return
+	}
+	s.whowas.add(whowasEntry{
+		key:      s.fold(c.nickname()),
+		nick:     c.nickname(),
+		user:     c.Username,
+		host:     c.Host,
+		realname: c.Realname,
+		when:     time.Now(),
+	})
+}
+
+func (s *Server) handleWhowas(c *Client, params []string) {
+	if len(params) == 0 || params[0] == "" {
+		s.numeric(c, errNoNicknameGiven, "No nickname given")
+		return
+	}
+	nick := params[0]
+	count := 0
+	if len(params) > 1 {
+		count, _ = strconv.Atoi(params[1])
+	}
+	s.mu.Lock()
+	entries := s.whowas.lookup(s.fold(nick), count)
+	server := s.cfg.Load().ServerName
+	s.mu.Unlock()
+
+	if len(entries) == 0 {
+		s.numeric(c, errWasNoSuchNick, nick, "There was no such nickname")
+	}
+	for _, e := range entries {
+		s.numeric(c, rplWhowasUser, e.nick, e.user, e.host, "*", e.realname)
+		s.numeric(c, rplWhoisServer, e.nick, server, e.when.Format(time.RFC1123))
+	}
+	s.numeric(c, rplEndOfWhowas, nick, "End of WHOWAS")
+}
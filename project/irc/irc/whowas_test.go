@@ -0,0 +1,47 @@
+package irc
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWhowasHistoryRing(t *testing.T) {
+	h := newWhowasHistory(3)
+	for i := 0; i < 5; i++ {
+		h.add(whowasEntry{key: "alice", nick: fmt.Sprint("alice", i)})
+	}
+	got := h.lookup("alice", 0)
+	if len(got) != 3 || got[0].nick != "alice4" || got[2].nick != "alice2" {
+		t.Errorf("unexpected entries %+v", got)
+	}
+	if got := h.lookup("alice", 2); len(got) != 2 {
+		t.Errorf("count not applied: %d entries", len(got))
+	}
+	if got := h.resize(2).lookup("alice", 0); len(got) != 2 || got[0].nick != "alice4" {
+		t.Errorf("resize lost newest entries: %+v", got)
+	}
+}
+
+func TestWhowasAfterNickChangeAndQuit(t *testing.T) {
+	s := startServer(t, DefaultConfig())
+	c := login(t, s, "alice")
+	bob := login(t, s, "bob")
+
+	c.Send("NICK carol")
+	readUntil(t, c, "NICK carol")
+	c.Join("#room")
+	readUntil(t, c, ":carol JOIN")
+	bob.Join("#room")
+	readUntil(t, c, ":bob JOIN")
+	bob.Send("QUIT")
+	// bob leaving the channel is announced after the entry is recorded.
+	readUntil(t, c, ":bob ")
+
+	c.Send("WHOWAS ALICE")
+	readUntil(t, c, " 314 carol alice alice ")
+	readUntil(t, c, " 369 carol ALICE ")
+	c.Send("WHOWAS bob 1")
+	readUntil(t, c, " 314 carol bob bob ")
+	c.Send("WHOWAS nobody")
+	readUntil(t, c, " 406 carol nobody ")
+}
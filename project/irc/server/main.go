@@ -1,24 +1,68 @@
 package main
 
 import (
-	"io"
+	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"vibes/irc"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to a JSON configuration file")
+	flag.Parse()
+
 	logFile, err := os.OpenFile("server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		log.Fatalf("failed to open log file: %v", err)
 	}
-	irc.Logger = log.New(logFile, "", log.LstdFlags)
-	irc.ErrorLogger = log.New(io.MultiWriter(logFile, os.Stderr), "ERROR: ", log.LstdFlags)
+
+	cfg := irc.DefaultConfig()
+	if *configPath != "" {
+		if cfg, err = irc.LoadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	addr := ":6667"
-	s := irc.NewServer(addr)
+	s := irc.NewServerWithConfig(addr, cfg)
+	// Every event goes to server.log, errors to stderr as well.
+	fileSink, stderrSink := irc.NewJSONSink(logFile), irc.NewJSONSink(os.Stderr)
+	s.SetLogSink(irc.LogSinkFunc(func(e irc.Event) {
+		fileSink.Log(e)
+		if e.Level >= irc.LevelError {
+			stderrSink.Log(e)
+		}
+	}))
+
+	// SIGHUP reloads the configuration file.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if *configPath == "" {
+				continue
+			}
+			cfg, err := irc.LoadConfig(*configPath)
+			if err != nil {
+				log.Println("rehash failed:", err)
+				continue
+			}
+			s.Rehash(cfg)
+		}
+	}()
+
+	// SIGINT and SIGTERM close the server, which writes a last snapshot.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		s.Close()
+	}()
+
 	if err := s.Run(); err != nil {
-		irc.ErrorLogger.Fatal(err)
+		log.Fatal(err)
 	}
 }